@@ -0,0 +1,38 @@
+// Выгружает правила доступа к топикам (настройка mqtt_acl) в формате acl_file брокера mosquitto.
+//
+//	MQTT_ACL="allow pub object_manager/#; allow sub #" go run ./cmd/mqtt-acl -user object_manager >> /etc/mosquitto/acl
+//
+// Если часть правил не выражается в mosquitto (запреты только pub или только sub), выгрузка не выполняется.
+// С флагом -force такие правила выгружаются комментариями, а предупреждение выводится в stderr.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/acl"
+)
+
+func main() {
+	rules := flag.String("rules", os.Getenv("MQTT_ACL"), "ACL rules (default from MQTT_ACL)")
+	user := flag.String("user", "", "Broker user name of the service")
+	force := flag.Bool("force", false, "Export even if some rules are not supported by mosquitto")
+	flag.Parse()
+
+	a, err := acl.Parse(*rules)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	text, err := a.Mosquitto(*user)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if !*force {
+			os.Exit(1)
+		}
+	}
+
+	fmt.Print(text)
+}
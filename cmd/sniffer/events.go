@@ -0,0 +1,17 @@
+package main
+
+// Регистрируем события (без пакета service, чтобы не тянуть в сниффер БД и брокер)
+import (
+	_ "github.com/VladimirDronik/touchon-server/events"
+	_ "github.com/VladimirDronik/touchon-server/events/item"
+	_ "github.com/VladimirDronik/touchon-server/events/object/controller"
+	_ "github.com/VladimirDronik/touchon-server/events/object/generic_input"
+	_ "github.com/VladimirDronik/touchon-server/events/object/onokom/gateway"
+	_ "github.com/VladimirDronik/touchon-server/events/object/port"
+	_ "github.com/VladimirDronik/touchon-server/events/object/regulator"
+	_ "github.com/VladimirDronik/touchon-server/events/object/relay"
+	_ "github.com/VladimirDronik/touchon-server/events/object/sensor"
+	_ "github.com/VladimirDronik/touchon-server/events/object/wiren_board/wb_mrm2_mini"
+	_ "github.com/VladimirDronik/touchon-server/events/script"
+	_ "github.com/VladimirDronik/touchon-server/events/service"
+)
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+// filter Условия отбора сообщений
+type filter struct {
+	publishers  map[string]bool
+	msgType     messages.MessageType
+	names       map[string]bool
+	targetTypes map[string]bool
+	targetIDs   map[int]bool
+	props       []*propPredicate
+}
+
+func (o *filter) match(m messages.Message) bool {
+	switch {
+	case len(o.publishers) > 0 && !o.publishers[m.GetPublisher()]:
+		return false
+	case o.msgType != "" && o.msgType != m.GetType():
+		return false
+	case len(o.names) > 0 && !o.names[m.GetName()]:
+		return false
+	case len(o.targetTypes) > 0 && !o.targetTypes[m.GetTargetType()]:
+		return false
+	case len(o.targetIDs) > 0 && !o.targetIDs[m.GetTargetID()]:
+		return false
+	}
+
+	for _, p := range o.props {
+		if !p.match(m.GetPayload()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Операторы сравнения в порядке разбора (сначала двухсимвольные)
+var propOperators = []string{"!=", ">=", "<=", "=", ">", "<", "~"}
+
+// propPredicate Условие на значение свойства: state=on, value>=20, msg~ошибка
+type propPredicate struct {
+	name  string
+	op    string
+	value string
+}
+
+func parsePropPredicate(s string) (*propPredicate, error) {
+	for _, op := range propOperators {
+		i := strings.Index(s, op)
+		if i < 1 {
+			continue
+		}
+
+		// Для "a>=1" оператор "=" не должен разбирать строку как "a>" = "1"
+		name := strings.TrimSpace(s[:i])
+		if strings.ContainsAny(name, "!<>=~") {
+			continue
+		}
+
+		return &propPredicate{name: name, op: op, value: strings.TrimSpace(s[i+len(op):])}, nil
+	}
+
+	return nil, errors.Wrap(errors.Errorf("bad prop predicate %q, expected name<op>value, op is one of %s", s, strings.Join(propOperators, " ")), "parsePropPredicate")
+}
+
+func (o *propPredicate) match(payload map[string]interface{}) bool {
+	v, ok := payload[o.name]
+	if !ok {
+		return o.op == "!="
+	}
+
+	actual := fmt.Sprint(v)
+
+	switch o.op {
+	case "=":
+		return actual == o.value
+	case "!=":
+		return actual != o.value
+	case "~":
+		return strings.Contains(actual, o.value)
+	}
+
+	// Остальные операторы сравнивают числа
+	a, err := strconv.ParseFloat(actual, 64)
+	if err != nil {
+		return false
+	}
+
+	b, err := strconv.ParseFloat(o.value, 64)
+	if err != nil {
+		return false
+	}
+
+	switch o.op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	default:
+		return false
+	}
+}
+
+// propFlags Значение флага -prop, который можно указать несколько раз
+type propFlags []*propPredicate
+
+func (o *propFlags) String() string {
+	items := make([]string, 0, len(*o))
+	for _, p := range *o {
+		items = append(items, p.name+p.op+p.value)
+	}
+
+	return strings.Join(items, ",")
+}
+
+func (o *propFlags) Set(s string) error {
+	p, err := parsePropPredicate(s)
+	if err != nil {
+		return err
+	}
+
+	*o = append(*o, p)
+
+	return nil
+}
+
+// splitList Разбирает список значений, перечисленных через запятую
+func splitList(s string) map[string]bool {
+	r := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			r[item] = true
+		}
+	}
+
+	return r
+}
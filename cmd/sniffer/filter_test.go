@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestPropPredicate(t *testing.T) {
+	payload := map[string]interface{}{"state": "on", "value": 21.5, "msg": "a=b"}
+
+	tests := []struct {
+		predicate string
+		want      bool
+	}{
+		{"state=on", true},
+		{"state!=on", false},
+		{"value>=21.5", true},
+		{"value>22", false},
+		{"value<22", true},
+		{"msg~a=b", true},
+		{"missing!=1", true},
+		{"missing=1", false},
+	}
+
+	for _, tt := range tests {
+		p, err := parsePropPredicate(tt.predicate)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := p.match(payload); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.predicate, got, tt.want)
+		}
+	}
+
+	if _, err := parsePropPredicate("state"); err == nil {
+		t.Error("predicate without operator must fail")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/event"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	mqttService "github.com/VladimirDronik/touchon-server/mqtt/service"
+)
+
+// printMessage Выводит сообщение в читаемом виде:
+//
+//	15:04:05.000 [object_manager/event/relay] event object.relay.on_state_on (Реле включено) object#5 travel=1.2ms
+//	    state (Состояние) = on
+func printMessage(w io.Writer, m messages.Message) {
+	sb := &strings.Builder{}
+
+	fmt.Fprintf(sb, "%s [%s] %s %s", m.GetReceivedAt().Format("15:04:05.000"), m.GetTopic(), m.GetType(), m.GetName())
+
+	// Для зарегистрированных событий выводим человекочитаемые названия
+	var e *event.Event
+	if m.GetType() == messages.MessageTypeEvent {
+		e, _ = event.FromMqttMessage(m, false)
+	}
+
+	if e != nil && e.Name != "" && e.Name != m.GetName() {
+		fmt.Fprintf(sb, " (%s)", e.Name)
+	}
+
+	if m.GetTargetType() != "" || m.GetTargetID() > 0 {
+		fmt.Fprintf(sb, " %s#%d", m.GetTargetType(), m.GetTargetID())
+	}
+
+	if travelTime, ok := mqttService.TravelTime(m); ok {
+		fmt.Fprintf(sb, " travel=%s", travelTime.Round(time.Microsecond))
+	}
+
+	sb.WriteString("\n")
+
+	for _, k := range sortedKeys(m.GetPayload()) {
+		label := k
+		if e != nil {
+			if p, err := e.Props.Get(k); err == nil && p.Name != "" && p.Name != k {
+				label = fmt.Sprintf("%s (%s)", k, p.Name)
+			}
+		}
+
+		fmt.Fprintf(sb, "    %s = %v\n", label, m.GetPayload()[k])
+	}
+
+	_, _ = io.WriteString(w, sb.String())
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"github.com/VladimirDronik/touchon-server/event"
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	maker := func() (*event.Event, error) {
+		e := &event.Event{
+			Code:        "service.on_cluster_info",
+			Name:        "on_cluster_info",
+			Description: "Сводная информация о сервисах",
+			Props:       event.NewProps(),
+			TargetType:  messages.TargetTypeService,
+		}
+
+		msg := &event.Prop{
+			Code: "info",
+			Name: "Информация",
+			Item: &models.Item{
+				Type: models.DataTypeInterface,
+			},
+		}
+
+		if err := e.Props.Add(msg); err != nil {
+			return nil, errors.Wrap(err, "init.maker")
+		}
+
+		return e, nil
+	}
+
+	// Для регистрации событий надо в service/init.go добавить импорт данного _пакета_!
+	if err := event.Register(maker); err != nil {
+		panic(err)
+	}
+}
+
+func NewOnClusterInfoMessage(topic string, clusterInfo interface{}) (messages.Message, error) {
+	e, err := event.MakeEvent("service.on_cluster_info", messages.TargetTypeService, 0, map[string]interface{}{"info": clusterInfo})
+	if err != nil {
+		return nil, errors.Wrap(err, "NewOnClusterInfoMessage")
+	}
+
+	m, err := e.ToMqttMessage(topic)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewOnClusterInfoMessage")
+	}
+
+	return m, nil
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"github.com/VladimirDronik/touchon-server/event"
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	maker := func() (*event.Event, error) {
+		e := &event.Event{
+			Code:        "service.on_metrics",
+			Name:        "on_metrics",
+			Description: "Сводка метрик сервиса",
+			Props:       event.NewProps(),
+			TargetType:  messages.TargetTypeService,
+		}
+
+		msg := &event.Prop{
+			Code: "metrics",
+			Name: "Метрики",
+			Item: &models.Item{
+				Type: models.DataTypeInterface,
+			},
+		}
+
+		if err := e.Props.Add(msg); err != nil {
+			return nil, errors.Wrap(err, "init.maker")
+		}
+
+		return e, nil
+	}
+
+	// Для регистрации событий надо в service/init.go добавить импорт данного _пакета_!
+	if err := event.Register(maker); err != nil {
+		panic(err)
+	}
+}
+
+func NewOnMetricsMessage(topic string, metrics interface{}) (messages.Message, error) {
+	e, err := event.MakeEvent("service.on_metrics", messages.TargetTypeService, 0, map[string]interface{}{"metrics": metrics})
+	if err != nil {
+		return nil, errors.Wrap(err, "NewOnMetricsMessage")
+	}
+
+	m, err := e.ToMqttMessage(topic)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewOnMetricsMessage")
+	}
+
+	return m, nil
+}
@@ -0,0 +1,277 @@
+// Пакет приведения значений, полученных из JSON, сообщений шины и настроек, к нужному типу.
+// Используется сообщениями шины (messages.Message), свойствами (models.Item) и хэлперами,
+// чтобы одно и то же значение одинаково читалось на всех уровнях.
+//
+// Правила приведения:
+//   - целые: любые целые и вещественные числа (дробная часть отбрасывается), строки с целым числом;
+//   - вещественные: любые числа, строки с числом;
+//   - логические: bool, строки, которые понимает strconv.ParseBool ("true", "1", "f" и т.д.);
+//   - строки: строки, []byte, числа и логические значения (в десятичном виде);
+//   - время: time.Time, строки в форматах TimeFormats, числа (unix-время в миллисекундах, как в конверте сообщения);
+//   - длительность: time.Duration, строки в формате time.ParseDuration, числа и строки с числом (секунды);
+//   - списки и объекты: срезы и map любого типа.
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeFormats Форматы, в которых принимается время
+var TimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02.01.2006 15:04:05.000000 MST", // Прежний формат времени в сообщениях шины
+}
+
+func ToInt(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case int8:
+		return int(v), nil
+	case int16:
+		return int(v), nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case uint:
+		return int(v), nil
+	case uint8:
+		return int(v), nil
+	case uint16:
+		return int(v), nil
+	case uint32:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case float32:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	case json.Number:
+		return ToInt(string(v))
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 0)
+		if err != nil {
+			return 0, errors.Wrap(errors.Errorf("value %q is not int", v), "ToInt")
+		}
+
+		return int(i), nil
+	}
+
+	return 0, errors.Wrap(errors.Errorf("value is not int (%T)", v), "ToInt")
+}
+
+func ToFloat64(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case json.Number:
+		return ToFloat64(string(v))
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, errors.Wrap(errors.Errorf("value %q is not float", v), "ToFloat64")
+		}
+
+		return f, nil
+	}
+
+	if i, err := ToInt(v); err == nil {
+		return float64(i), nil
+	}
+
+	return 0, errors.Wrap(errors.Errorf("value is not float (%T)", v), "ToFloat64")
+}
+
+func ToFloat32(v interface{}) (float32, error) {
+	if f, ok := v.(float32); ok {
+		return f, nil
+	}
+
+	f, err := ToFloat64(v)
+	if err != nil {
+		return 0, errors.Wrap(err, "ToFloat32")
+	}
+
+	return float32(f), nil
+}
+
+func ToBool(v interface{}) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, errors.Wrap(errors.Errorf("value %q is not bool", v), "ToBool")
+		}
+
+		return b, nil
+	}
+
+	return false, errors.Wrap(errors.Errorf("value is not bool (%T)", v), "ToBool")
+}
+
+func ToString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case json.Number:
+		return string(v), nil
+	}
+
+	if i, err := ToInt(v); err == nil {
+		return strconv.Itoa(i), nil
+	}
+
+	return "", errors.Wrap(errors.Errorf("value is not string (%T)", v), "ToString")
+}
+
+func ToTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, format := range TimeFormats {
+			if t, err := time.ParseInLocation(format, strings.TrimSpace(v), time.Local); err == nil {
+				return t, nil
+			}
+		}
+
+		return time.Time{}, errors.Wrap(errors.Errorf("value %q is not time", v), "ToTime")
+	}
+
+	if ms, err := ToFloat64(v); err == nil {
+		return time.UnixMilli(int64(ms)), nil
+	}
+
+	return time.Time{}, errors.Wrap(errors.Errorf("value is not time (%T)", v), "ToTime")
+}
+
+func ToDuration(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case time.Duration:
+		return v, nil
+	case string:
+		if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+			return d, nil
+		}
+	}
+
+	if sec, err := ToFloat64(v); err == nil && !math.IsNaN(sec) && !math.IsInf(sec, 0) {
+		return time.Duration(sec * float64(time.Second)), nil
+	}
+
+	return 0, errors.Wrap(errors.Errorf("value is not duration (%v)", v), "ToDuration")
+}
+
+func ToSlice(v interface{}) ([]interface{}, error) {
+	if s, ok := v.([]interface{}); ok {
+		return s, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, errors.Wrap(errors.Errorf("value is not list (%T)", v), "ToSlice")
+	}
+
+	r := make([]interface{}, rv.Len())
+	for i := range r {
+		r[i] = rv.Index(i).Interface()
+	}
+
+	return r, nil
+}
+
+func ToMap(v interface{}) (map[string]interface{}, error) {
+	if m, ok := v.(map[string]interface{}); ok {
+		return m, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil, errors.Wrap(errors.Errorf("value is not object (%T)", v), "ToMap")
+	}
+
+	r := make(map[string]interface{}, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		r[fmt.Sprint(iter.Key().Interface())] = iter.Value().Interface()
+	}
+
+	return r, nil
+}
+
+// Lookup Возвращает значение по имени или по пути вида "a.b.0" (элементы списков задаются индексом).
+// Ключ, содержащий точку, находится, если он задан целиком.
+func Lookup(m map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := m[path]; ok {
+		return v, true
+	}
+
+	if !strings.Contains(path, ".") {
+		return nil, false
+	}
+
+	var v interface{} = m
+	for _, key := range strings.Split(path, ".") {
+		switch {
+		case isMap(v):
+			obj, _ := ToMap(v)
+
+			var ok bool
+			if v, ok = obj[key]; !ok {
+				return nil, false
+			}
+
+		case isSlice(v):
+			list, _ := ToSlice(v)
+
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(list) {
+				return nil, false
+			}
+
+			v = list[i]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func isMap(v interface{}) bool {
+	return v != nil && reflect.TypeOf(v).Kind() == reflect.Map
+}
+
+func isSlice(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+
+	k := reflect.TypeOf(v).Kind()
+	return k == reflect.Slice || k == reflect.Array
+}
@@ -0,0 +1,113 @@
+package convert
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConvert(t *testing.T) {
+	type conv func(v interface{}) (interface{}, error)
+
+	toInt := func(v interface{}) (interface{}, error) { return ToInt(v) }
+	toFloat := func(v interface{}) (interface{}, error) { return ToFloat32(v) }
+	toBool := func(v interface{}) (interface{}, error) { return ToBool(v) }
+	toString := func(v interface{}) (interface{}, error) { return ToString(v) }
+	toDuration := func(v interface{}) (interface{}, error) { return ToDuration(v) }
+	toTime := func(v interface{}) (interface{}, error) { return ToTime(v) }
+
+	tests := []struct {
+		name    string
+		conv    conv
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"int from float64", toInt, 12.7, 12, false},
+		{"int from int64", toInt, int64(12), 12, false},
+		{"int from uint8", toInt, uint8(12), 12, false},
+		{"int from string", toInt, " 12 ", 12, false},
+		{"int from json.Number", toInt, json.Number("12"), 12, false},
+		{"int from float string", toInt, "1.5", nil, true},
+		{"int from bool", toInt, true, nil, true},
+		{"int from nil", toInt, nil, nil, true},
+
+		{"float from int64", toFloat, int64(3), float32(3), false},
+		{"float from float64", toFloat, 2.5, float32(2.5), false},
+		{"float from string", toFloat, "2.5", float32(2.5), false},
+		{"float from bad string", toFloat, "abc", nil, true},
+
+		{"bool from bool", toBool, true, true, false},
+		{"bool from string", toBool, "true", true, false},
+		{"bool from 0", toBool, "0", false, false},
+		{"bool from number", toBool, 1, nil, true},
+
+		{"string from string", toString, "on", "on", false},
+		{"string from float", toString, 2.5, "2.5", false},
+		{"string from int", toString, 7, "7", false},
+		{"string from bool", toString, false, "false", false},
+		{"string from map", toString, map[string]interface{}{}, nil, true},
+
+		{"duration from string", toDuration, "1m30s", 90 * time.Second, false},
+		{"duration from seconds", toDuration, 1.5, 1500 * time.Millisecond, false},
+		{"duration from seconds string", toDuration, "10", 10 * time.Second, false},
+		{"duration from bad string", toDuration, "soon", nil, true},
+
+		{"time from RFC3339", toTime, "2024-03-01T10:20:30Z", time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC), false},
+		{"time from unix ms", toTime, float64(1709288430000), time.UnixMilli(1709288430000), false},
+		{"time from bad string", toTime, "yesterday", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.conv(tt.value)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Fatalf("%s: expected error, got %v", tt.name, got)
+		case !tt.wantErr && err != nil:
+			t.Fatalf("%s: %v", tt.name, err)
+		case tt.wantErr:
+			continue
+		}
+
+		if wt, ok := tt.want.(time.Time); ok {
+			if !got.(time.Time).Equal(wt) {
+				t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+			continue
+		}
+
+		if got != tt.want {
+			t.Fatalf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	m := map[string]interface{}{
+		"a":   map[string]interface{}{"b": 1.0, "list": []interface{}{"x", map[string]interface{}{"c": true}}},
+		"a.b": "exact",
+		"ids": []int{5, 6},
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"a.b", "exact", true},
+		{"a.list.0", "x", true},
+		{"a.list.1.c", true, true},
+		{"ids.1", 6, true},
+		{"a.list.2", nil, false},
+		{"a.missing", nil, false},
+		{"a.b.c", nil, false},
+		{"missing", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := Lookup(m, tt.path)
+		if ok != tt.ok || got != tt.want {
+			t.Fatalf("%s: got %v, %v, want %v, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
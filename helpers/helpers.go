@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"sync"
 
+	"github.com/VladimirDronik/touchon-server/helpers/convert"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
@@ -170,19 +171,12 @@ func GetRequestID(ctx *fasthttp.RequestCtx) uint64 {
 	return 0
 }
 
+// GetNumber Приводит значение к целому числу (см. convert.ToInt)
 func GetNumber(v interface{}) (int, error) {
-	switch v := v.(type) {
-	case float64:
-		return int(v), nil
-	case int:
-		return v, nil
-	case int64:
-		return int(v), nil
-	case string:
-		if v, err := strconv.Atoi(v); err == nil {
-			return v, nil
-		}
+	i, err := convert.ToInt(v)
+	if err != nil {
+		return 0, errors.Wrap(err, "GetNumber")
 	}
 
-	return 0, errors.Wrap(errors.Errorf("value is not number (%T)", v), "GetNumber")
+	return i, nil
 }
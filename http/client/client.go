@@ -119,6 +119,31 @@ func (o *Client) DoRequest(method, uri string, params, headers map[string]string
 	return r, nil
 }
 
+// Send Отправляет запрос с телом body как есть и возвращает код и тело ответа. Статус ответа не проверяется.
+func (o *Client) Send(method, uri string, headers map[string]string, body []byte) (int, []byte, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(method)
+	req.Header.SetRequestURI(uri)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBody(body)
+
+	if err := o.client.Do(req, resp); err != nil {
+		return 0, nil, errors.Wrap(err, "http.Client.Send")
+	}
+
+	r := make([]byte, len(resp.Body()))
+	copy(r, resp.Body())
+
+	return resp.StatusCode(), r, nil
+}
+
 type errResp struct {
 	Error string `json:"error"`
 }
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// Роли пользователей. Роль RoleAdmin дает доступ ко всем эндпоинтам.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+
+	// RoleAnonymous Эндпоинт доступен без авторизации
+	RoleAnonymous = "anonymous"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// Identity Авторизованный пользователь
+type Identity struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// HasRole Проверяет наличие у пользователя хотя бы одной из ролей (roles пустой - любой пользователь)
+func (o *Identity) HasRole(roles ...string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+
+	for _, have := range o.Roles {
+		if have == RoleAdmin {
+			return true
+		}
+
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Authenticator Способ авторизации запросов.
+// Возвращает nil, nil, если в запросе нет данных для этого способа авторизации,
+// и ошибку, если данные есть, но неверны.
+type Authenticator interface {
+	Authenticate(ctx *fasthttp.RequestCtx) (*Identity, error)
+}
+
+// SetIdentity Сохраняет пользователя в контексте запроса
+func SetIdentity(ctx *fasthttp.RequestCtx, id *Identity) {
+	ctx.SetUserValue("identity", id)
+}
+
+// GetIdentity Возвращает пользователя запроса (nil - запрос без авторизации)
+func GetIdentity(ctx *fasthttp.RequestCtx) *Identity {
+	id, _ := ctx.UserValue("identity").(*Identity)
+	return id
+}
+
+// AddAuthenticator Добавляет способ авторизации. Пока способы авторизации не заданы, все эндпоинты доступны без авторизации.
+func (o *Server) AddAuthenticator(a Authenticator) {
+	o.authenticators = append(o.authenticators, a)
+}
+
+// initAuth Создает способы авторизации из настроек http_api_keys и http_jwt_secret
+func (o *Server) initAuth() error {
+	if v := o.cfg["http_api_keys"]; v != "" {
+		a, err := NewAPIKeyAuth(v)
+		if err != nil {
+			return errors.Wrap(err, "initAuth")
+		}
+
+		o.AddAuthenticator(a)
+	}
+
+	if v := o.cfg["http_jwt_secret"]; v != "" {
+		o.AddAuthenticator(NewJWTAuth(v))
+	}
+
+	if len(o.authenticators) == 0 {
+		o.logger.Warnf("HTTP (%s): авторизация не настроена (http_api_keys, http_jwt_secret), эндпоинты доступны всем", o.name)
+	}
+
+	return nil
+}
+
+// authenticate Авторизует запрос
+func (o *Server) authenticate(ctx *fasthttp.RequestCtx) (*Identity, error) {
+	for _, a := range o.authenticators {
+		id, err := a.Authenticate(ctx)
+		if err != nil {
+			return nil, errors.Wrap(ErrUnauthorized, err.Error())
+		}
+
+		if id != nil {
+			return id, nil
+		}
+	}
+
+	return nil, ErrUnauthorized
+}
+
+// withAuth Проверяет, что у пользователя есть одна из ролей roles (roles пустой - любой авторизованный пользователь).
+// Ошибки возвращаются в формате Response.
+func (o *Server) withAuth(next fasthttp.RequestHandler, roles ...string) fasthttp.RequestHandler {
+	for _, role := range roles {
+		if role == RoleAnonymous {
+			return next
+		}
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		if len(o.authenticators) == 0 {
+			next(ctx)
+			return
+		}
+
+		id, err := o.authenticate(ctx)
+		if err != nil {
+			ctx.Response.Header.Set("WWW-Authenticate", `Bearer realm="touchon"`)
+			JsonHandlerWrapper(func(*fasthttp.RequestCtx) (interface{}, int, error) {
+				return nil, http.StatusUnauthorized, err
+			})(ctx)
+			return
+		}
+
+		if !id.HasRole(roles...) {
+			JsonHandlerWrapper(func(*fasthttp.RequestCtx) (interface{}, int, error) {
+				return nil, http.StatusForbidden, errors.Wrapf(ErrForbidden, "role %s required", strings.Join(roles, " or "))
+			})(ctx)
+			return
+		}
+
+		SetIdentity(ctx, id)
+		next(ctx)
+	}
+}
+
+// NewAPIKeyAuth Создает авторизацию по статическим ключам вида "key:role1,role2;key2:role".
+// Ключ передается в заголовке api-key (или X-Api-Key).
+func NewAPIKeyAuth(keys string) (*APIKeyAuth, error) {
+	o := &APIKeyAuth{}
+
+	for i, item := range strings.Split(keys, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, errors.Wrap(errors.Errorf("bad api key #%d, expected key:role1,role2", i+1), "NewAPIKeyAuth")
+		}
+
+		var roles []string
+		for _, role := range strings.Split(kv[1], ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+
+		o.keys = append(o.keys, apiKey{
+			key:      []byte(strings.TrimSpace(kv[0])),
+			identity: &Identity{Name: "api-key#" + strconv.Itoa(i+1), Roles: roles},
+		})
+	}
+
+	return o, nil
+}
+
+type apiKey struct {
+	key      []byte
+	identity *Identity
+}
+
+type APIKeyAuth struct {
+	keys []apiKey
+}
+
+func (o *APIKeyAuth) Authenticate(ctx *fasthttp.RequestCtx) (*Identity, error) {
+	key := ctx.Request.Header.Peek("api-key")
+	if len(key) == 0 {
+		key = ctx.Request.Header.Peek("X-Api-Key")
+	}
+
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	for _, k := range o.keys {
+		if subtle.ConstantTimeCompare(k.key, key) == 1 {
+			return k.identity, nil
+		}
+	}
+
+	return nil, errors.New("invalid api key")
+}
+
+// NewJWTAuth Создает авторизацию по токенам JWT, подписанным HMAC-SHA256 (HS256).
+// Токен передается в заголовке "Authorization: Bearer <token>" (или token).
+// Роли берутся из поля roles (список или строка через запятую), имя - из поля sub.
+func NewJWTAuth(secret string) *JWTAuth {
+	return &JWTAuth{secret: []byte(secret)}
+}
+
+type JWTAuth struct {
+	secret []byte
+}
+
+// jwtClaims Поля токена
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Roles     json.RawMessage `json:"roles,omitempty"`
+	ExpiresAt int64           `json:"exp,omitempty"`
+	NotBefore int64           `json:"nbf,omitempty"`
+}
+
+func (o *JWTAuth) Authenticate(ctx *fasthttp.RequestCtx) (*Identity, error) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	if auth := string(ctx.Request.Header.Peek("Authorization")); token == "" && auth != "" {
+		scheme, value, _ := strings.Cut(auth, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return nil, nil
+		}
+
+		token = strings.TrimSpace(value)
+	}
+
+	if token == "" {
+		return nil, nil
+	}
+
+	id, err := o.Verify(token, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "JWTAuth")
+	}
+
+	return id, nil
+}
+
+// Verify Проверяет токен и возвращает пользователя
+func (o *JWTAuth) Verify(token string, now time.Time) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "header")
+	}
+
+	if header.Alg != "HS256" {
+		return nil, errors.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	if !hmac.Equal(sig, o.sign(parts[0]+"."+parts[1])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := &jwtClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, errors.Wrap(err, "claims")
+	}
+
+	switch {
+	case claims.ExpiresAt != 0 && now.Unix() >= claims.ExpiresAt:
+		return nil, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Unix() < claims.NotBefore:
+		return nil, errors.New("token is not valid yet")
+	}
+
+	id := &Identity{Name: claims.Subject}
+
+	if len(claims.Roles) > 0 {
+		var s string
+		if err := json.Unmarshal(claims.Roles, &id.Roles); err != nil {
+			if err := json.Unmarshal(claims.Roles, &s); err != nil {
+				return nil, errors.New("bad token roles")
+			}
+
+			for _, role := range strings.Split(s, ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					id.Roles = append(id.Roles, role)
+				}
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// Issue Выпускает токен для пользователя со сроком действия ttl (0 - бессрочный)
+func (o *JWTAuth) Issue(subject string, roles []string, ttl time.Duration) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+	rolesData, err := json.Marshal(roles)
+	if err != nil {
+		return "", errors.Wrap(err, "JWTAuth.Issue")
+	}
+
+	claims := &jwtClaims{Subject: subject, Roles: rolesData}
+	if ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "JWTAuth.Issue")
+	}
+
+	s := header + "." + base64.RawURLEncoding.EncodeToString(data)
+
+	return s + "." + base64.RawURLEncoding.EncodeToString(o.sign(s)), nil
+}
+
+func (o *JWTAuth) sign(s string) []byte {
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAuth(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := New("test", map[string]string{
+		"http_api_keys":   "admin-key:admin; user-key:user",
+		"http_jwt_secret": "secret",
+	}, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.AddHandler(http.MethodGet, "/public", func(*fasthttp.RequestCtx) (interface{}, int, error) {
+		return "ok", http.StatusOK, nil
+	}, RoleAnonymous)
+
+	srv.AddHandler(http.MethodGet, "/user", func(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+		return GetIdentity(ctx).Name, http.StatusOK, nil
+	}, RoleUser)
+
+	jwt := NewJWTAuth("secret")
+
+	token, err := jwt.Issue("ivan", []string{"user"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := jwt.Issue("ivan", []string{"user"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Verify(expired, time.Now().Add(2*time.Hour)); err == nil {
+		t.Error("expired token accepted")
+	}
+
+	forged, err := NewJWTAuth("other").Issue("ivan", []string{"admin"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"public", "/public", nil, http.StatusOK},
+		{"no credentials", "/user", nil, http.StatusUnauthorized},
+		{"bad api key", "/user", map[string]string{"api-key": "bad"}, http.StatusUnauthorized},
+		{"user api key", "/user", map[string]string{"api-key": "user-key"}, http.StatusOK},
+		{"admin api key", "/user", map[string]string{"X-Api-Key": "admin-key"}, http.StatusOK},
+		{"user api key, admin route", "/_/info", map[string]string{"api-key": "user-key"}, http.StatusForbidden},
+		{"admin api key, admin route", "/_/info", map[string]string{"api-key": "admin-key"}, http.StatusOK},
+		{"bearer token", "/user", map[string]string{"Authorization": "Bearer " + token}, http.StatusOK},
+		{"token header", "/user", map[string]string{"token": token}, http.StatusOK},
+		{"forged token", "/user", map[string]string{"Authorization": "Bearer " + forged}, http.StatusUnauthorized},
+		{"metrics, any user", "/_/metrics?format=json", map[string]string{"Authorization": "Bearer " + token}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(tt.path)
+		ctx.Request.Header.SetMethod(http.MethodGet)
+		for k, v := range tt.headers {
+			ctx.Request.Header.Set(k, v)
+		}
+
+		srv.GetServer().Handler(ctx)
+
+		if ctx.Response.StatusCode() != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, ctx.Response.StatusCode(), tt.status, ctx.Response.Body())
+			continue
+		}
+
+		r := &Response[any]{}
+		if err := json.Unmarshal(ctx.Response.Body(), r); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if r.Success != (tt.status == http.StatusOK) {
+			t.Errorf("%s: success = %v, error %q", tt.name, r.Success, r.Error)
+		}
+
+		if tt.status == http.StatusUnauthorized && len(ctx.Response.Header.Peek("WWW-Authenticate")) == 0 {
+			t.Errorf("%s: WWW-Authenticate header expected", tt.name)
+		}
+
+		if tt.path == "/user" && tt.name == "bearer token" && r.Data != "ivan" {
+			t.Errorf("%s: identity %v, want ivan", tt.name, r.Data)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	mqttClient "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DefaultCommandTimeout = 5 * time.Second
+	MaxCommandTimeout     = time.Minute
+
+	// CommandReplyTopic Топики ответов сервисов на служебные команды (service/info, service/cluster_info)
+	CommandReplyTopic = "service/+"
+)
+
+// Режимы ожидания результата команды
+const (
+	CommandWaitNone  = ""      // Не ждать, ответ сразу после отправки
+	CommandWaitReply = "reply" // Ждать событие с ID корреляции команды (только команды сервисам, см. mqtt/service)
+	CommandWaitEvent = "event" // Ждать событие цели команды, подходящее под шаблон event
+)
+
+// CommandRequest Команда, отправляемая в шину через HTTP
+type CommandRequest struct {
+	TargetType string                 `json:"target_type"`       // Тип цели
+	TargetID   int                    `json:"target_id"`         // ID цели
+	Method     string                 `json:"method"`            // Метод
+	Args       map[string]interface{} `json:"args,omitempty"`    // Аргументы метода
+	Topic      string                 `json:"topic,omitempty"`   // Топик <сервис>/command/..., другие топики - только для роли admin. По умолчанию - http_command_topic или <object_manager|service>/command/<target_type>
+	Wait       string                 `json:"wait,omitempty"`    // "", reply, event
+	Event      string                 `json:"event,omitempty"`   // Шаблон кода события для wait=event: object.sensor.*
+	Timeout    string                 `json:"timeout,omitempty"` // Время ожидания результата, по умолчанию http_command_timeout
+}
+
+// CommandResult Результат отправки команды
+type CommandResult struct {
+	CorrelationID string         `json:"correlation_id"`  // ID корреляции команды
+	Topic         string         `json:"topic"`           //
+	SentAt        time.Time      `json:"sent_at"`         //
+	Reply         *StreamMessage `json:"reply,omitempty"` // Полученный ответ или событие
+}
+
+func (o *Server) initCommand() error {
+	o.commandTimeout = DefaultCommandTimeout
+	o.commandTopic = o.cfg["http_command_topic"]
+	if o.commandTopic != "" {
+		if err := checkCommandTopic(o.commandTopic, true); err != nil {
+			return errors.Wrap(err, "initCommand")
+		}
+	}
+
+	if s := o.cfg["http_command_timeout"]; s != "" {
+		var err error
+		if o.commandTimeout, err = time.ParseDuration(s); err != nil || o.commandTimeout <= 0 || o.commandTimeout > MaxCommandTimeout {
+			return errors.Wrap(errors.Errorf("bad http_command_timeout %q", s), "initCommand")
+		}
+	}
+
+	return nil
+}
+
+// parseCommandRequest Разбирает и проверяет команду. Без роли admin команду можно отправить только в топик команд.
+func (o *Server) parseCommandRequest(data []byte, admin bool) (*CommandRequest, time.Duration, error) {
+	req := &CommandRequest{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, 0, errors.Wrap(err, "parseCommandRequest")
+	}
+
+	switch {
+	case !messages.TargetTypes[req.TargetType]:
+		return nil, 0, errors.Wrap(errors.Errorf("unknown target type %q", req.TargetType), "parseCommandRequest")
+	case req.TargetID < 0:
+		return nil, 0, errors.Wrap(errors.New("target_id < 0"), "parseCommandRequest")
+	case req.Method == "":
+		return nil, 0, errors.Wrap(errors.New("method is empty"), "parseCommandRequest")
+	case req.Wait != CommandWaitNone && req.Wait != CommandWaitReply && req.Wait != CommandWaitEvent:
+		return nil, 0, errors.Wrap(errors.Errorf("unknown wait mode %q", req.Wait), "parseCommandRequest")
+	case req.Wait == CommandWaitEvent && req.Event == "":
+		return nil, 0, errors.Wrap(errors.New("event is empty"), "parseCommandRequest")
+	case req.Wait == CommandWaitReply && req.TargetType != messages.TargetTypeService:
+		// ID корреляции копируют в ответ только служебные команды сервисов, события устройств его не содержат
+		return nil, 0, errors.Wrap(errors.Errorf("wait=reply is supported only for target type %q, use wait=event", messages.TargetTypeService), "parseCommandRequest")
+	}
+
+	if _, err := path.Match(req.Event, ""); err != nil {
+		return nil, 0, errors.Wrap(errors.Errorf("bad event pattern %q", req.Event), "parseCommandRequest")
+	}
+
+	if req.Topic != "" {
+		if err := checkCommandTopic(req.Topic, admin); err != nil {
+			return nil, 0, errors.Wrap(err, "parseCommandRequest")
+		}
+	} else {
+		req.Topic = o.commandTopic
+	}
+
+	switch {
+	case req.Topic != "":
+	case req.TargetType == messages.TargetTypeService:
+		req.Topic = topics.TopicServiceCommand
+	default:
+		req.Topic = topics.ClientObjectManager + "/" + topics.TopicCommand + "/" + req.TargetType
+	}
+
+	timeout := o.commandTimeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 || timeout > MaxCommandTimeout {
+			return nil, 0, errors.Wrap(errors.Errorf("bad timeout %q (max %s)", req.Timeout, MaxCommandTimeout), "parseCommandRequest")
+		}
+	}
+
+	return req, timeout, nil
+}
+
+// checkCommandTopic Проверяет топик команды: без шаблонов, пустых уровней и служебного префикса $.
+// Без роли admin допускаются только топики команд <сервис>/command/...
+func checkCommandTopic(topic string, admin bool) error {
+	levels := strings.Split(topic, "/")
+
+	for _, level := range levels {
+		if level == "" || strings.ContainsAny(level, "+#") {
+			return errors.Errorf("bad topic %q", topic)
+		}
+	}
+
+	if strings.HasPrefix(topic, "$") {
+		return errors.Errorf("bad topic %q", topic)
+	}
+
+	if !admin && (len(levels) < 2 || levels[1] != topics.TopicCommand) {
+		return errors.Errorf("topic %q is not a command topic <service>/%s/..., role %s required", topic, topics.TopicCommand, RoleAdmin)
+	}
+
+	return nil
+}
+
+// match Проверяет, является ли событие результатом команды
+func (o *CommandRequest) match(correlationID string, m messages.Message) bool {
+	if o.Wait == CommandWaitReply {
+		// Сама команда несет тот же ID корреляции, поэтому ответом считается только событие
+		return m.GetType() == messages.MessageTypeEvent && m.GetCorrelationID() == correlationID
+	}
+
+	if o.TargetType != m.GetTargetType() || (o.TargetID != 0 && o.TargetID != m.GetTargetID()) {
+		return false
+	}
+
+	ok, _ := path.Match(o.Event, m.GetName())
+	return ok
+}
+
+// Отправить команду
+// @Summary Отправить команду
+// @Tags Service
+// @Description Отправляет команду в шину. Если задан режим ожидания, ждет ответ с ID корреляции команды (wait=reply, только для target_type=service)
+// @Description или событие цели команды, подходящее под шаблон event (wait=event). Ответы принимаются из топиков service/+, события - из топика http_stream_topic.
+// @Description Топик команды должен быть топиком команд <сервис>/command/..., другие топики доступны только роли admin.
+// @ID Command
+// @Accept json
+// @Produce json
+// @Param command body server.CommandRequest true "Команда"
+// @Success      200 {object} http.Response[server.CommandResult]
+// @Failure      400 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Failure      503 {object} http.Response[any]
+// @Failure      504 {object} http.Response[any]
+// @Router /_/command [post]
+func (o *Server) handleCommand(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	id := GetIdentity(ctx)
+
+	req, timeout, err := o.parseCommandRequest(ctx.PostBody(), id != nil && id.HasRole(RoleAdmin))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	client := mqttClient.I
+	if client == nil {
+		return nil, http.StatusInternalServerError, errors.New("mqtt client is not initialized")
+	}
+
+	cmd, err := messages.NewCommand(req.Method, req.TargetType, req.TargetID, req.Args)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	r := &CommandResult{CorrelationID: messages.NewCorrelationID(), Topic: req.Topic}
+	cmd.SetTopic(req.Topic)
+	cmd.SetCorrelationID(r.CorrelationID)
+
+	match := func(m messages.Message) bool { return req.match(r.CorrelationID, m) }
+
+	var w *streamWaiter
+	switch req.Wait {
+	case CommandWaitReply:
+		w, err = o.streams.waitReply(CommandReplyTopic, match)
+	case CommandWaitEvent:
+		w, err = o.streams.wait(match)
+	}
+
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if w != nil {
+		defer o.streams.stopWaiting(w)
+	}
+
+	if err := client.Send(cmd); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	r.SentAt = cmd.GetSentAt()
+
+	if w == nil {
+		return r, http.StatusOK, nil
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case m, ok := <-w.c:
+		if !ok {
+			return nil, http.StatusServiceUnavailable, errors.Errorf("server is shutting down, command %s is sent", r.CorrelationID)
+		}
+
+		r.Reply = newStreamMessage(m)
+		return r, http.StatusOK, nil
+
+	case <-t.C:
+		return nil, http.StatusGatewayTimeout, errors.Errorf("no %s to command %s within %s", req.Wait, r.CorrelationID, timeout)
+	}
+}
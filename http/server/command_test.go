@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/VladimirDronik/touchon-server/events/object/sensor"
+	"github.com/VladimirDronik/touchon-server/models"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	mqttClient "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	mqttService "github.com/VladimirDronik/touchon-server/mqtt/service"
+	"github.com/valyala/fasthttp"
+)
+
+func TestCommand(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := mqttClient.NewBus()
+	device := bus.NewClient("device", "device", "device/#")
+
+	prev := mqttClient.I
+	mqttClient.I = bus.NewClient("http", "http", "http/#")
+	defer func() { mqttClient.I = prev }()
+
+	// Объект 5 отвечает на любую команду событием (без ID корреляции, как устройства object_manager)
+	commands, err := device.Subscribe("object_manager/command/#", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for msg := range commands.C() {
+			cmd, err := messages.NewFromMQTT(msg)
+			if err != nil || cmd.GetTargetID() != 5 {
+				continue
+			}
+
+			reply, err := sensor.NewOnAlarmMessage("object_manager/event/sensor", cmd.GetTargetID(), cmd.GetName())
+			if err != nil {
+				continue
+			}
+
+			_ = device.Send(reply)
+		}
+	}()
+
+	// Сервис отвечает на команду info событием с ID корреляции команды
+	svc, err := mqttService.New(bus.NewClient("svc", "svc", "svc/#"), map[string]string{}, 10, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.SetHandler(func(messages.Message) error { return nil })
+
+	if err := svc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Shutdown()
+
+	srv, err := New("test", map[string]string{}, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = srv.Shutdown() }()
+
+	const deviceTopic = "object_manager/command/object"
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		topic  string
+		reply  string // Код ожидаемого события
+	}{
+		{"bad target type", `{"target_type":"bad","target_id":5,"method":"check"}`, http.StatusBadRequest, "", ""},
+		{"no method", `{"target_type":"object","target_id":5}`, http.StatusBadRequest, "", ""},
+		{"bad timeout", `{"target_type":"service","method":"info","wait":"reply","timeout":"1h"}`, http.StatusBadRequest, "", ""},
+		{"device reply", `{"target_type":"object","target_id":5,"method":"check","wait":"reply"}`, http.StatusBadRequest, "", ""},
+		{"no wait", `{"target_type":"object","target_id":6,"method":"check"}`, http.StatusOK, deviceTopic, ""},
+		{"service reply", `{"target_type":"service","method":"info","wait":"reply"}`, http.StatusOK, topics.TopicServiceCommand, "service.on_info"},
+		{"cluster info reply", `{"target_type":"service","method":"cluster_info","args":{"timeout":"100ms"},"wait":"reply"}`, http.StatusOK, topics.TopicServiceCommand, "service.on_cluster_info"},
+		{"custom topic", `{"target_type":"object","target_id":6,"method":"check","topic":"device/command/relay"}`, http.StatusOK, "device/command/relay", ""},
+		{"wildcard topic", `{"target_type":"object","target_id":6,"method":"check","topic":"device/command/#"}`, http.StatusBadRequest, "", ""},
+		{"empty topic level", `{"target_type":"object","target_id":6,"method":"check","topic":"device//command"}`, http.StatusBadRequest, "", ""},
+		{"not a command topic", `{"target_type":"service","method":"info","topic":"service/leader/test"}`, http.StatusBadRequest, "", ""},
+		{"event", `{"target_type":"object","target_id":5,"method":"check","wait":"event","event":"object.sensor.*"}`, http.StatusOK, deviceTopic, "object.sensor.on_alarm"},
+		{"timeout", `{"target_type":"object","target_id":6,"method":"check","wait":"event","event":"*","timeout":"100ms"}`, http.StatusGatewayTimeout, "", ""},
+	}
+
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/_/command")
+		ctx.Request.Header.SetMethod(http.MethodPost)
+		ctx.Request.SetBodyString(tt.body)
+
+		srv.GetServer().Handler(ctx)
+
+		if ctx.Response.StatusCode() != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, ctx.Response.StatusCode(), tt.status, ctx.Response.Body())
+			continue
+		}
+
+		r := &Response[*CommandResult]{}
+		if err := json.Unmarshal(ctx.Response.Body(), r); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		switch {
+		case r.Data == nil || r.Data.CorrelationID == "" || r.Data.Topic != tt.topic:
+			t.Errorf("%s: unexpected result %s", tt.name, ctx.Response.Body())
+		case tt.reply != "" && (r.Data.Reply == nil || r.Data.Reply.Event != tt.reply):
+			t.Errorf("%s: unexpected reply %s", tt.name, ctx.Response.Body())
+		case strings.HasPrefix(tt.reply, "service.") && r.Data.Reply.CorrelationID != r.Data.CorrelationID:
+			t.Errorf("%s: reply is not correlated %s", tt.name, ctx.Response.Body())
+		case tt.reply == "" && r.Data.Reply != nil:
+			t.Errorf("%s: reply is not expected", tt.name)
+		}
+	}
+}
+
+func TestCheckCommandTopic(t *testing.T) {
+	for _, tt := range []struct {
+		topic string
+		admin bool
+		ok    bool
+	}{
+		{"object_manager/command/object", false, true},
+		{topics.TopicServiceCommand, false, true},
+		{"service/leader/test", false, false},
+		{"service/leader/test", true, true},
+		{"object_manager/command/+", true, false},
+		{"#", true, false},
+		{"object_manager//command", true, false},
+		{"$SYS/command/x", true, false},
+	} {
+		if err := checkCommandTopic(tt.topic, tt.admin); (err == nil) != tt.ok {
+			t.Errorf("%s (admin=%v): %v", tt.topic, tt.admin, err)
+		}
+	}
+}
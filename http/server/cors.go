@@ -0,0 +1,174 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DefaultCORSMethods = "GET,POST,PUT,PATCH,DELETE"
+	DefaultCORSHeaders = "api-key,token,authorization,content-type"
+	DefaultCORSMaxAge  = 10 * time.Minute
+)
+
+// newCORSPolicy Создает политику CORS из настроек:
+//
+//	http_cors_origins = "https://panel.local,https://*.example.com" # Разрешенные источники, допускаются шаблоны; "*" - любой источник (без передачи учетных данных). Пустой - CORS выключен
+//	http_cors_methods = "GET,POST,PUT,PATCH,DELETE"                   # Разрешенные методы
+//	http_cors_headers = "api-key,token,authorization,content-type"    # Разрешенные заголовки запроса
+//	http_cors_max_age = "10m"                                          # Время кэширования ответа на предварительный запрос
+func newCORSPolicy(cfg map[string]string) (*corsPolicy, error) {
+	o := &corsPolicy{
+		methods: splitList(DefaultCORSMethods, strings.ToUpper),
+		headers: splitList(DefaultCORSHeaders, strings.ToLower),
+		maxAge:  DefaultCORSMaxAge,
+	}
+
+	for _, origin := range splitList(cfg["http_cors_origins"], strings.ToLower) {
+		if origin == "*" {
+			o.any = true
+			continue
+		}
+
+		if _, err := path.Match(origin, ""); err != nil {
+			return nil, errors.Wrap(errors.Errorf("bad origin pattern %q", origin), "newCORSPolicy")
+		}
+
+		o.origins = append(o.origins, origin)
+	}
+
+	if v := cfg["http_cors_methods"]; v != "" {
+		o.methods = splitList(v, strings.ToUpper)
+	}
+
+	if v := cfg["http_cors_headers"]; v != "" {
+		o.headers = splitList(v, strings.ToLower)
+	}
+
+	if v := cfg["http_cors_max_age"]; v != "" {
+		var err error
+		if o.maxAge, err = time.ParseDuration(v); err != nil || o.maxAge < 0 {
+			return nil, errors.Wrap(errors.Errorf("bad http_cors_max_age %q", v), "newCORSPolicy")
+		}
+	}
+
+	return o, nil
+}
+
+// corsPolicy Политика CORS
+type corsPolicy struct {
+	any     bool     // Разрешен любой источник
+	origins []string // Шаблоны разрешенных источников
+	methods []string
+	headers []string
+	maxAge  time.Duration
+}
+
+// matchOrigin Проверяет источник запроса. Возвращает значение Access-Control-Allow-Origin
+// и признак разрешения передачи учетных данных.
+func (o *corsPolicy) matchOrigin(origin string) (string, bool, bool) {
+	if origin == "" {
+		return "", false, false
+	}
+
+	lower := strings.ToLower(origin)
+	for _, pattern := range o.origins {
+		if ok, _ := path.Match(pattern, lower); ok {
+			return origin, true, true
+		}
+	}
+
+	if o.any {
+		return "*", false, true
+	}
+
+	return "", false, false
+}
+
+// allowWebSocket Проверяет источник запроса WebSocket. Браузеры не применяют CORS к WebSocket,
+// поэтому разрешаются только запросы без Origin, со своего хоста и из разрешенных источников.
+func (o *corsPolicy) allowWebSocket(origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, host) {
+		return true
+	}
+
+	_, _, ok := o.matchOrigin(origin)
+	return ok
+}
+
+// handle Добавляет заголовки CORS в ответ. Возвращает true, если запрос был предварительным (preflight)
+// и ответ на него уже сформирован.
+func (o *corsPolicy) handle(ctx *fasthttp.RequestCtx) bool {
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	preflight := string(ctx.Method()) == http.MethodOptions && len(ctx.Request.Header.Peek("Access-Control-Request-Method")) > 0
+
+	if origin != "" {
+		ctx.Response.Header.Add("Vary", "Origin")
+	}
+
+	allowOrigin, credentials, ok := o.matchOrigin(origin)
+
+	if preflight {
+		ctx.Response.Header.Add("Vary", "Access-Control-Request-Method")
+		ctx.Response.Header.Add("Vary", "Access-Control-Request-Headers")
+		ctx.SetStatusCode(http.StatusNoContent)
+
+		method := strings.ToUpper(string(ctx.Request.Header.Peek("Access-Control-Request-Method")))
+		headers := splitList(string(ctx.Request.Header.Peek("Access-Control-Request-Headers")), strings.ToLower)
+
+		if !ok || !slices.Contains(o.methods, method) || !containsAll(o.headers, headers) {
+			return true
+		}
+
+		ctx.Response.Header.Set("Access-Control-Allow-Methods", strings.Join(o.methods, ","))
+		ctx.Response.Header.Set("Access-Control-Allow-Headers", strings.Join(o.headers, ","))
+		if o.maxAge > 0 {
+			ctx.Response.Header.Set("Access-Control-Max-Age", strconv.Itoa(int(o.maxAge.Seconds())))
+		}
+	}
+
+	if !ok {
+		return preflight
+	}
+
+	ctx.Response.Header.Set("Access-Control-Allow-Origin", allowOrigin)
+	if credentials {
+		ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	return preflight
+}
+
+// splitList Разбирает список через запятую
+func splitList(s string, normalize func(string) string) []string {
+	var r []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			r = append(r, normalize(item))
+		}
+	}
+
+	return r
+}
+
+func containsAll(list, items []string) bool {
+	for _, item := range items {
+		if !slices.Contains(list, item) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCORS(t *testing.T) {
+	p, err := newCORSPolicy(map[string]string{
+		"http_cors_origins": "https://panel.local, https://*.example.com",
+		"http_cors_max_age": "1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		reqMethod   string
+		reqHeaders  string
+		allowOrigin string
+		preflight   bool
+	}{
+		{"no origin", http.MethodGet, "", "", "", "", false},
+		{"allowed origin", http.MethodGet, "https://panel.local", "", "", "https://panel.local", false},
+		{"wildcard origin", http.MethodPost, "https://a.example.com", "", "", "https://a.example.com", false},
+		{"disallowed origin", http.MethodGet, "https://evil.com", "", "", "", false},
+		{"preflight", http.MethodOptions, "https://panel.local", "PUT", "Content-Type, Api-Key", "https://panel.local", true},
+		{"preflight, disallowed origin", http.MethodOptions, "https://evil.com", "PUT", "", "", true},
+		{"preflight, disallowed method", http.MethodOptions, "https://panel.local", "TRACE", "", "", true},
+		{"preflight, disallowed header", http.MethodOptions, "https://panel.local", "GET", "x-custom", "", true},
+	}
+
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(tt.method)
+		if tt.origin != "" {
+			ctx.Request.Header.Set("Origin", tt.origin)
+		}
+		if tt.reqMethod != "" {
+			ctx.Request.Header.Set("Access-Control-Request-Method", tt.reqMethod)
+		}
+		if tt.reqHeaders != "" {
+			ctx.Request.Header.Set("Access-Control-Request-Headers", tt.reqHeaders)
+		}
+
+		if preflight := p.handle(ctx); preflight != tt.preflight {
+			t.Errorf("%s: preflight = %v", tt.name, preflight)
+		}
+
+		if v := string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")); v != tt.allowOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.name, v, tt.allowOrigin)
+		}
+
+		allowed := tt.allowOrigin != ""
+		if v := string(ctx.Response.Header.Peek("Access-Control-Allow-Credentials")); (v == "true") != allowed {
+			t.Errorf("%s: Access-Control-Allow-Credentials = %q", tt.name, v)
+		}
+
+		if v := string(ctx.Response.Header.Peek("Access-Control-Max-Age")); tt.preflight && allowed && v != "60" {
+			t.Errorf("%s: Access-Control-Max-Age = %q", tt.name, v)
+		}
+	}
+
+	wildcard, err := newCORSPolicy(map[string]string{"http_cors_origins": "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("Origin", "https://any.site")
+	wildcard.handle(ctx)
+
+	if string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "*" || len(ctx.Response.Header.Peek("Access-Control-Allow-Credentials")) != 0 {
+		t.Error("wildcard origin must not allow credentials")
+	}
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqttClient "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/pbnjay/memory"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultHealthTimeout       = 5 * time.Second
+	DefaultHealthMinFreeMemory = 32 // MiB
+	DefaultHealthMaxErrors     = 10
+	DefaultHealthErrorsWindow  = time.Minute
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+// HealthCheck Проверка готовности сервиса. Возвращает ошибку, если сервис не готов.
+type HealthCheck func(ctx context.Context) error
+
+// HealthCheckResult Результат проверки
+type HealthCheckResult struct {
+	Status  string  `json:"status"`          // ok, fail
+	Latency float64 `json:"latency"`         // Длительность проверки, с
+	Error   string  `json:"error,omitempty"` // Причина неготовности
+}
+
+// Health Состояние сервиса
+type Health struct {
+	Status string                        `json:"status"`           // ok, fail
+	Uptime string                        `json:"uptime,omitempty"` //
+	Checks map[string]*HealthCheckResult `json:"checks,omitempty"` // Результаты проверок по названиям
+}
+
+// Проверки готовности, добавляемые во все создаваемые серверы (см. RegisterHealthCheck)
+var (
+	defaultHealthMu     sync.Mutex
+	defaultHealthChecks = map[string]HealthCheck{}
+)
+
+// RegisterHealthCheck Регистрирует проверку готовности для всех серверов, создаваемых после вызова.
+// Используется для ресурсов, которые создаются до сервера (например, БД в service.Prolog).
+func RegisterHealthCheck(name string, check HealthCheck) {
+	defaultHealthMu.Lock()
+	defer defaultHealthMu.Unlock()
+	defaultHealthChecks[name] = check
+}
+
+// initHealth Регистрирует встроенные проверки: свободная память, частота ошибок в логе
+// и проверки, зарегистрированные через RegisterHealthCheck. Проверка MQTT выполняется,
+// только если глобальный клиент mqtt/client.I создан (см. CheckHealth).
+// Настройки:
+//
+//	http_health_timeout         = "5s" # Время ожидания одной проверки
+//	http_health_min_free_memory = "32" # Минимальный объем доступной памяти, MiB (0 - не проверять)
+//	http_health_max_errors      = "10" # Допустимое количество ошибок в логе за окно (0 - не проверять)
+//	http_health_errors_window   = "1m" # Окно подсчета ошибок
+func (o *Server) initHealth() error {
+	o.healthTimeout = DefaultHealthTimeout
+	minFreeMemory := DefaultHealthMinFreeMemory
+	maxErrors := DefaultHealthMaxErrors
+	errorsWindow := DefaultHealthErrorsWindow
+
+	var err error
+
+	for key, v := range map[string]*time.Duration{
+		"http_health_timeout":       &o.healthTimeout,
+		"http_health_errors_window": &errorsWindow,
+	} {
+		if s := o.cfg[key]; s != "" {
+			if *v, err = time.ParseDuration(s); err != nil || *v <= 0 {
+				return errors.Wrap(errors.Errorf("bad %s %q", key, s), "initHealth")
+			}
+		}
+	}
+
+	for key, v := range map[string]*int{
+		"http_health_min_free_memory": &minFreeMemory,
+		"http_health_max_errors":      &maxErrors,
+	} {
+		if s := o.cfg[key]; s != "" {
+			if *v, err = strconv.Atoi(s); err != nil || *v < 0 {
+				return errors.Wrap(errors.Errorf("bad %s %q", key, s), "initHealth")
+			}
+		}
+	}
+
+	defaultHealthMu.Lock()
+	for name, check := range defaultHealthChecks {
+		o.AddHealthCheck(name, check)
+	}
+	defaultHealthMu.Unlock()
+
+	if minFreeMemory > 0 {
+		o.AddHealthCheck("memory", FreeMemoryCheck(uint64(minFreeMemory)*1024*1024))
+	}
+
+	if counter, ok := o.ringBuffer.(ErrorCounter); ok && maxErrors > 0 {
+		o.AddHealthCheck("log_errors", ErrorRateCheck(counter, errorsWindow, maxErrors))
+	}
+
+	return nil
+}
+
+// AddHealthCheck Добавляет проверку готовности (или заменяет проверку с тем же названием)
+func (o *Server) AddHealthCheck(name string, check HealthCheck) {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+
+	if o.healthChecks == nil {
+		o.healthChecks = make(map[string]HealthCheck)
+	}
+
+	o.healthChecks[name] = check
+}
+
+// RemoveHealthCheck Удаляет проверку готовности
+func (o *Server) RemoveHealthCheck(name string) {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+	delete(o.healthChecks, name)
+}
+
+// CheckHealth Выполняет проверки готовности параллельно.
+// Если проверка mqtt не добавлена явно, подключение глобального клиента проверяется, когда клиент создан.
+func (o *Server) CheckHealth(ctx context.Context) *Health {
+	o.healthMu.RLock()
+	checks := make(map[string]HealthCheck, len(o.healthChecks)+1)
+	for name, check := range o.healthChecks {
+		checks[name] = check
+	}
+	o.healthMu.RUnlock()
+
+	if _, ok := checks["mqtt"]; !ok && mqttClient.I != nil {
+		checks["mqtt"] = MQTTCheck(mqttClient.I)
+	}
+
+	r := &Health{Status: HealthStatusOK, Checks: make(map[string]*HealthCheckResult, len(checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+
+			res := runHealthCheck(ctx, check, o.healthTimeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			r.Checks[name] = res
+			if res.Status != HealthStatusOK {
+				r.Status = HealthStatusFail
+			}
+		}(name, check)
+	}
+
+	wg.Wait()
+
+	return r
+}
+
+// runHealthCheck Выполняет проверку с ограничением времени ожидания
+func runHealthCheck(ctx context.Context, check HealthCheck, timeout time.Duration) *HealthCheckResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.Errorf("timeout %s", timeout)
+	}
+
+	r := &HealthCheckResult{
+		Status:  HealthStatusOK,
+		Latency: float64(int(time.Since(start).Seconds()*1000)) / 1000,
+	}
+
+	if err != nil {
+		r.Status = HealthStatusFail
+		r.Error = err.Error()
+	}
+
+	return r
+}
+
+// Проверить, что сервис работает
+// @Summary Проверить, что сервис работает
+// @Tags Service
+// @Description Проверить, что процесс сервиса работает и обрабатывает запросы (liveness)
+// @ID HealthLive
+// @Produce json
+// @Success      200 {object} http.Response[server.Health]
+// @Router /_/health/live [get]
+func (o *Server) handleGetHealthLive(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	return &Health{Status: HealthStatusOK, Uptime: time.Since(o.startedAt).Round(time.Second).String()}, http.StatusOK, nil
+}
+
+// Проверить готовность сервиса
+// @Summary Проверить готовность сервиса
+// @Tags Service
+// @Description Выполнить проверки готовности сервиса (БД, MQTT, ошибки в логе, свободная память) (readiness)
+// @ID HealthReady
+// @Produce json
+// @Success      200 {object} http.Response[server.Health]
+// @Failure      503 {object} http.Response[server.Health]
+// @Router /_/health/ready [get]
+func (o *Server) handleGetHealthReady(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	h := o.CheckHealth(o.ctx)
+
+	// Ответ записывается без JsonHandlerWrapper: обертка при ошибке не возвращает данные,
+	// а результаты проверок нужны и при отказе
+	r := &Response[any]{Success: h.Status == HealthStatusOK, Data: h}
+	status := http.StatusOK
+	if !r.Success {
+		status = http.StatusServiceUnavailable
+		r.Error = "failed checks: " + failedChecks(h)
+	}
+
+	r.Meta.Duration = float64(int(time.Since(start).Seconds()*1000)) / 1000
+	ctx.Response.SetStatusCode(status)
+	observeRequest(ctx, status, time.Since(start))
+
+	writeResponse(ctx, r)
+}
+
+func failedChecks(h *Health) string {
+	var names []string
+	for name, res := range h.Checks {
+		if res.Status != HealthStatusOK {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// DBCheck Проверяет доступность БД (см. helpers.NewDB): ping и запись в служебную таблицу _health.
+// Запись выполняется в транзакции, которая откатывается, поэтому таблица в БД не остается.
+func DBCheck(db *gorm.DB) HealthCheck {
+	return func(ctx context.Context) error {
+		if db == nil {
+			return errors.New("db is nil")
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			return errors.Wrap(err, "DBCheck")
+		}
+
+		if err := sqlDB.PingContext(ctx); err != nil {
+			return errors.Wrap(err, "DBCheck: ping")
+		}
+
+		tx, err := sqlDB.BeginTx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "DBCheck: begin")
+		}
+		defer func() { _ = tx.Rollback() }()
+
+		if _, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS _health (id INTEGER PRIMARY KEY, checked_at INTEGER NOT NULL)"); err != nil {
+			return errors.Wrap(err, "DBCheck: write")
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO _health (id, checked_at) VALUES (1, ?)", time.Now().Unix()); err != nil {
+			return errors.Wrap(err, "DBCheck: write")
+		}
+
+		return nil
+	}
+}
+
+// MQTTCheck Проверяет, что клиент подключен к брокеру (client = nil - глобальный клиент mqtt/client.I)
+func MQTTCheck(client mqttClient.Client) HealthCheck {
+	return func(context.Context) error {
+		c := client
+		if c == nil {
+			c = mqttClient.I
+		}
+
+		if c == nil {
+			return errors.New("mqtt client is not initialized")
+		}
+
+		if state := c.State(); state != mqttClient.StateConnected {
+			return errors.Errorf("mqtt client is %s", state)
+		}
+
+		return nil
+	}
+}
+
+// ErrorCounter Источник количества ошибок (например, models.RingBuffer)
+type ErrorCounter interface {
+	CountErrors(since time.Time) int
+}
+
+// ErrorRateCheck Проверяет, что за окно window в лог записано не более max ошибок
+func ErrorRateCheck(counter ErrorCounter, window time.Duration, max int) HealthCheck {
+	return func(context.Context) error {
+		if n := counter.CountErrors(time.Now().Add(-window)); n > max {
+			return errors.Errorf("%d errors in log for %s (max %d)", n, window, max)
+		}
+
+		return nil
+	}
+}
+
+// FreeMemoryCheck Проверяет, что доступной памяти не меньше min байт (см. availableMemory).
+// Если объем памяти на платформе определить нельзя, проверка считается пройденной.
+func FreeMemoryCheck(min uint64) HealthCheck {
+	return func(context.Context) error {
+		if free := availableMemory(); free > 0 && free < min {
+			return errors.Errorf("available memory %.1f MiB < %.1f MiB", float64(free)/1024/1024, float64(min)/1024/1024)
+		}
+
+		return nil
+	}
+}
+
+// availableMemory Возвращает объем памяти, доступной без подкачки. В Linux это MemAvailable
+// из /proc/meminfo: в отличие от свободной памяти, он учитывает освобождаемый кэш страниц.
+func availableMemory() uint64 {
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		if v, ok := parseMemAvailable(data); ok {
+			return v
+		}
+	}
+
+	return memory.FreeMemory()
+}
+
+// parseMemAvailable Возвращает значение MemAvailable из содержимого /proc/meminfo в байтах
+func parseMemAvailable(data []byte) (uint64, bool) {
+	for _, line := range strings.Split(string(data), "\n") {
+		v, ok := strings.CutPrefix(line, "MemAvailable:")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(v)
+		if len(fields) != 2 || fields[1] != "kB" {
+			return 0, false
+		}
+
+		n, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		return n * 1024, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/valyala/fasthttp"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestHealth(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetOutput(io.Discard)
+
+	rb := models.NewRingBuffer(10*1024, &models.LogFormatter{})
+	logger.AddHook(rb)
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	// Проверка БД регистрируется до создания сервера (как в service.Prolog)
+	RegisterHealthCheck("db", DBCheck(db))
+	defer func() {
+		defaultHealthMu.Lock()
+		delete(defaultHealthChecks, "db")
+		defaultHealthMu.Unlock()
+	}()
+
+	srv, err := New("test", map[string]string{
+		"http_health_min_free_memory": "0",
+		"http_health_max_errors":      "1",
+	}, rb, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := func() (int, *Health) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/_/health/ready")
+		ctx.Request.Header.SetMethod(http.MethodGet)
+		srv.GetServer().Handler(ctx)
+
+		r := &Response[*Health]{}
+		if err := json.Unmarshal(ctx.Response.Body(), r); err != nil {
+			t.Fatal(err)
+		}
+
+		return ctx.Response.StatusCode(), r.Data
+	}
+
+	// Без клиента шины подключение к брокеру не проверяется
+	if status, h := ready(); status != http.StatusOK || h.Status != HealthStatusOK || len(h.Checks) != 2 || h.Checks["mqtt"] != nil {
+		t.Fatalf("status %d, health %+v", status, h)
+	}
+
+	// Запись в БД проверяется в откатываемой транзакции
+	if db.Migrator().HasTable("_health") {
+		t.Fatal("_health table is left in db")
+	}
+
+	mqttClient := client.NewBus().NewClient("test", "test", "test")
+	mqttClient.SetState(client.StateConnected)
+
+	prev := client.I
+	client.I = mqttClient
+	defer func() { client.I = prev }()
+
+	if status, h := ready(); status != http.StatusOK || h.Status != HealthStatusOK || len(h.Checks) != 3 {
+		t.Fatalf("status %d, health %+v", status, h)
+	}
+
+	mqttClient.SetState(client.StateReconnecting)
+	logger.Error("error 1")
+	logger.Error("error 2")
+
+	status, h := ready()
+	if status != http.StatusServiceUnavailable || h.Status != HealthStatusFail {
+		t.Fatalf("status %d, health %+v", status, h)
+	}
+
+	for name, want := range map[string]string{"db": HealthStatusOK, "mqtt": HealthStatusFail, "log_errors": HealthStatusFail} {
+		if h.Checks[name] == nil || h.Checks[name].Status != want {
+			t.Errorf("check %s: %+v, want %s", name, h.Checks[name], want)
+		}
+	}
+}
+
+func TestParseMemAvailable(t *testing.T) {
+	data := []byte("MemTotal:       16318424 kB\nMemFree:          412340 kB\nMemAvailable:    9876543 kB\nBuffers:          123456 kB\n")
+	if v, ok := parseMemAvailable(data); !ok || v != 9876543*1024 {
+		t.Fatalf("got %d, %v", v, ok)
+	}
+
+	for _, data := range []string{"MemFree: 1 kB\n", "MemAvailable: x kB\n", "MemAvailable: 1\n"} {
+		if v, ok := parseMemAvailable([]byte(data)); ok {
+			t.Fatalf("%q: got %d", data, v)
+		}
+	}
+}
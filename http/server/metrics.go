@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/helpers"
+	"github.com/VladimirDronik/touchon-server/metrics"
+	"github.com/fasthttp/router"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// Метрики запросов, обработанных JsonHandlerWrapper
+var (
+	httpRequests = metrics.NewCounterVec()   // Количество запросов по методу, маршруту и коду ответа
+	httpDuration = metrics.NewHistogramVec() // Длительность обработки запросов по методу и маршруту
+)
+
+func init() {
+	metrics.RegisterCounterVec("http_requests_total", "Total number of HTTP requests.", httpRequests, "method", "route", "code")
+	metrics.RegisterHistogramVec("http_request_duration_seconds", "HTTP request latencies in seconds.", httpDuration, "method", "route")
+
+	metrics.Register("http", func() interface{} {
+		requests := make(map[string]uint64)
+		for label, v := range httpRequests.Snapshot() {
+			requests[strings.Join(metrics.SplitLabels(label), " ")] = v
+		}
+
+		duration := make(map[string]*metrics.HistogramSnapshot)
+		for label, v := range httpDuration.Snapshot() {
+			duration[strings.Join(metrics.SplitLabels(label), " ")] = v
+		}
+
+		return map[string]interface{}{"requests": requests, "duration": duration}
+	})
+}
+
+// observeRequest Учитывает запрос в метриках. Маршрут берется из шаблона пути роутера,
+// чтобы ID в пути не порождали новые метки.
+func observeRequest(ctx *fasthttp.RequestCtx, status int, d time.Duration) {
+	route, _ := ctx.UserValue(router.MatchedRoutePathParam).(string)
+	if route == "" {
+		route = "unknown"
+	}
+
+	method := string(ctx.Method())
+
+	httpRequests.With(metrics.JoinLabels(method, route, strconv.Itoa(status))).Inc()
+	httpDuration.With(metrics.JoinLabels(method, route)).ObserveDuration(d)
+}
+
+// Получить метрики сервиса
+// @Summary Получить метрики сервиса
+// @Tags Service
+// @Description Получить метрики сервиса в формате Prometheus (среда выполнения Go, HTTP-запросы, сообщения MQTT).
+// @Description С параметром format=json - метрики в формате JSON (время доставки и обработки сообщений, счетчики сообщений и ошибок)
+// @ID ServiceMetrics
+// @Produce text/plain
+// @Produce json
+// @Param format query string false "Формат: prometheus (по умолчанию) или json"
+// @Success      200 {object} http.Response[map[string]any]
+// @Failure      400 {object} http.Response[any]
+// @Router /_/metrics [get]
+func (o *Server) handleGetMetrics(ctx *fasthttp.RequestCtx) {
+	switch helpers.GetParam(ctx, "format") {
+	case "json":
+		JsonHandlerWrapper(o.handleGetMetricsJSON)(ctx)
+
+	case "", "prometheus":
+		ctx.Response.Header.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+		if err := metrics.WritePrometheus(ctx); err != nil {
+			o.logger.Error(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+		}
+
+	default:
+		JsonHandlerWrapper(func(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+			return nil, http.StatusBadRequest, errors.Errorf("unknown format %q", helpers.GetParam(ctx, "format"))
+		})(ctx)
+	}
+}
+
+func (o *Server) handleGetMetricsJSON(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	return metrics.Snapshot(), http.StatusOK, nil
+}
@@ -8,7 +8,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/VladimirDronik/touchon-server/helpers"
 	"github.com/VladimirDronik/touchon-server/info"
+	mqttClient "github.com/VladimirDronik/touchon-server/mqtt/client"
+	mqttService "github.com/VladimirDronik/touchon-server/mqtt/service"
+	"github.com/pkg/errors"
 	"github.com/valyala/fasthttp"
 )
 
@@ -32,6 +36,44 @@ func (o *Server) handleGetInfo(ctx *fasthttp.RequestCtx) (interface{}, int, erro
 	return nfo, http.StatusOK, nil
 }
 
+// Получить информацию обо всех сервисах
+// @Summary Получить информацию обо всех сервисах
+// @Tags Service
+// @Description Отправляет в шину команду info и собирает ответы сервисов
+// @ID ServiceClusterInfo
+// @Produce json
+// @Param timeout query string false "Время ожидания ответов, например 2s (не больше 10s)"
+// @Success      200 {object} http.Response[service.ClusterInfo]
+// @Failure      400 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/cluster/info [get]
+func (o *Server) handleGetClusterInfo(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	if mqttClient.I == nil {
+		return nil, http.StatusInternalServerError, errors.New("mqtt client is not initialized")
+	}
+
+	s := helpers.GetParam(ctx, "timeout")
+	if s == "" {
+		s = o.cfg["mqtt_cluster_info_timeout"]
+	}
+
+	timeout := mqttService.DefaultClusterInfoTimeout
+	if s != "" {
+		var err error
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout <= 0 || timeout > mqttService.MaxClusterInfoTimeout {
+			return nil, http.StatusBadRequest, errors.Errorf("bad timeout %q (max %s)", s, mqttService.MaxClusterInfoTimeout)
+		}
+	}
+
+	clusterInfo, err := mqttService.CollectClusterInfo(mqttClient.I, timeout)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return clusterInfo, http.StatusOK, nil
+}
+
 // Получить логи
 // @Summary Получить логи
 // @Tags Service
@@ -65,13 +107,12 @@ type Response[T any] struct {
 func JsonHandlerWrapper(f RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		var r Response[any]
-		const magic = "CoNtEnTLeNgTh"
 
 		start := time.Now()
 		data, status, err := f(ctx)
 		r.Meta.Duration = float64(int(time.Since(start).Seconds()*1000)) / 1000
-		r.Meta.ContentLength = magic
 		ctx.Response.SetStatusCode(status)
+		observeRequest(ctx, status, time.Since(start))
 
 		switch {
 		case err != nil:
@@ -82,20 +123,29 @@ func JsonHandlerWrapper(f RequestHandler) fasthttp.RequestHandler {
 
 		r.Success = err == nil
 
-		var buf bytes.Buffer
+		writeResponse(ctx, &r)
+	}
+}
 
-		enc := json.NewEncoder(&buf)
-		enc.SetIndent("", "  ")
-		if err := enc.Encode(r); err != nil {
-			buf.Reset()
-			r.Data = nil
-			r.Error = err.Error()
-			_ = enc.Encode(r)
-		}
+// writeResponse Записывает ответ в едином формате, выставляя размер ответа в метаданных
+func writeResponse(ctx *fasthttp.RequestCtx, r *Response[any]) {
+	const magic = "CoNtEnTLeNgTh"
+
+	r.Meta.ContentLength = magic
 
-		// Выставляем размер ответа
-		contLength := buf.Len() - len(magic)
-		body := strings.Replace(buf.String(), magic, strconv.Itoa(contLength/1024)+"K", 1)
-		_, _ = ctx.WriteString(body)
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		buf.Reset()
+		r.Data = nil
+		r.Error = err.Error()
+		_ = enc.Encode(r)
 	}
+
+	// Выставляем размер ответа
+	contLength := buf.Len() - len(magic)
+	body := strings.Replace(buf.String(), magic, strconv.Itoa(contLength/1024)+"K", 1)
+	_, _ = ctx.WriteString(body)
 }
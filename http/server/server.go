@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -37,6 +38,31 @@ func New(name string, cfg map[string]string, ringBuffer fmt.Stringer, logger *lo
 		ctx:          ctx,
 		cancel:       cancel,
 		gzipResponse: true,
+		startedAt:    time.Now(),
+	}
+
+	// Шаблон пути маршрута используется как метка метрик HTTP
+	o.router.SaveMatchedRoutePath = true
+
+	if err := o.initAuth(); err != nil {
+		return nil, errors.Wrap(err, "http.New")
+	}
+
+	var err error
+	if o.cors, err = newCORSPolicy(cfg); err != nil {
+		return nil, errors.Wrap(err, "http.New")
+	}
+
+	if err := o.initHealth(); err != nil {
+		return nil, errors.Wrap(err, "http.New")
+	}
+
+	if o.streams, err = newStreamHub(cfg, logger); err != nil {
+		return nil, errors.Wrap(err, "http.New")
+	}
+
+	if err := o.initCommand(); err != nil {
+		return nil, errors.Wrap(err, "http.New")
 	}
 
 	// Обработчик для Swagger'а
@@ -57,8 +83,22 @@ func New(name string, cfg map[string]string, ringBuffer fmt.Stringer, logger *lo
 	))
 
 	// Служебные эндпоинты
-	o.router.GET("/_/info", JsonHandlerWrapper(o.handleGetInfo))
-	o.router.GET("/_/log", o.handleGetLog)
+	o.AddHandler(http.MethodGet, "/_/info", o.handleGetInfo, RoleAdmin)
+	o.router.GET("/_/log", o.withAuth(o.handleGetLog, RoleAdmin))
+	o.AddHandler(http.MethodGet, "/_/cluster/info", o.handleGetClusterInfo, RoleAdmin)
+	o.router.GET("/_/metrics", o.withAuth(o.handleGetMetrics))
+	o.AddHandler(http.MethodGet, "/_/health/live", o.handleGetHealthLive, RoleAnonymous)
+	o.router.GET("/_/health/ready", o.withAuth(o.handleGetHealthReady, RoleAnonymous))
+	o.router.GET("/_/stream", streamAuth(o.withAuth(o.handleStream)))
+	o.AddHandler(http.MethodPost, "/_/command", o.handleCommand, RoleUser)
+
+	// Подписки на события (webhooks)
+	o.AddHandler(http.MethodGet, "/_/webhooks", o.handleGetWebhooks, RoleAdmin)
+	o.AddHandler(http.MethodPost, "/_/webhooks", o.handleCreateWebhook, RoleAdmin)
+	o.AddHandler(http.MethodGet, "/_/webhooks/{id}", o.handleGetWebhook, RoleAdmin)
+	o.AddHandler(http.MethodPut, "/_/webhooks/{id}", o.handleUpdateWebhook, RoleAdmin)
+	o.AddHandler(http.MethodDelete, "/_/webhooks/{id}", o.handleDeleteWebhook, RoleAdmin)
+	o.AddHandler(http.MethodGet, "/_/webhooks/{id}/deliveries", o.handleGetWebhookDeliveries, RoleAdmin)
 
 	o.httpServer.Handler = o.RequestWrapper(o.router.Handler)
 
@@ -76,6 +116,19 @@ type Server struct {
 	cancel       context.CancelFunc
 	requestID    atomic.Uint64
 	gzipResponse bool
+
+	authenticators []Authenticator // Способы авторизации (пустой - авторизация отключена)
+	cors           *corsPolicy
+	startedAt      time.Time
+
+	healthMu      sync.RWMutex
+	healthChecks  map[string]HealthCheck // Проверки готовности по названиям
+	healthTimeout time.Duration
+
+	streams *streamHub // Поток событий /_/stream
+
+	commandTopic   string        // Топик команд /_/command по умолчанию
+	commandTimeout time.Duration // Время ожидания результата команды по умолчанию
 }
 
 func (o *Server) GetGzipResponse() bool {
@@ -86,8 +139,10 @@ func (o *Server) SetGzipResponseIfPossible(v bool) {
 	o.gzipResponse = v
 }
 
-func (o *Server) AddHandler(method, path string, handler RequestHandler) {
-	o.router.Handle(method, path, JsonHandlerWrapper(handler))
+// AddHandler Добавляет обработчик, доступный пользователям с одной из ролей roles.
+// Без ролей обработчик доступен любому авторизованному пользователю, с ролью RoleAnonymous - всем.
+func (o *Server) AddHandler(method, path string, handler RequestHandler, roles ...string) {
+	o.router.Handle(method, path, o.withAuth(JsonHandlerWrapper(handler), roles...))
 }
 
 func (o *Server) GetContext() context.Context {
@@ -127,6 +182,10 @@ func (o *Server) Start(bindAddr string) error {
 func (o *Server) Shutdown() error {
 	o.cancel()
 
+	if err := o.streams.shutdown(); err != nil {
+		return errors.Wrap(err, "Shutdown")
+	}
+
 	if err := o.httpServer.Shutdown(); err != nil {
 		return errors.Wrap(err, "Shutdown")
 	}
@@ -139,22 +198,17 @@ func (o *Server) SetRequestID(ctx *fasthttp.RequestCtx) {
 	helpers.SetRequestID(ctx, o.requestID.Load())
 }
 
-// RequestWrapper добавляет CORS заголовки и content type
+// RequestWrapper добавляет CORS заголовки (по политике из настроек http_cors_*) и content type
 func (o *Server) RequestWrapper(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		// Маркируем запрос
 		o.SetRequestID(ctx)
 
-		ref := string(ctx.Request.Header.Peek("Origin"))
-		if ref == "" {
-			ref = "*"
+		// Предварительный запрос CORS обрабатывается без вызова обработчика
+		if o.cors.handle(ctx) {
+			return
 		}
 
-		ctx.Response.Header.Set("Access-Control-Allow-Origin", ref)
-		ctx.Response.Header.Set("Access-Control-Allow-Headers", "api-key,token,content-type")
-		ctx.Response.Header.Set("Access-Control-Allow-Methods", "*")
-		ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
-
 		// Хрому нужен OK на запрос OPTIONS
 		if string(ctx.Method()) == http.MethodOptions {
 			ctx.SetStatusCode(http.StatusOK)
@@ -174,6 +228,8 @@ func (o *Server) RequestWrapper(next fasthttp.RequestHandler) fasthttp.RequestHa
 		helpers.DumpResponse(o.logger, ctx)
 
 		switch {
+		case ctx.Hijacked():
+			// Соединение передано потоку событий, ответ fasthttp не отправляется
 		case o.gzipResponse && string(ctx.Response.Header.ContentEncoding()) == "" && ctx.Request.Header.HasAcceptEncoding("gzip"):
 			ctx.Response.Header.SetContentEncoding("gzip")
 			ctx.Response.SetBody(fasthttp.AppendGzipBytes(nil, ctx.Response.Body()))
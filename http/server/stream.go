@@ -0,0 +1,725 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/event"
+	"github.com/VladimirDronik/touchon-server/helpers"
+	"github.com/VladimirDronik/touchon-server/metrics"
+	mqttClient "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const (
+	DefaultStreamTopic  = "+/event/#"
+	DefaultStreamBuffer = 100
+
+	streamPingInterval = 30 * time.Second
+	streamWriteTimeout = 10 * time.Second
+)
+
+// Типы сообщений потока
+const (
+	StreamMessageEvent   = "event"   // Событие из шины
+	StreamMessageDropped = "dropped" // Клиент не успевал читать поток, часть событий отброшена
+)
+
+var (
+	streamClients = &metrics.Gauge{}   // Количество подключенных клиентов потока
+	streamDropped = &metrics.Counter{} // Количество событий, отброшенных из-за переполнения буферов клиентов
+)
+
+func init() {
+	metrics.RegisterGauge("http_stream_clients", "Number of connected event stream clients.", streamClients)
+	metrics.RegisterCounter("http_stream_dropped_total", "Total number of events dropped because of slow stream clients.", streamDropped)
+}
+
+// StreamMessage Сообщение потока событий
+type StreamMessage struct {
+	Type          string                 `json:"type"`                     // event, dropped
+	Event         string                 `json:"event,omitempty"`          // Код события
+	Name          string                 `json:"name,omitempty"`           // Название события из реестра событий
+	TargetType    string                 `json:"target_type,omitempty"`    //
+	TargetID      int                    `json:"target_id,omitempty"`      //
+	Publisher     string                 `json:"publisher,omitempty"`      //
+	CorrelationID string                 `json:"correlation_id,omitempty"` // ID команды, ответом на которую является событие
+	SentAt        *time.Time             `json:"sent_at,omitempty"`        //
+	Payload       map[string]interface{} `json:"payload,omitempty"`        // Значения свойств события
+	Dropped       int64                  `json:"dropped,omitempty"`        // Количество отброшенных событий
+}
+
+// newStreamMessage Создает сообщение потока из события шины.
+// Зарегистрированные события разбираются через реестр событий, значения свойств приводятся к их типам.
+func newStreamMessage(m messages.Message) *StreamMessage {
+	sentAt := m.GetSentAt()
+
+	r := &StreamMessage{
+		Type:          StreamMessageEvent,
+		Event:         m.GetName(),
+		TargetType:    m.GetTargetType(),
+		TargetID:      m.GetTargetID(),
+		Publisher:     m.GetPublisher(),
+		CorrelationID: m.GetCorrelationID(),
+		SentAt:        &sentAt,
+		Payload:       m.GetPayload(),
+	}
+
+	e, err := event.FromMqttMessage(m, false)
+	if err != nil {
+		return r
+	}
+
+	r.Name = e.Name
+	r.Payload = make(map[string]interface{}, e.Props.Len())
+	for _, p := range e.Props.GetOrderedMap().GetValueList() {
+		if v := p.GetValue(); v != nil {
+			r.Payload[p.Code] = v
+		}
+	}
+
+	return r
+}
+
+// streamFilter Фильтр событий клиента потока
+type streamFilter struct {
+	events     []string // Коды событий, допускаются шаблоны: object.sensor.*, *.on_alarm. Пустой - все события
+	targetType string
+	targetID   int
+}
+
+// parseStreamFilter Разбирает фильтр из параметров запроса event, target_type, target_id
+func parseStreamFilter(ctx *fasthttp.RequestCtx) (*streamFilter, error) {
+	f := &streamFilter{targetType: helpers.GetParam(ctx, "target_type")}
+
+	for _, pattern := range strings.Split(helpers.GetParam(ctx, "event"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("bad event pattern %q", pattern)
+		}
+
+		f.events = append(f.events, pattern)
+	}
+
+	if f.targetType != "" && !messages.TargetTypes[f.targetType] {
+		return nil, errors.Errorf("unknown target type %q", f.targetType)
+	}
+
+	if s := helpers.GetParam(ctx, "target_id"); s != "" {
+		var err error
+		if f.targetID, err = strconv.Atoi(s); err != nil || f.targetID <= 0 {
+			return nil, errors.Errorf("bad target_id %q", s)
+		}
+	}
+
+	return f, nil
+}
+
+func (o *streamFilter) match(m messages.Message) bool {
+	switch {
+	case o.targetType != "" && o.targetType != m.GetTargetType():
+		return false
+	case o.targetID != 0 && o.targetID != m.GetTargetID():
+		return false
+	case len(o.events) == 0:
+		return true
+	}
+
+	for _, pattern := range o.events {
+		if ok, _ := path.Match(pattern, m.GetName()); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamClient Клиент потока. События копятся в ограниченном буфере,
+// если клиент не успевает их читать, новые события отбрасываются.
+type streamClient struct {
+	filter  *streamFilter
+	c       chan []byte
+	dropped atomic.Int64 // Отброшено событий с последнего уведомления клиента
+}
+
+// takeDropped Возвращает сообщение об отброшенных событиях (nil - событий не отбрасывалось)
+func (o *streamClient) takeDropped() []byte {
+	n := o.dropped.Swap(0)
+	if n == 0 {
+		return nil
+	}
+
+	data, _ := json.Marshal(&StreamMessage{Type: StreamMessageDropped, Dropped: n})
+	return data
+}
+
+func newStreamHub(cfg map[string]string, logger *logrus.Logger) (*streamHub, error) {
+	o := &streamHub{
+		topic:      cfg["http_stream_topic"],
+		logger:     logger,
+		bufferSize: DefaultStreamBuffer,
+		clients:    make(map[*streamClient]struct{}),
+		waiters:    make(map[*streamWaiter]struct{}),
+		replies:    make(map[*streamWaiter]struct{}),
+	}
+
+	if o.topic == "" {
+		o.topic = DefaultStreamTopic
+	}
+
+	if s := cfg["http_stream_buffer"]; s != "" {
+		var err error
+		if o.bufferSize, err = strconv.Atoi(s); err != nil || o.bufferSize <= 0 {
+			return nil, errors.Wrap(errors.Errorf("bad http_stream_buffer %q", s), "newStreamHub")
+		}
+	}
+
+	return o, nil
+}
+
+// streamWaiter Ожидание первого подходящего события (ответа на команду, см. handleCommand)
+type streamWaiter struct {
+	match func(messages.Message) bool
+	c     chan messages.Message
+	sub   *mqttClient.Subscription // Отдельная подписка на ответы (nil - ожидание события из потока)
+}
+
+// streamHub Рассылает события шины клиентам потока и ожидающим ответа командам.
+// Подписка на топик событий выполняется при подключении первого клиента
+// и отменяется после отключения последнего.
+type streamHub struct {
+	topic      string
+	bufferSize int
+	logger     *logrus.Logger
+
+	mu      sync.Mutex
+	sub     *mqttClient.Subscription // Подписка на топик событий (nil - подписки нет)
+	clients map[*streamClient]struct{}
+	waiters map[*streamWaiter]struct{} // Ожидания событий из потока
+	replies map[*streamWaiter]struct{} // Ожидания ответов по отдельным подпискам
+	closed  bool
+}
+
+// subscribe Подписывается на топик событий, если подписки еще нет. Вызывается под o.mu.
+func (o *streamHub) subscribe() error {
+	if o.closed {
+		return errors.New("server is shutting down")
+	}
+
+	if o.sub != nil {
+		return nil
+	}
+
+	c := mqttClient.I
+	if c == nil {
+		return errors.New("mqtt client is not initialized")
+	}
+
+	sub, err := c.Subscribe(o.topic, o.bufferSize)
+	if err != nil {
+		return errors.Wrap(err, "streamHub.subscribe")
+	}
+
+	o.sub = sub
+	go o.run(sub.C())
+
+	return nil
+}
+
+// add Подключает клиента потока
+func (o *streamHub) add(filter *streamFilter) (*streamClient, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.subscribe(); err != nil {
+		return nil, errors.Wrap(err, "streamHub.add")
+	}
+
+	client := &streamClient{filter: filter, c: make(chan []byte, o.bufferSize)}
+	o.clients[client] = struct{}{}
+	streamClients.Inc()
+
+	return client, nil
+}
+
+// remove Отключает клиента потока
+func (o *streamHub) remove(client *streamClient) {
+	o.mu.Lock()
+
+	if _, ok := o.clients[client]; ok {
+		delete(o.clients, client)
+		close(client.c)
+		streamClients.Dec()
+	}
+
+	sub := o.release()
+	o.mu.Unlock()
+
+	o.unsubscribe(sub)
+}
+
+// release Забирает подписку на топик событий, если не осталось клиентов и ожиданий.
+// Вызывается под o.mu, отписка выполняется после снятия блокировки (см. unsubscribe).
+func (o *streamHub) release() *mqttClient.Subscription {
+	if len(o.clients) > 0 || len(o.waiters) > 0 {
+		return nil
+	}
+
+	sub := o.sub
+	o.sub = nil
+
+	return sub
+}
+
+// unsubscribe Отменяет подписку, забранную release. Канал подписки закрывается, и run завершается.
+func (o *streamHub) unsubscribe(sub *mqttClient.Subscription) {
+	if sub == nil {
+		return
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		o.logger.Error(errors.Wrap(err, "streamHub.unsubscribe"))
+	}
+}
+
+// wait Начинает ожидание события, для которого match вернет true.
+// Ожидание нужно начинать до отправки команды, чтобы не пропустить быстрый ответ.
+func (o *streamHub) wait(match func(messages.Message) bool) (*streamWaiter, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.subscribe(); err != nil {
+		return nil, errors.Wrap(err, "streamHub.wait")
+	}
+
+	w := &streamWaiter{match: match, c: make(chan messages.Message, 1)}
+	o.waiters[w] = struct{}{}
+
+	return w, nil
+}
+
+// waitReply Начинает ожидание ответа на команду, для которого match вернет true.
+// Ответы публикуются не в топики событий, поэтому для ожидания открывается отдельная подписка на topic.
+func (o *streamHub) waitReply(topic string, match func(messages.Message) bool) (*streamWaiter, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil, errors.Wrap(errors.New("server is shutting down"), "streamHub.waitReply")
+	}
+
+	c := mqttClient.I
+	if c == nil {
+		return nil, errors.Wrap(errors.New("mqtt client is not initialized"), "streamHub.waitReply")
+	}
+
+	sub, err := c.Subscribe(topic, o.bufferSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "streamHub.waitReply")
+	}
+
+	w := &streamWaiter{match: match, c: make(chan messages.Message, 1), sub: sub}
+	o.replies[w] = struct{}{}
+	go o.runReply(w)
+
+	return w, nil
+}
+
+// runReply Передает ожиданию первый подходящий ответ. Завершается при отмене подписки (см. stopWaiting).
+func (o *streamHub) runReply(w *streamWaiter) {
+	for msg := range w.sub.C() {
+		m, err := messages.NewFromMQTT(msg)
+		if err != nil || !w.match(m) {
+			continue
+		}
+
+		o.mu.Lock()
+		if _, ok := o.replies[w]; ok {
+			delete(o.replies, w)
+			w.c <- m
+		}
+		o.mu.Unlock()
+	}
+}
+
+// stopWaiting Завершает ожидание события или ответа
+func (o *streamHub) stopWaiting(w *streamWaiter) {
+	o.mu.Lock()
+	delete(o.waiters, w)
+	delete(o.replies, w)
+	sub := o.release()
+	o.mu.Unlock()
+
+	o.unsubscribe(sub)
+	o.unsubscribe(w.sub)
+}
+
+func (o *streamHub) run(msgs <-chan paho.Message) {
+	for msg := range msgs {
+		m, err := messages.NewFromMQTT(msg)
+		if err != nil || m.GetType() != messages.MessageTypeEvent {
+			continue
+		}
+
+		o.broadcast(m)
+	}
+}
+
+// broadcast Отправляет событие подходящим клиентам. Событие сериализуется один раз.
+func (o *streamHub) broadcast(m messages.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for w := range o.waiters {
+		if w.match(m) {
+			// Нужно только первое событие, остальные не ждем
+			delete(o.waiters, w)
+			w.c <- m
+		}
+	}
+
+	var data []byte
+
+	for client := range o.clients {
+		if !client.filter.match(m) {
+			continue
+		}
+
+		if data == nil {
+			var err error
+			if data, err = json.Marshal(newStreamMessage(m)); err != nil {
+				return
+			}
+		}
+
+		select {
+		case client.c <- data:
+		default:
+			client.dropped.Add(1)
+			streamDropped.Inc()
+		}
+	}
+}
+
+// shutdown Отписывается от событий и отключает всех клиентов
+func (o *streamHub) shutdown() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+
+	for _, waiters := range []map[*streamWaiter]struct{}{o.waiters, o.replies} {
+		for w := range waiters {
+			delete(waiters, w)
+			close(w.c)
+		}
+	}
+
+	for client := range o.clients {
+		delete(o.clients, client)
+		close(client.c)
+		streamClients.Dec()
+	}
+
+	if o.sub != nil {
+		sub := o.sub
+		o.sub = nil
+
+		if err := sub.Unsubscribe(); err != nil {
+			return errors.Wrap(err, "streamHub.shutdown")
+		}
+	}
+
+	return nil
+}
+
+// streamAuth Браузеры не позволяют задать заголовки для WebSocket и EventSource,
+// поэтому ключ и токен можно передать параметрами запроса api_key и token.
+func streamAuth(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if s := helpers.GetParam(ctx, "api_key"); s != "" && len(ctx.Request.Header.Peek("api-key")) == 0 {
+			ctx.Request.Header.Set("api-key", s)
+		}
+
+		if s := helpers.GetParam(ctx, "token"); s != "" && len(ctx.Request.Header.Peek("token")) == 0 {
+			ctx.Request.Header.Set("token", s)
+		}
+
+		next(ctx)
+	}
+}
+
+// Получить поток событий
+// @Summary Получить поток событий
+// @Tags Service
+// @Description Поток событий шины через WebSocket (при запросе Upgrade: websocket) или Server-Sent Events.
+// @Description Каждое сообщение - JSON StreamMessage. Если клиент не успевает читать поток, события отбрасываются,
+// @Description а клиенту отправляется сообщение с типом dropped и количеством отброшенных событий.
+// @Description Ключ и токен можно передать параметрами api_key и token.
+// @ID Stream
+// @Produce text/event-stream
+// @Param event query string false "Коды событий через запятую, допускаются шаблоны: object.sensor.*, *.on_alarm"
+// @Param target_type query string false "Тип цели"
+// @Param target_id query int false "ID цели"
+// @Success      200 {object} server.StreamMessage
+// @Failure      400 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/stream [get]
+func (o *Server) handleStream(ctx *fasthttp.RequestCtx) {
+	fail := func(status int, err error) {
+		JsonHandlerWrapper(func(*fasthttp.RequestCtx) (interface{}, int, error) {
+			return nil, status, err
+		})(ctx)
+	}
+
+	filter, err := parseStreamFilter(ctx)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	r := &http.Request{}
+	if err := fasthttpadaptor.ConvertRequest(ctx, r, true); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	ws := websocket.IsWebSocketUpgrade(r)
+	if ws && !o.cors.allowWebSocket(r.Header.Get("Origin"), r.Host) {
+		fail(http.StatusForbidden, errors.New("origin is not allowed"))
+		return
+	}
+
+	client, err := o.streams.add(filter)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Заголовки CORS, выставленные RequestWrapper, передаем в ответ SSE
+	header := make(http.Header)
+	ctx.Response.Header.VisitAll(func(k, v []byte) {
+		if strings.HasPrefix(string(k), "Access-Control-") || string(k) == "Vary" {
+			header.Add(string(k), string(v))
+		}
+	})
+
+	// Соединение обслуживается вне fasthttp, чтобы не действовали таймауты сервера и сжатие ответа
+	ctx.HijackSetNoResponse(true)
+	ctx.Hijack(func(conn net.Conn) {
+		defer o.streams.remove(client)
+
+		_ = conn.SetDeadline(time.Time{})
+
+		var err error
+		if ws {
+			err = serveWebSocket(conn, r, client)
+		} else {
+			err = serveSSE(conn, header, client)
+		}
+
+		if err != nil {
+			o.logger.Debug(errors.Wrap(err, "handleStream"))
+		}
+	})
+}
+
+// serveWebSocket Отправляет события клиенту WebSocket
+func serveWebSocket(netConn net.Conn, r *http.Request, client *streamClient) error {
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: streamWriteTimeout,
+		CheckOrigin:      func(*http.Request) bool { return true }, // Проверено до перехвата соединения
+	}
+
+	conn, err := upgrader.Upgrade(&hijackedResponseWriter{conn: netConn, header: make(http.Header)}, r, nil)
+	if err != nil {
+		return errors.Wrap(err, "serveWebSocket")
+	}
+
+	// Входящие сообщения не ожидаются, читаем только для обработки служебных кадров и закрытия соединения
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// После выхода соединение возвращается fasthttp, поэтому дожидаемся завершения чтения
+	defer func() {
+		_ = conn.Close()
+		<-closed
+	}()
+
+	write := func(data []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case data, ok := <-client.c:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+				return nil
+			}
+
+			if dropped := client.takeDropped(); dropped != nil {
+				if err := write(dropped); err != nil {
+					return errors.Wrap(err, "serveWebSocket")
+				}
+			}
+
+			if err := write(data); err != nil {
+				return errors.Wrap(err, "serveWebSocket")
+			}
+
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return errors.Wrap(err, "serveWebSocket")
+			}
+
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+// serveSSE Отправляет события клиенту Server-Sent Events.
+// Ответ не имеет длины, конец потока - закрытие соединения.
+func serveSSE(conn net.Conn, header http.Header, client *streamClient) error {
+	w := bufio.NewWriter(conn)
+
+	_, _ = w.WriteString("HTTP/1.1 200 OK\r\n")
+	header.Set("Content-Type", "text/event-stream; charset=UTF-8")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "close")
+	header.Set("X-Accel-Buffering", "no")
+	_ = header.Write(w)
+	_, _ = w.WriteString("\r\n")
+
+	// Строки, начинающиеся с двоеточия, - комментарии, клиент их пропускает
+	_, _ = w.WriteString(": connected\n\n")
+
+	write := func(event string, data []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+		switch {
+		case data == nil:
+			_, _ = w.WriteString(": ping\n\n")
+		case event != "":
+			_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		default:
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+
+		return w.Flush()
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "serveSSE")
+	}
+
+	// Клиент SSE ничего не отправляет, чтение завершится при закрытии соединения
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		buf := make([]byte, 512)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		_ = conn.Close()
+		<-closed
+	}()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case data, ok := <-client.c:
+			if !ok {
+				return nil
+			}
+
+			if dropped := client.takeDropped(); dropped != nil {
+				if err := write(StreamMessageDropped, dropped); err != nil {
+					return errors.Wrap(err, "serveSSE")
+				}
+			}
+
+			if err := write("", data); err != nil {
+				return errors.Wrap(err, "serveSSE")
+			}
+
+		case <-ping.C:
+			if err := write("", nil); err != nil {
+				return errors.Wrap(err, "serveSSE")
+			}
+
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+// hijackedResponseWriter Ответ поверх перехваченного у fasthttp соединения,
+// нужен websocket.Upgrader, который работает с net/http.
+type hijackedResponseWriter struct {
+	conn        net.Conn
+	header      http.Header
+	wroteHeader bool
+}
+
+func (o *hijackedResponseWriter) Header() http.Header {
+	return o.header
+}
+
+func (o *hijackedResponseWriter) WriteHeader(status int) {
+	if o.wroteHeader {
+		return
+	}
+	o.wroteHeader = true
+
+	o.header.Set("Connection", "close")
+	_, _ = fmt.Fprintf(o.conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	_ = o.header.Write(o.conn)
+	_, _ = o.conn.Write([]byte("\r\n"))
+}
+
+func (o *hijackedResponseWriter) Write(data []byte) (int, error) {
+	o.WriteHeader(http.StatusOK)
+	return o.conn.Write(data)
+}
+
+func (o *hijackedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return o.conn, bufio.NewReadWriter(bufio.NewReader(o.conn), bufio.NewWriter(o.conn)), nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/events/object/sensor"
+	"github.com/VladimirDronik/touchon-server/models"
+	mqttClient "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/gorilla/websocket"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestStream(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := mqttClient.NewBus()
+	publisher := bus.NewClient("object_manager", "object_manager", "object_manager/#")
+
+	prev := mqttClient.I
+	mqttClient.I = bus.NewClient("http", "http", "http/#")
+	defer func() { mqttClient.I = prev }()
+
+	srv, err := New("test", map[string]string{}, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+	go func() { _ = srv.GetServer().Serve(ln) }()
+	defer func() { _ = srv.Shutdown() }()
+
+	send := func(targetID int, msg string) {
+		m, err := sensor.NewOnAlarmMessage("object_manager/event/sensor", targetID, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := publisher.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(transport string, data []byte) {
+		m := &StreamMessage{}
+		if err := json.Unmarshal(data, m); err != nil {
+			t.Fatalf("%s: %v", transport, err)
+		}
+
+		if m.Type != StreamMessageEvent || m.Event != "object.sensor.on_alarm" || m.Name != "on_alarm" || m.TargetID != 5 || m.Payload["msg"] != "alarm" {
+			t.Fatalf("%s: unexpected message %s", transport, data)
+		}
+	}
+
+	// WebSocket
+	dialer := &websocket.Dialer{NetDial: func(string, string) (net.Conn, error) { return ln.Dial() }}
+	ws, _, err := dialer.Dial("ws://test/_/stream?event=object.sensor.*&target_id=5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	send(6, "other")
+	send(5, "alarm")
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("websocket", data)
+
+	// Server-Sent Events
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("GET /_/stream?target_type=object&target_id=5 HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	status, err := r.ReadString('\n')
+	if err != nil || !strings.Contains(status, "200") {
+		t.Fatalf("status %q, %v", status, err)
+	}
+
+	// Ждем окончания заголовков и комментария о подключении, после которого клиент зарегистрирован
+	for line := ""; line != ": connected\n"; {
+		if line, err = r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(5, "alarm")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.HasPrefix(line, "data: ") {
+			check("sse", []byte(strings.TrimPrefix(line, "data: ")))
+			break
+		}
+	}
+}
+
+func TestStreamHub_Release(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := mqttClient.I
+	mqttClient.I = mqttClient.NewBus().NewClient("http", "http", "http/#")
+	defer func() { mqttClient.I = prev }()
+
+	hub, err := newStreamHub(map[string]string{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribed := func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return hub.sub != nil
+	}
+
+	client, err := hub.add(&streamFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := hub.wait(func(messages.Message) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Подписка сохраняется, пока есть клиенты или ожидания
+	hub.remove(client)
+	if !subscribed() {
+		t.Fatal("unsubscribed while waiting")
+	}
+
+	hub.stopWaiting(w)
+	if subscribed() {
+		t.Fatal("subscription is not released")
+	}
+
+	// Следующий клиент подписывается заново
+	if _, err := hub.add(&streamFilter{}); err != nil || !subscribed() {
+		t.Fatalf("not subscribed again: %v", err)
+	}
+
+	if err := hub.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/VladimirDronik/touchon-server/helpers"
+	"github.com/VladimirDronik/touchon-server/webhooks"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// getWebhooks Возвращает сервис webhook'ов или ошибку, если он не запущен
+func getWebhooks() (*webhooks.Service, error) {
+	if webhooks.I == nil {
+		return nil, errors.New("webhooks are not initialized")
+	}
+
+	return webhooks.I, nil
+}
+
+// getWebhookID Возвращает ID подписки из пути запроса
+func getWebhookID(ctx *fasthttp.RequestCtx) (int, error) {
+	s, _ := ctx.UserValue("id").(string)
+
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		return 0, errors.Errorf("bad subscription id %q", s)
+	}
+
+	return id, nil
+}
+
+// hideSecret Убирает секрет из подписки для ответа
+func hideSecret(s *webhooks.Subscription) *webhooks.Subscription {
+	r := *s
+	r.Secret = ""
+	return &r
+}
+
+func webhookErrorStatus(err error) int {
+	if errors.Is(err, webhooks.ErrNotFound) {
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// Получить подписки на события
+// @Summary Получить подписки на события
+// @Tags Webhooks
+// @Description Получить подписки на события (секреты подписей не возвращаются)
+// @ID GetWebhooks
+// @Produce json
+// @Success      200 {object} http.Response[[]webhooks.Subscription]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/webhooks [get]
+func (o *Server) handleGetWebhooks(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	wh, err := getWebhooks()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	items, err := wh.GetStore().GetSubscriptions()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	r := make([]*webhooks.Subscription, 0, len(items))
+	for _, item := range items {
+		r = append(r, hideSecret(item))
+	}
+
+	return r, http.StatusOK, nil
+}
+
+// Получить подписку на события
+// @Summary Получить подписку на события
+// @Tags Webhooks
+// @Description Получить подписку на события
+// @ID GetWebhook
+// @Produce json
+// @Param id path int true "ID подписки"
+// @Success      200 {object} http.Response[webhooks.Subscription]
+// @Failure      400 {object} http.Response[any]
+// @Failure      404 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/webhooks/{id} [get]
+func (o *Server) handleGetWebhook(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	wh, err := getWebhooks()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	id, err := getWebhookID(ctx)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	s, err := wh.GetStore().GetSubscription(id)
+	if err != nil {
+		return nil, webhookErrorStatus(err), err
+	}
+
+	return hideSecret(s), http.StatusOK, nil
+}
+
+// Создать подписку на события
+// @Summary Создать подписку на события
+// @Tags Webhooks
+// @Description Создать подписку на события. События отправляются POST-запросом на url подписки.
+// @ID CreateWebhook
+// @Accept json
+// @Produce json
+// @Param subscription body webhooks.Subscription true "Подписка"
+// @Success      201 {object} http.Response[webhooks.Subscription]
+// @Failure      400 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/webhooks [post]
+func (o *Server) handleCreateWebhook(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	wh, err := getWebhooks()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	s := &webhooks.Subscription{Enabled: true}
+	if err := json.Unmarshal(ctx.PostBody(), s); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	s.ID = 0
+
+	if err := s.Check(); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := wh.SaveSubscription(s); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return hideSecret(s), http.StatusCreated, nil
+}
+
+// Изменить подписку на события
+// @Summary Изменить подписку на события
+// @Tags Webhooks
+// @Description Изменить подписку на события. Если секрет не передан, сохраняется прежний, пустая строка удаляет секрет.
+// @Description Если не передан признак enabled, сохраняется прежнее значение.
+// @ID UpdateWebhook
+// @Accept json
+// @Produce json
+// @Param id path int true "ID подписки"
+// @Param subscription body webhooks.Subscription true "Подписка"
+// @Success      200 {object} http.Response[webhooks.Subscription]
+// @Failure      400 {object} http.Response[any]
+// @Failure      404 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/webhooks/{id} [put]
+func (o *Server) handleUpdateWebhook(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	wh, err := getWebhooks()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	id, err := getWebhookID(ctx)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	prev, err := wh.GetStore().GetSubscription(id)
+	if err != nil {
+		return nil, webhookErrorStatus(err), err
+	}
+
+	s := &webhooks.Subscription{}
+	if err := json.Unmarshal(ctx.PostBody(), s); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	// Поля, которые сохраняют прежнее значение, если не переданы в запросе
+	kept := struct {
+		Secret  *string `json:"secret"`
+		Enabled *bool   `json:"enabled"`
+	}{}
+	if err := json.Unmarshal(ctx.PostBody(), &kept); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	s.ID = id
+	s.CreatedAt = prev.CreatedAt
+	if kept.Secret == nil {
+		s.Secret = prev.Secret
+	}
+
+	if kept.Enabled == nil {
+		s.Enabled = prev.Enabled
+	}
+
+	if err := s.Check(); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := wh.SaveSubscription(s); err != nil {
+		return nil, webhookErrorStatus(err), err
+	}
+
+	return hideSecret(s), http.StatusOK, nil
+}
+
+// Удалить подписку на события
+// @Summary Удалить подписку на события
+// @Tags Webhooks
+// @Description Удалить подписку на события вместе с журналом доставки
+// @ID DeleteWebhook
+// @Produce json
+// @Param id path int true "ID подписки"
+// @Success      200 {object} http.Response[any]
+// @Failure      400 {object} http.Response[any]
+// @Failure      404 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/webhooks/{id} [delete]
+func (o *Server) handleDeleteWebhook(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	wh, err := getWebhooks()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	id, err := getWebhookID(ctx)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := wh.DeleteSubscription(id); err != nil {
+		return nil, webhookErrorStatus(err), err
+	}
+
+	return nil, http.StatusOK, nil
+}
+
+// Получить журнал доставки подписки
+// @Summary Получить журнал доставки подписки
+// @Tags Webhooks
+// @Description Получить последние записи журнала доставки событий подписчику
+// @ID GetWebhookDeliveries
+// @Produce json
+// @Param id path int true "ID подписки"
+// @Param limit query int false "Количество записей (по умолчанию 100)"
+// @Success      200 {object} http.Response[[]webhooks.Delivery]
+// @Failure      400 {object} http.Response[any]
+// @Failure      404 {object} http.Response[any]
+// @Failure      500 {object} http.Response[any]
+// @Router /_/webhooks/{id}/deliveries [get]
+func (o *Server) handleGetWebhookDeliveries(ctx *fasthttp.RequestCtx) (interface{}, int, error) {
+	wh, err := getWebhooks()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	id, err := getWebhookID(ctx)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if _, err := wh.GetStore().GetSubscription(id); err != nil {
+		return nil, webhookErrorStatus(err), err
+	}
+
+	limit := 100
+	if s := helpers.GetParam(ctx, "limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return nil, http.StatusBadRequest, errors.Errorf("bad limit %q", s)
+		}
+	}
+
+	items, err := wh.GetStore().GetDeliveries(id, limit)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return items, http.StatusOK, nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	mqttClient "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/webhooks"
+	"github.com/valyala/fasthttp"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestWebhooks(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	wh, err := webhooks.New(mqttClient.NewBus().NewClient("webhooks", "webhooks", ""), db, map[string]string{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := webhooks.I
+	webhooks.I = wh
+	defer func() { webhooks.I = prev }()
+
+	srv, err := New("test", map[string]string{}, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = srv.Shutdown() }()
+
+	// do Выполняет запрос и возвращает код ответа и его тело
+	do := func(method, uri, body string) (int, string) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetBodyString(body)
+
+		srv.GetServer().Handler(ctx)
+
+		return ctx.Response.StatusCode(), string(ctx.Response.Body())
+	}
+
+	// stored Возвращает подписку из БД вместе с секретом
+	stored := func(id int) *webhooks.Subscription {
+		s, err := wh.GetStore().GetSubscription(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	status, body := do(http.MethodPost, "/_/webhooks", `{"name":"alarms","url":"http://127.0.0.1:1/hook","events":["*.on_alarm"],"secret":"s1"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", status, body)
+	}
+
+	created := &Response[webhooks.Subscription]{}
+	if err := json.Unmarshal([]byte(body), created); err != nil {
+		t.Fatal(err)
+	}
+
+	id := created.Data.ID
+	uri := "/_/webhooks/" + strconv.Itoa(id)
+
+	switch s := stored(id); {
+	case id == 0, !created.Data.Enabled:
+		t.Fatalf("unexpected subscription %+v", created.Data)
+	case strings.Contains(body, "s1"), s.Secret != "s1":
+		t.Fatalf("secret is returned or not saved: %s", body)
+	}
+
+	if status, body := do(http.MethodPost, "/_/webhooks", `{"url":"ftp://example.com"}`); status != http.StatusBadRequest {
+		t.Fatalf("create with bad url: status %d: %s", status, body)
+	}
+
+	// Без enabled и secret сохраняются прежние значения
+	if status, body := do(http.MethodPut, uri, `{"name":"alarms","url":"http://127.0.0.1:2/hook"}`); status != http.StatusOK {
+		t.Fatalf("update: status %d: %s", status, body)
+	}
+
+	if s := stored(id); !s.Enabled || s.Secret != "s1" || s.URL != "http://127.0.0.1:2/hook" || !s.CreatedAt.Equal(created.Data.CreatedAt) {
+		t.Fatalf("unexpected subscription after update %+v", s)
+	}
+
+	if status, body := do(http.MethodPut, uri, `{"url":"http://127.0.0.1:2/hook","enabled":false}`); status != http.StatusOK {
+		t.Fatalf("disable: status %d: %s", status, body)
+	}
+
+	if s := stored(id); s.Enabled || s.Secret != "s1" {
+		t.Fatalf("unexpected subscription after disable %+v", s)
+	}
+
+	// Пустой секрет удаляет прежний
+	if status, body := do(http.MethodPut, uri, `{"url":"http://127.0.0.1:2/hook","secret":""}`); status != http.StatusOK {
+		t.Fatalf("clear secret: status %d: %s", status, body)
+	}
+
+	if s := stored(id); s.Enabled || s.Secret != "" {
+		t.Fatalf("unexpected subscription after clearing secret %+v", s)
+	}
+
+	if status, body := do(http.MethodPut, uri, `{"url":"http://127.0.0.1:2/hook","secret":"secret-2"}`); status != http.StatusOK || strings.Contains(body, "secret-2") {
+		t.Fatalf("set secret: status %d: %s", status, body)
+	}
+
+	for _, u := range []string{"/_/webhooks", uri} {
+		status, body := do(http.MethodGet, u, "")
+		if status != http.StatusOK || !strings.Contains(body, "127.0.0.1:2/hook") || strings.Contains(body, "secret-2") {
+			t.Fatalf("get %s: status %d: %s", u, status, body)
+		}
+	}
+
+	for _, d := range []*webhooks.Delivery{{SubscriptionID: id, Event: "a"}, {SubscriptionID: id, Event: "b", Success: true}} {
+		if err := wh.GetStore().AddDelivery(d, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, body = do(http.MethodGet, uri+"/deliveries?limit=1", "")
+	if status != http.StatusOK {
+		t.Fatalf("deliveries: status %d: %s", status, body)
+	}
+
+	deliveries := &Response[[]webhooks.Delivery]{}
+	if err := json.Unmarshal([]byte(body), deliveries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries.Data) != 1 || deliveries.Data[0].Event != "b" {
+		t.Fatalf("unexpected deliveries %+v", deliveries.Data)
+	}
+
+	if status, body := do(http.MethodGet, uri+"/deliveries?limit=0", ""); status != http.StatusBadRequest {
+		t.Fatalf("deliveries with bad limit: status %d: %s", status, body)
+	}
+
+	if status, body := do(http.MethodDelete, uri, ""); status != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", status, body)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		if status, body := do(method, uri, `{"url":"http://127.0.0.1:2/hook"}`); status != http.StatusNotFound {
+			t.Fatalf("%s deleted: status %d: %s", method, status, body)
+		}
+	}
+
+	if status, body := do(http.MethodGet, "/_/webhooks/x", ""); status != http.StatusBadRequest {
+		t.Fatalf("bad id: status %d: %s", status, body)
+	}
+}
@@ -5,6 +5,7 @@ package info
 import (
 	"fmt"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -35,6 +36,24 @@ func init() {
 	}()
 }
 
+var sectionsMu sync.RWMutex
+var sections = make(map[string]func() interface{})
+
+// AddSection Добавляет в информацию о сервисе раздел,
+// значение которого вычисляется при каждом запросе информации.
+func AddSection(name string, f func() interface{}) {
+	sectionsMu.Lock()
+	defer sectionsMu.Unlock()
+	sections[name] = f
+}
+
+// RemoveSection Удаляет раздел из информации о сервисе
+func RemoveSection(name string) {
+	sectionsMu.Lock()
+	defer sectionsMu.Unlock()
+	delete(sections, name)
+}
+
 type Info struct {
 	Service        string
 	StartedAt      string
@@ -45,6 +64,7 @@ type Info struct {
 	GOOS           string
 	GOARCH         string
 	Env            map[string]string
+	Sections       map[string]interface{} `json:",omitempty"`
 }
 
 func GetInfo() (*Info, error) {
@@ -60,5 +80,19 @@ func GetInfo() (*Info, error) {
 		Env:            Config,
 	}
 
+	sectionsMu.RLock()
+	fs := make(map[string]func() interface{}, len(sections))
+	for name, f := range sections {
+		fs[name] = f
+	}
+	sectionsMu.RUnlock()
+
+	if len(fs) > 0 {
+		info.Sections = make(map[string]interface{}, len(fs))
+		for name, f := range fs {
+			info.Sections[name] = f()
+		}
+	}
+
 	return info, nil
 }
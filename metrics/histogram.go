@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultDurationBuckets Границы интервалов гистограммы длительностей, в секундах
+var DefaultDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// NewHistogram Создает гистограмму с указанными верхними границами интервалов.
+// Если границы не указаны, используются DefaultDurationBuckets.
+func NewHistogram(bounds ...float64) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultDurationBuckets
+	}
+
+	b := make([]float64, len(bounds))
+	copy(b, bounds)
+	sort.Float64s(b)
+
+	return &Histogram{
+		bounds: b,
+		counts: make([]uint64, len(b)+1),
+	}
+}
+
+// Histogram Распределение значений по интервалам
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // Количество значений в интервале; последний элемент - значения больше всех границ
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func (o *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(o.bounds, v)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.counts[i]++
+
+	if o.count == 0 || v < o.min {
+		o.min = v
+	}
+
+	if o.count == 0 || v > o.max {
+		o.max = v
+	}
+
+	o.count++
+	o.sum += v
+}
+
+// ObserveDuration Добавляет длительность в секундах
+func (o *Histogram) ObserveDuration(d time.Duration) {
+	o.Observe(d.Seconds())
+}
+
+// Bucket Интервал гистограммы
+type Bucket struct {
+	Le    string `json:"le"`    // Верхняя граница интервала (+Inf для последнего)
+	Count uint64 `json:"count"` // Количество значений, не превышающих границу
+}
+
+// HistogramSnapshot Значения гистограммы на момент запроса
+type HistogramSnapshot struct {
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+	Avg     float64  `json:"avg"`
+	Min     float64  `json:"min"`
+	Max     float64  `json:"max"`
+	P50     float64  `json:"p50"` // Оценка медианы по интервалам
+	P90     float64  `json:"p90"`
+	P99     float64  `json:"p99"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+func (o *Histogram) Snapshot() *HistogramSnapshot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s := &HistogramSnapshot{
+		Count:   o.count,
+		Sum:     o.sum,
+		Min:     o.min,
+		Max:     o.max,
+		Buckets: make([]Bucket, 0, len(o.counts)),
+	}
+
+	if o.count > 0 {
+		s.Avg = o.sum / float64(o.count)
+		s.P50 = o.quantile(0.5)
+		s.P90 = o.quantile(0.9)
+		s.P99 = o.quantile(0.99)
+	}
+
+	var cumulative uint64
+	for i, n := range o.counts {
+		cumulative += n
+
+		le := "+Inf"
+		if i < len(o.bounds) {
+			le = strconv.FormatFloat(o.bounds[i], 'g', -1, 64)
+		}
+
+		s.Buckets = append(s.Buckets, Bucket{Le: le, Count: cumulative})
+	}
+
+	return s
+}
+
+// quantile Оценивает квантиль линейной интерполяцией внутри интервала
+func (o *Histogram) quantile(q float64) float64 {
+	rank := q * float64(o.count)
+
+	var cumulative uint64
+	for i, n := range o.counts {
+		if n == 0 || float64(cumulative+n) < rank {
+			cumulative += n
+			continue
+		}
+
+		lower := o.min
+		if i > 0 {
+			lower = math.Max(o.bounds[i-1], o.min)
+		}
+
+		upper := o.max
+		if i < len(o.bounds) {
+			upper = math.Min(o.bounds[i], o.max)
+		}
+
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(n)
+	}
+
+	return o.max
+}
+
+// NewHistogramVec Создает набор гистограмм с указанными границами интервалов (см. NewHistogram)
+func NewHistogramVec(bounds ...float64) *HistogramVec {
+	return &HistogramVec{bounds: bounds, m: make(map[string]*Histogram)}
+}
+
+// HistogramVec Набор гистограмм, различающихся меткой
+type HistogramVec struct {
+	bounds []float64
+	mu     sync.RWMutex
+	m      map[string]*Histogram
+}
+
+// With Возвращает гистограмму для метки, создавая ее при необходимости
+func (o *HistogramVec) With(label string) *Histogram {
+	o.mu.RLock()
+	h, ok := o.m[label]
+	o.mu.RUnlock()
+
+	if ok {
+		return h
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if h, ok := o.m[label]; ok {
+		return h
+	}
+
+	h = NewHistogram(o.bounds...)
+	o.m[label] = h
+
+	return h
+}
+
+// Snapshot Возвращает значения гистограмм по меткам
+func (o *HistogramVec) Snapshot() map[string]*HistogramSnapshot {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	r := make(map[string]*HistogramSnapshot, len(o.m))
+	for label, h := range o.m {
+		r[label] = h.Snapshot()
+	}
+
+	return r
+}
+
+// Labels Возвращает отсортированный список меток
+func (o *HistogramVec) Labels() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	r := make([]string, 0, len(o.m))
+	for label := range o.m {
+		r = append(r, label)
+	}
+
+	sort.Strings(r)
+
+	return r
+}
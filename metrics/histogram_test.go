@@ -0,0 +1,31 @@
+package metrics
+
+import "testing"
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(1, 2, 5)
+	for _, v := range []float64{0.5, 1.5, 1.5, 3, 10} {
+		h.Observe(v)
+	}
+
+	s := h.Snapshot()
+
+	if s.Count != 5 || s.Sum != 16.5 || s.Min != 0.5 || s.Max != 10 {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+
+	want := []Bucket{{"1", 1}, {"2", 3}, {"5", 4}, {"+Inf", 5}}
+	for i, b := range want {
+		if s.Buckets[i] != b {
+			t.Fatalf("bucket %d = %+v, want %+v", i, s.Buckets[i], b)
+		}
+	}
+
+	if s.P50 < 1 || s.P50 > 2 {
+		t.Fatalf("p50 = %v, want value in (1, 2]", s.P50)
+	}
+
+	if s.P99 < 5 || s.P99 > 10 {
+		t.Fatalf("p99 = %v, want value in (5, 10]", s.P99)
+	}
+}
@@ -0,0 +1,155 @@
+// Пакет простых метрик сервиса: счетчики, показатели и гистограммы.
+// Группы метрик регистрируются по имени (Register) и отдаются эндпоинтом /_/metrics?format=json,
+// метрики в формате Prometheus регистрируются функциями Register* и RegisterCollector
+// и отдаются эндпоинтом /_/metrics.
+
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var registryMu sync.RWMutex
+var registry = make(map[string]func() interface{})
+
+// Register Регистрирует группу метрик, значение которой вычисляется при каждом запросе
+func Register(name string, f func() interface{}) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = f
+}
+
+// Unregister Удаляет группу метрик
+func Unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, name)
+}
+
+// Snapshot Возвращает текущие значения всех групп метрик
+func Snapshot() map[string]interface{} {
+	registryMu.RLock()
+	funcs := make(map[string]func() interface{}, len(registry))
+	for name, f := range registry {
+		funcs[name] = f
+	}
+	registryMu.RUnlock()
+
+	r := make(map[string]interface{}, len(funcs))
+	for name, f := range funcs {
+		r[name] = f()
+	}
+
+	return r
+}
+
+// Counter Монотонно возрастающий счетчик
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (o *Counter) Inc() {
+	o.v.Add(1)
+}
+
+func (o *Counter) Add(n uint64) {
+	o.v.Add(n)
+}
+
+func (o *Counter) Get() uint64 {
+	return o.v.Load()
+}
+
+func NewCounterVec() *CounterVec {
+	return &CounterVec{m: make(map[string]*Counter)}
+}
+
+// CounterVec Набор счетчиков, различающихся меткой (например, названием события)
+type CounterVec struct {
+	mu sync.RWMutex
+	m  map[string]*Counter
+}
+
+// With Возвращает счетчик для метки, создавая его при необходимости
+func (o *CounterVec) With(label string) *Counter {
+	o.mu.RLock()
+	c, ok := o.m[label]
+	o.mu.RUnlock()
+
+	if ok {
+		return c
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if c, ok := o.m[label]; ok {
+		return c
+	}
+
+	c = &Counter{}
+	o.m[label] = c
+
+	return c
+}
+
+// Snapshot Возвращает значения счетчиков по меткам
+func (o *CounterVec) Snapshot() map[string]uint64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	r := make(map[string]uint64, len(o.m))
+	for label, c := range o.m {
+		r[label] = c.Get()
+	}
+
+	return r
+}
+
+// Labels Возвращает отсортированный список меток
+func (o *CounterVec) Labels() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	r := make([]string, 0, len(o.m))
+	for label := range o.m {
+		r = append(r, label)
+	}
+
+	sort.Strings(r)
+
+	return r
+}
+
+// Gauge Показатель, значение которого может как расти, так и уменьшаться
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (o *Gauge) Set(v float64) {
+	o.bits.Store(math.Float64bits(v))
+}
+
+func (o *Gauge) Add(v float64) {
+	for {
+		old := o.bits.Load()
+		if o.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (o *Gauge) Inc() {
+	o.Add(1)
+}
+
+func (o *Gauge) Dec() {
+	o.Add(-1)
+}
+
+func (o *Gauge) Get() float64 {
+	return math.Float64frombits(o.bits.Load())
+}
@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Типы метрик Prometheus
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// labelSeparator Разделитель значений меток в метке CounterVec/HistogramVec (см. JoinLabels)
+const labelSeparator = "\x00"
+
+// JoinLabels Собирает метку CounterVec/HistogramVec из значений нескольких меток.
+// Названия меток задаются при регистрации (RegisterCounterVec, RegisterHistogramVec).
+func JoinLabels(values ...string) string {
+	return strings.Join(values, labelSeparator)
+}
+
+// SplitLabels Разбирает метку, собранную JoinLabels
+func SplitLabels(label string) []string {
+	return strings.Split(label, labelSeparator)
+}
+
+var collectorsMu sync.RWMutex
+var collectors = make(map[string]func(w *Writer))
+
+// RegisterCollector Регистрирует функцию, которая при каждом запросе метрик в формате Prometheus
+// записывает в w текущие значения. Метрики одного семейства от разных функций объединяются.
+func RegisterCollector(name string, f func(w *Writer)) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	collectors[name] = f
+}
+
+// UnregisterCollector Удаляет функцию сбора метрик
+func UnregisterCollector(name string) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	delete(collectors, name)
+}
+
+// RegisterCounter Регистрирует счетчик под именем name
+func RegisterCounter(name, help string, c *Counter) {
+	RegisterCollector(name, func(w *Writer) {
+		w.Counter(name, help, float64(c.Get()))
+	})
+}
+
+// RegisterCounterVec Регистрирует набор счетчиков. Метки счетчиков разбираются на значения меток labelNames (см. JoinLabels).
+func RegisterCounterVec(name, help string, c *CounterVec, labelNames ...string) {
+	RegisterCollector(name, func(w *Writer) {
+		values := c.Snapshot()
+		for _, label := range c.Labels() {
+			w.Counter(name, help, float64(values[label]), labelPairs(labelNames, label)...)
+		}
+	})
+}
+
+// RegisterGauge Регистрирует показатель под именем name
+func RegisterGauge(name, help string, g *Gauge) {
+	RegisterCollector(name, func(w *Writer) {
+		w.Gauge(name, help, g.Get())
+	})
+}
+
+// RegisterGaugeFunc Регистрирует показатель, значение которого вычисляется при каждом запросе
+func RegisterGaugeFunc(name, help string, f func() float64) {
+	RegisterCollector(name, func(w *Writer) {
+		w.Gauge(name, help, f())
+	})
+}
+
+// RegisterHistogram Регистрирует гистограмму под именем name
+func RegisterHistogram(name, help string, h *Histogram) {
+	RegisterCollector(name, func(w *Writer) {
+		w.Histogram(name, help, h.Snapshot())
+	})
+}
+
+// RegisterHistogramVec Регистрирует набор гистограмм. Метки гистограмм разбираются на значения меток labelNames (см. JoinLabels).
+func RegisterHistogramVec(name, help string, h *HistogramVec, labelNames ...string) {
+	RegisterCollector(name, func(w *Writer) {
+		values := h.Snapshot()
+		for _, label := range h.Labels() {
+			w.Histogram(name, help, values[label], labelPairs(labelNames, label)...)
+		}
+	})
+}
+
+// labelPairs Возвращает пары название-значение меток
+func labelPairs(names []string, label string) []string {
+	values := SplitLabels(label)
+
+	r := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		r = append(r, name, v)
+	}
+
+	return r
+}
+
+// WritePrometheus Записывает все зарегистрированные метрики в текстовом формате Prometheus
+func WritePrometheus(out io.Writer) error {
+	collectorsMu.RLock()
+	funcs := make([]func(w *Writer), 0, len(collectors))
+	for _, f := range collectors {
+		funcs = append(funcs, f)
+	}
+	collectorsMu.RUnlock()
+
+	w := &Writer{families: make(map[string]*family)}
+	for _, f := range funcs {
+		f(w)
+	}
+
+	if err := w.writeTo(out); err != nil {
+		return errors.Wrap(err, "WritePrometheus")
+	}
+
+	return nil
+}
+
+// Writer Собирает значения метрик для вывода в формате Prometheus
+type Writer struct {
+	families map[string]*family
+}
+
+type family struct {
+	typ     string
+	help    string
+	samples []sample
+}
+
+type sample struct {
+	suffix string // _bucket, _sum, _count для гистограмм
+	labels []string
+	value  float64
+}
+
+// Counter Добавляет значение счетчика. labels - пары название-значение меток.
+func (o *Writer) Counter(name, help string, v float64, labels ...string) {
+	o.add(name, TypeCounter, help, sample{labels: labels, value: v})
+}
+
+// Gauge Добавляет значение показателя. labels - пары название-значение меток.
+func (o *Writer) Gauge(name, help string, v float64, labels ...string) {
+	o.add(name, TypeGauge, help, sample{labels: labels, value: v})
+}
+
+// Histogram Добавляет гистограмму. labels - пары название-значение меток.
+func (o *Writer) Histogram(name, help string, s *HistogramSnapshot, labels ...string) {
+	samples := make([]sample, 0, len(s.Buckets)+2)
+	for _, b := range s.Buckets {
+		samples = append(samples, sample{suffix: "_bucket", labels: append(labels[:len(labels):len(labels)], "le", b.Le), value: float64(b.Count)})
+	}
+
+	samples = append(samples,
+		sample{suffix: "_sum", labels: labels, value: s.Sum},
+		sample{suffix: "_count", labels: labels, value: float64(s.Count)},
+	)
+
+	o.add(name, TypeHistogram, help, samples...)
+}
+
+func (o *Writer) add(name, typ, help string, samples ...sample) {
+	f, ok := o.families[name]
+	if !ok {
+		f = &family{typ: typ, help: help}
+		o.families[name] = f
+	}
+
+	f.samples = append(f.samples, samples...)
+}
+
+func (o *Writer) writeTo(out io.Writer) error {
+	names := make([]string, 0, len(o.families))
+	for name := range o.families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	w := bufio.NewWriter(out)
+
+	for _, name := range names {
+		f := o.families[name]
+
+		if f.help != "" {
+			_, _ = w.WriteString("# HELP " + name + " " + escapeHelp(f.help) + "\n")
+		}
+
+		_, _ = w.WriteString("# TYPE " + name + " " + f.typ + "\n")
+
+		for _, s := range f.samples {
+			_, _ = w.WriteString(name + s.suffix)
+
+			if len(s.labels) > 0 {
+				_ = w.WriteByte('{')
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						_ = w.WriteByte(',')
+					}
+					_, _ = w.WriteString(s.labels[i] + `="` + escapeLabelValue(s.labels[i+1]) + `"`)
+				}
+				_ = w.WriteByte('}')
+			}
+
+			_, _ = w.WriteString(" " + formatValue(s.value) + "\n")
+		}
+	}
+
+	return w.Flush()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+var startedAt = time.Now()
+
+func init() {
+	RegisterCollector("go_runtime", collectRuntime)
+}
+
+// collectRuntime Метрики среды выполнения Go
+func collectRuntime(w *Writer) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	w.Gauge("go_info", "Information about the Go environment.", 1, "version", runtime.Version())
+	w.Gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	w.Gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(m.Alloc))
+	w.Counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(m.TotalAlloc))
+	w.Gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(m.Sys))
+	w.Gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(m.HeapInuse))
+	w.Gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(m.HeapObjects))
+	w.Counter("go_memstats_mallocs_total", "Total number of mallocs.", float64(m.Mallocs))
+	w.Counter("go_memstats_frees_total", "Total number of frees.", float64(m.Frees))
+	w.Counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(m.NumGC))
+	w.Counter("go_gc_pause_seconds_total", "Total GC pause time in seconds.", float64(m.PauseTotalNs)/1e9)
+	w.Gauge("go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", float64(m.LastGC)/1e9)
+	w.Gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(startedAt.UnixNano())/1e9)
+}
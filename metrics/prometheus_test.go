@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	c := NewCounterVec()
+	c.With(JoinLabels("GET", `/a"b`)).Add(3)
+	RegisterCounterVec("test_requests_total", "Test requests.", c, "method", "route")
+	defer UnregisterCollector("test_requests_total")
+
+	g := &Gauge{}
+	g.Set(2.5)
+	g.Dec()
+	RegisterGauge("test_gauge", "Test gauge.", g)
+	defer UnregisterCollector("test_gauge")
+
+	h := NewHistogram(1, 2)
+	h.Observe(0.5)
+	h.Observe(3)
+	RegisterHistogram("test_duration_seconds", "", h)
+	defer UnregisterCollector("test_duration_seconds")
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	text := buf.String()
+
+	for _, want := range []string{
+		"# HELP test_requests_total Test requests.\n# TYPE test_requests_total counter\ntest_requests_total{method=\"GET\",route=\"/a\\\"b\"} 3\n",
+		"# TYPE test_gauge gauge\ntest_gauge 1.5\n",
+		"# TYPE test_duration_seconds histogram\n" +
+			"test_duration_seconds_bucket{le=\"1\"} 1\n" +
+			"test_duration_seconds_bucket{le=\"2\"} 1\n" +
+			"test_duration_seconds_bucket{le=\"+Inf\"} 2\n" +
+			"test_duration_seconds_sum 3.5\n" +
+			"test_duration_seconds_count 2\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("output does not contain:\n%s\ngot:\n%s", want, text)
+		}
+	}
+}
@@ -2,9 +2,9 @@ package models
 
 import (
 	"fmt"
-	"strconv"
 
 	"github.com/VladimirDronik/touchon-server/helpers"
+	"github.com/VladimirDronik/touchon-server/helpers/convert"
 	"github.com/pkg/errors"
 )
 
@@ -42,59 +42,50 @@ func (o *Item) GetValue() interface{} {
 
 // GetStringValue Метод-хэлпер для получения строкового значения
 func (o *Item) GetStringValue() (string, error) {
-	if v, ok := o.value.(string); ok {
-		return v, nil
+	v, err := convert.ToString(o.value)
+	if err != nil {
+		return "", errors.Wrap(err, "GetStringValue")
 	}
 
-	return "", errors.Wrap(errors.Errorf("value is not string (%T)", o.value), "GetStringValue")
+	return v, nil
 }
 
 // GetBoolValue Метод-хэлпер для получения логического значения
 func (o *Item) GetBoolValue() (bool, error) {
-	if v, ok := o.value.(bool); ok {
-		return v, nil
+	v, err := convert.ToBool(o.value)
+	if err != nil {
+		return false, errors.Wrap(err, "GetBoolValue")
 	}
 
-	return false, errors.Wrap(errors.Errorf("value is not bool (%T)", o.value), "GetBoolValue")
+	return v, nil
 }
 
 // GetEnumValue Метод-хэлпер для получения значения-перечисления
 func (o *Item) GetEnumValue() (string, error) {
-	if v, ok := o.value.(string); ok {
-		return v, nil
+	v, err := convert.ToString(o.value)
+	if err != nil {
+		return "", errors.Wrap(err, "GetEnumValue")
 	}
 
-	return "", errors.Wrap(errors.Errorf("value is not string (%T)", o.value), "GetEnumValue")
+	return v, nil
 }
 
 func (o *Item) GetIntValue() (int, error) {
-	switch v := o.value.(type) {
-	case float64:
-		return int(v), nil
-	case int:
-		return v, nil
-	case int64:
-		return int(v), nil
-	case string:
-		if v, err := strconv.Atoi(v); err == nil {
-			return v, nil
-		}
+	v, err := convert.ToInt(o.value)
+	if err != nil {
+		return 0, errors.Wrap(err, "GetIntValue")
 	}
 
-	return 0, errors.Wrap(errors.Errorf("value is not int (%T)", o.value), "GetIntValue")
+	return v, nil
 }
 
 func (o *Item) GetFloatValue() (float32, error) {
-	switch v := o.value.(type) {
-	case float32:
-		return v, nil
-	case float64:
-		return float32(v), nil
-	case int:
-		return float32(v), nil
-	default:
-		return 0, errors.Wrap(errors.Errorf("value is not float32, float64 or int (%T)", o.value), "GetFloatValue")
+	v, err := convert.ToFloat32(o.value)
+	if err != nil {
+		return 0, errors.Wrap(err, "GetFloatValue")
 	}
+
+	return v, nil
 }
 
 func (o *Item) SetValue(value interface{}) error {
@@ -121,76 +112,42 @@ func (o *Item) SetValue(value interface{}) error {
 		o.value = s
 
 	case DataTypeBool:
-		switch v := value.(type) {
-		case string:
-			if v == "" {
-				return nil
-			}
-			b, err := strconv.ParseBool(v)
-			if err != nil {
-				return errors.Wrap(err, "Item.SetValue")
-			}
-			o.value = b
-
-		case bool:
-			o.value = v
-
-		default:
-			return errors.Wrap(errors.Errorf("value is not string or bool (%T)", value), "Item.SetValue")
+		if value == "" {
+			return nil
+		}
+
+		b, err := convert.ToBool(value)
+		if err != nil {
+			return errors.Wrap(err, "Item.SetValue")
 		}
+		o.value = b
 
 	case DataTypeInt:
-		switch v := value.(type) {
-		case string:
-			if v == "" {
-				return nil
-			}
-			i, err := strconv.ParseInt(v, 10, 64)
-			if err != nil {
-				return errors.Wrap(err, "SetValue")
-			}
-			o.value = int(i)
-
-		case float32:
-			o.value = int(v)
-
-		case float64:
-			o.value = int(v)
-
-		case int:
-			o.value = v
-
-		default:
-			return errors.Wrap(errors.Errorf("value is not string or int (%T)", value), "Item.SetValue")
+		if value == "" {
+			return nil
 		}
 
+		i, err := convert.ToInt(value)
+		if err != nil {
+			return errors.Wrap(err, "Item.SetValue")
+		}
+		o.value = i
+
 	case DataTypeFloat:
 		round := o.noRound
 		if o.RoundFloat {
 			round = o.round
 		}
 
-		switch v := value.(type) {
-		case string:
-			if v == "" {
-				return nil
-			}
-			f, err := strconv.ParseFloat(v, 32)
-			if err != nil {
-				return errors.Wrap(err, "Item.SetValue")
-			}
-			o.value = round(float32(f))
-
-		case int:
-			o.value = round(float32(v))
-		case float64:
-			o.value = round(float32(v))
-		case float32:
-			o.value = round(v)
-
-		default:
-			return errors.Wrap(errors.Errorf("value is not string, int or float (%T)", value), "Item.SetValue")
+		if value == "" {
+			return nil
+		}
+
+		f, err := convert.ToFloat32(value)
+		if err != nil {
+			return errors.Wrap(err, "Item.SetValue")
 		}
+		o.value = round(f)
 
 	case DataTypeInterface:
 		o.value = value
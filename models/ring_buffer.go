@@ -2,6 +2,7 @@ package models
 
 import (
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -26,8 +27,13 @@ type RingBuffer struct {
 
 	logLevel     logrus.Level
 	logFormatter logrus.Formatter
+
+	errorTimes []time.Time // Время последних записей уровня error и выше
 }
 
+// maxErrorTimes Количество хранимых отметок времени ошибок
+const maxErrorTimes = 1000
+
 func (o *RingBuffer) Levels() []logrus.Level {
 	return logrus.AllLevels[:o.logLevel+1]
 }
@@ -42,9 +48,31 @@ func (o *RingBuffer) Fire(e *logrus.Entry) error {
 		return errors.Wrap(err, "RingBuffer.Fire")
 	}
 
+	if e.Level <= logrus.ErrorLevel {
+		o.mu.Lock()
+		if len(o.errorTimes) >= maxErrorTimes {
+			o.errorTimes = append(o.errorTimes[:0], o.errorTimes[1:]...)
+		}
+		o.errorTimes = append(o.errorTimes, e.Time)
+		o.mu.Unlock()
+	}
+
 	return nil
 }
 
+// CountErrors Возвращает количество записей уровня error и выше, сделанных начиная с since
+func (o *RingBuffer) CountErrors(since time.Time) int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	n := 0
+	for i := len(o.errorTimes) - 1; i >= 0 && !o.errorTimes[i].Before(since); i-- {
+		n++
+	}
+
+	return n
+}
+
 func (o *RingBuffer) String() string {
 	o.mu.RLock()
 	defer o.mu.RUnlock()
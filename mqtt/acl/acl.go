@@ -0,0 +1,214 @@
+// Пакет правил доступа к топикам шины (ACL).
+//
+// Правила задаются строками вида "<allow|deny> <pub|sub|all> <фильтр>", разделенными ";" или переводом строки:
+//
+//	mqtt_acl = "allow pub object_manager/#; allow sub #; deny sub debug/#"
+//
+// В фильтрах допускаются + и #, а также подстановки %c (ID клиента) и %u (имя пользователя).
+// Действие разрешено, если ему соответствует хотя бы одно разрешающее правило и ни одного запрещающего.
+// Пустой список правил ничего не запрещает.
+//
+// Правила можно выгрузить в формате acl_file брокера mosquitto (он же используется встроенным брокером).
+package acl
+
+import (
+	"strings"
+
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/pkg/errors"
+)
+
+var ErrDenied = errors.New("denied by ACL")
+
+type Action string
+
+const (
+	ActionPub Action = "pub" // Публикация
+	ActionSub Action = "sub" // Подписка и получение
+	ActionAll Action = "all"
+)
+
+// Rule Правило доступа
+type Rule struct {
+	Allow  bool
+	Action Action
+	Filter string
+}
+
+func (o *Rule) String() string {
+	s := "deny"
+	if o.Allow {
+		s = "allow"
+	}
+
+	return s + " " + string(o.Action) + " " + o.Filter
+}
+
+func (o *Rule) applies(action Action) bool {
+	return o.Action == ActionAll || o.Action == action
+}
+
+// filter Возвращает фильтр правила с выполненными подстановками
+func (o *Rule) filter(clientID, username string) string {
+	if !strings.Contains(o.Filter, "%") {
+		return o.Filter
+	}
+
+	return strings.NewReplacer("%c", clientID, "%u", username).Replace(o.Filter)
+}
+
+// Parse Разбирает правила доступа
+func Parse(s string) (*ACL, error) {
+	o := &ACL{}
+
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		items := strings.Fields(line)
+		if len(items) != 3 {
+			return nil, errors.Wrap(errors.Errorf("bad rule %q, expected <allow|deny> <pub|sub|all> <filter>", line), "acl.Parse")
+		}
+
+		r := &Rule{Action: Action(items[1]), Filter: items[2]}
+
+		switch items[0] {
+		case "allow":
+			r.Allow = true
+		case "deny":
+		default:
+			return nil, errors.Wrap(errors.Errorf("bad rule %q: unknown permission %q", line, items[0]), "acl.Parse")
+		}
+
+		switch r.Action {
+		case ActionPub, ActionSub, ActionAll:
+		default:
+			return nil, errors.Wrap(errors.Errorf("bad rule %q: unknown action %q", line, items[1]), "acl.Parse")
+		}
+
+		o.rules = append(o.rules, r)
+	}
+
+	return o, nil
+}
+
+// ACL Список правил доступа
+type ACL struct {
+	rules []*Rule
+
+	// Если правила не заданы, запрещать все (как брокер с включенным acl_file)
+	strict bool
+}
+
+func (o *ACL) GetRules() []*Rule {
+	return o.rules
+}
+
+// CanPublish Проверяет право публикации в топик
+func (o *ACL) CanPublish(topic, clientID, username string) bool {
+	return o.check(ActionPub, clientID, username, func(filter string) bool {
+		return topics.TopicMatch(filter, topic)
+	}, func(filter string) bool {
+		return topics.TopicMatch(filter, topic)
+	})
+}
+
+// CanRead Проверяет право получения сообщения из топика
+func (o *ACL) CanRead(topic, clientID, username string) bool {
+	return o.check(ActionSub, clientID, username, func(filter string) bool {
+		return topics.TopicMatch(filter, topic)
+	}, func(filter string) bool {
+		return topics.TopicMatch(filter, topic)
+	})
+}
+
+// CanSubscribe Проверяет право подписки: фильтр подписки должен целиком входить в разрешенный фильтр
+// и не пересекаться с запрещенными.
+func (o *ACL) CanSubscribe(filter, clientID, username string) bool {
+	filter = topics.TrimShared(filter)
+
+	return o.check(ActionSub, clientID, username, func(rule string) bool {
+		return covers(rule, filter)
+	}, func(rule string) bool {
+		return overlaps(rule, filter)
+	})
+}
+
+func (o *ACL) check(action Action, clientID, username string, allowMatch, denyMatch func(filter string) bool) bool {
+	if o == nil || (len(o.rules) == 0 && !o.strict) {
+		return true
+	}
+
+	allowed := false
+	for _, r := range o.rules {
+		if !r.applies(action) {
+			continue
+		}
+
+		filter := r.filter(clientID, username)
+
+		if !r.Allow && denyMatch(filter) {
+			return false
+		}
+
+		if r.Allow && allowMatch(filter) {
+			allowed = true
+		}
+	}
+
+	return allowed
+}
+
+// covers Проверяет, что все топики, подходящие под filter, подходят и под rule
+func covers(rule, filter string) bool {
+	r := strings.Split(rule, "/")
+	f := strings.Split(filter, "/")
+
+	for i, level := range r {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(f):
+			return false
+		case f[i] == "#":
+			return false
+		case level == "+":
+			continue
+		case f[i] == "+" || f[i] != level:
+			return false
+		}
+	}
+
+	return len(r) == len(f)
+}
+
+// overlaps Проверяет, существует ли топик, подходящий под оба фильтра
+func overlaps(a, b string) bool {
+	x := strings.Split(a, "/")
+	y := strings.Split(b, "/")
+
+	for i := 0; i < len(x) && i < len(y); i++ {
+		switch {
+		case x[i] == "#" || y[i] == "#":
+			return true
+		case x[i] == "+" || y[i] == "+":
+			continue
+		case x[i] != y[i]:
+			return false
+		}
+	}
+
+	if len(x) == len(y) {
+		return true
+	}
+
+	// "a/#" пересекается с "a"
+	longer := x
+	if len(y) > len(x) {
+		longer = y
+	}
+
+	return len(longer) == min(len(x), len(y))+1 && longer[len(longer)-1] == "#"
+}
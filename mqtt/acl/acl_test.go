@@ -0,0 +1,77 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestACL(t *testing.T) {
+	a, err := Parse("allow pub %c/#; allow sub #; deny sub debug/#\nallow all service/command")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"pub object_manager/event/relay", a.CanPublish("object_manager/event/relay", "object_manager", "")},
+		{"pub action_router/command/relay", !a.CanPublish("action_router/command/relay", "object_manager", "")},
+		{"pub service/command", a.CanPublish("service/command", "object_manager", "")},
+		{"sub action_router/#", a.CanSubscribe("action_router/#", "object_manager", "")},
+		{"sub $share/g/action_router/#", a.CanSubscribe("$share/g/action_router/#", "object_manager", "")},
+		{"sub debug/+/x", !a.CanSubscribe("debug/+/x", "object_manager", "")},
+		{"sub # overlaps debug", !a.CanSubscribe("#", "object_manager", "")},
+		{"read debug/x", !a.CanRead("debug/x", "object_manager", "")},
+	}
+
+	for _, tt := range tests {
+		if !tt.ok {
+			t.Errorf("%s: unexpected result", tt.name)
+		}
+	}
+
+	if (&ACL{}).CanPublish("any", "", "") != true {
+		t.Error("empty ACL must allow everything")
+	}
+}
+
+func TestMosquitto(t *testing.T) {
+	a, err := Parse("allow pub object_manager/#; allow sub #; deny all debug/#; deny pub service/#; allow sub %u/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := a.Mosquitto("om")
+	want := "user om\ntopic write object_manager/#\ntopic read #\ntopic deny debug/#\n# unsupported by mosquitto: deny pub service/#\npattern read %u/#\n"
+	if text != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", text, want)
+	}
+
+	// Выгруженные правила разрешают публикацию в service/#, об этом сообщается ошибкой
+	if errors.Cause(err) != ErrUnsupportedRule || !strings.Contains(err.Error(), "deny pub service/#") {
+		t.Fatalf("got error %v, want %v", err, ErrUnsupportedRule)
+	}
+
+	f, err := ParseMosquitto(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	om := f.Get("om")
+	switch {
+	case !om.CanPublish("object_manager/event", "c1", "om"):
+		t.Error("om must publish to object_manager/#")
+	case om.CanRead("debug/x", "c1", "om"):
+		t.Error("om must not read debug/#")
+	case !om.CanRead("om/x", "c1", "om"):
+		t.Error("om must read own pattern topics")
+	}
+
+	// Пользователь без правил не имеет доступа
+	if f.Get("guest").CanRead("object_manager/event", "c2", "guest") {
+		t.Error("guest must not read anything")
+	}
+}
@@ -0,0 +1,169 @@
+package acl
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupportedRule Правило не выражается в формате acl_file mosquitto
+var ErrUnsupportedRule = errors.New("rule is not supported by mosquitto")
+
+// Mosquitto Выгружает правила в формате acl_file брокера mosquitto для пользователя username.
+// Правила с подстановками выгружаются строками pattern, которые mosquitto применяет ко всем пользователям.
+// Запреты только публикации или только подписки в mosquitto не выражаются: они выгружаются комментариями,
+// а функция возвращает ошибку ErrUnsupportedRule со списком таких правил, так как выгруженные правила
+// разрешают больше исходных.
+func (o *ACL) Mosquitto(username string) (string, error) {
+	sb := &strings.Builder{}
+	var unsupported []string
+
+	if username != "" {
+		sb.WriteString("user " + username + "\n")
+	}
+
+	for _, r := range o.rules {
+		keyword := "topic"
+		if strings.Contains(r.Filter, "%") {
+			keyword = "pattern"
+		}
+
+		var access string
+		switch {
+		case !r.Allow && r.Action == ActionAll:
+			access = "deny"
+		case !r.Allow:
+			sb.WriteString("# unsupported by mosquitto: " + r.String() + "\n")
+			unsupported = append(unsupported, r.String())
+			continue
+		case r.Action == ActionPub:
+			access = "write"
+		case r.Action == ActionSub:
+			access = "read"
+		default:
+			access = "readwrite"
+		}
+
+		sb.WriteString(keyword + " " + access + " " + r.Filter + "\n")
+	}
+
+	if len(unsupported) > 0 {
+		return sb.String(), errors.Wrap(errors.Wrap(ErrUnsupportedRule, strings.Join(unsupported, "; ")), "ACL.Mosquitto")
+	}
+
+	return sb.String(), nil
+}
+
+// File Правила доступа брокера в формате acl_file mosquitto
+type File struct {
+	anonymous []*Rule            // Правила до первой строки user
+	users     map[string][]*Rule // Правила пользователей
+	patterns  []*Rule            // Правила pattern, общие для всех пользователей
+}
+
+// Get Возвращает правила доступа пользователя. Если правил нет, доступ запрещен.
+func (o *File) Get(username string) *ACL {
+	rules := o.anonymous
+	if username != "" {
+		rules = o.users[username]
+	}
+
+	r := &ACL{strict: true}
+	r.rules = append(r.rules, rules...)
+	r.rules = append(r.rules, o.patterns...)
+
+	return r
+}
+
+// LoadMosquittoFile Загружает правила доступа из файла в формате acl_file mosquitto
+func LoadMosquittoFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadMosquittoFile")
+	}
+
+	f, err := ParseMosquitto(string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadMosquittoFile")
+	}
+
+	return f, nil
+}
+
+// ParseMosquitto Разбирает правила в формате acl_file mosquitto (строки user, topic и pattern)
+func ParseMosquitto(s string) (*File, error) {
+	o := &File{users: make(map[string][]*Rule)}
+
+	user := ""
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		items := strings.Fields(line)
+
+		switch items[0] {
+		case "user":
+			if len(items) != 2 {
+				return nil, errors.Wrap(errors.Errorf("line %d: expected user <name>", i+1), "ParseMosquitto")
+			}
+
+			user = items[1]
+			if _, ok := o.users[user]; !ok {
+				o.users[user] = nil
+			}
+
+		case "topic", "pattern":
+			r, err := parseMosquittoRule(items[1:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "ParseMosquitto: line %d", i+1)
+			}
+
+			switch {
+			case items[0] == "pattern":
+				o.patterns = append(o.patterns, r)
+			case user == "":
+				o.anonymous = append(o.anonymous, r)
+			default:
+				o.users[user] = append(o.users[user], r)
+			}
+
+		default:
+			return nil, errors.Wrap(errors.Errorf("line %d: unknown keyword %q", i+1, items[0]), "ParseMosquitto")
+		}
+	}
+
+	return o, nil
+}
+
+func parseMosquittoRule(items []string) (*Rule, error) {
+	access := "readwrite"
+
+	switch len(items) {
+	case 1:
+	case 2:
+		access = items[0]
+	default:
+		return nil, errors.Wrap(errors.New("expected [read|write|readwrite|deny] <topic>"), "parseMosquittoRule")
+	}
+
+	r := &Rule{Allow: true, Filter: items[len(items)-1]}
+
+	switch access {
+	case "read":
+		r.Action = ActionSub
+	case "write":
+		r.Action = ActionPub
+	case "readwrite":
+		r.Action = ActionAll
+	case "deny":
+		r.Allow = false
+		r.Action = ActionAll
+	default:
+		return nil, errors.Wrap(errors.Errorf("unknown access %q", access), "parseMosquittoRule")
+	}
+
+	return r, nil
+}
@@ -0,0 +1,398 @@
+// Пакет встроенного MQTT 3.1.1 брокера для небольших инсталляций.
+// Поддерживает QoS 0-2, retained-сообщения, LWT, общие подписки ($share)
+// и аутентификацию по логину и паролю из настроек. Сессии не сохраняются
+// между подключениями (каждое подключение считается чистой сессией).
+//
+// Настройки:
+//
+//	mqtt_broker_enabled         = true
+//	mqtt_broker_addr            = ":1883"            # пусто - только подключения внутри процесса
+//	mqtt_broker_users           = "user:pass,user2:pass2"
+//	mqtt_broker_allow_anonymous = false              # по умолчанию true, если пользователи не заданы
+//	mqtt_broker_acl_file        = "/etc/touchon/acl" # правила доступа в формате acl_file mosquitto (см. пакет mqtt/acl)
+//
+// Клиенты внутри процесса подключаются со строкой подключения вида embedded://user:pass@/topic.
+
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/acl"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Scheme Схема строки подключения для клиентов внутри процесса
+const Scheme = "embedded"
+
+// Global instance
+var I *Broker
+
+func New(cfg map[string]string, logger *logrus.Logger) (*Broker, error) {
+	if logger == nil {
+		return nil, errors.Wrap(errors.New("logger is nil"), "broker.New")
+	}
+
+	o := &Broker{
+		addr:      cfg["mqtt_broker_addr"],
+		users:     make(map[string]string),
+		logger:    logger,
+		sessions:  make(map[string]*session),
+		retained:  make(map[string]*packets.PublishPacket),
+		shareNext: make(map[string]int),
+		done:      make(chan struct{}),
+	}
+
+	for _, item := range strings.Split(cfg["mqtt_broker_users"], ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Wrap(errors.Errorf("bad user %q, expected user:password", item), "broker.New")
+		}
+
+		o.users[kv[0]] = kv[1]
+	}
+
+	o.allowAnonymous = len(o.users) == 0
+	if v := cfg["mqtt_broker_allow_anonymous"]; v != "" {
+		var err error
+		o.allowAnonymous, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "broker.New")
+		}
+	}
+
+	if path := cfg["mqtt_broker_acl_file"]; path != "" {
+		var err error
+		o.acl, err = acl.LoadMosquittoFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "broker.New")
+		}
+	}
+
+	return o, nil
+}
+
+type Broker struct {
+	addr           string
+	users          map[string]string
+	allowAnonymous bool
+	acl            *acl.File // Правила доступа (nil - без ограничений)
+	logger         *logrus.Logger
+	listener       net.Listener
+
+	mu        sync.RWMutex
+	sessions  map[string]*session               // clientID -> сессия
+	retained  map[string]*packets.PublishPacket // topic -> retained-сообщение
+	shareNext map[string]int                    // Очередность доставки для общих подписок
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	received  atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	slow      atomic.Uint64
+}
+
+// Stats Статистика брокера
+type Stats struct {
+	Addr      string
+	Clients   int
+	Retained  int
+	Received  uint64 // Количество принятых от клиентов сообщений
+	Delivered uint64 // Количество отправленных клиентам сообщений
+	Dropped   uint64 // Количество QoS 0 сообщений, не доставленных медленным клиентам
+	Slow      uint64 // Количество отключений клиентов, переполнивших очередь отправки
+}
+
+func (o *Broker) GetStats() *Stats {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return &Stats{
+		Addr:      o.addr,
+		Clients:   len(o.sessions),
+		Retained:  len(o.retained),
+		Received:  o.received.Load(),
+		Delivered: o.delivered.Load(),
+		Dropped:   o.dropped.Load(),
+		Slow:      o.slow.Load(),
+	}
+}
+
+// Start Запускает прием подключений по TCP (если задан адрес)
+// и регистрирует схему embedded для подключений внутри процесса.
+func (o *Broker) Start() error {
+	if o.addr != "" {
+		l, err := net.Listen("tcp", o.addr)
+		if err != nil {
+			return errors.Wrap(err, "Broker.Start")
+		}
+
+		o.listener = l
+
+		o.wg.Add(1)
+		go o.acceptLoop()
+	}
+
+	mqtt.RegisterDialer(Scheme, o.Dial)
+
+	o.logger.Infof("MQTT broker (%s): брокер запущен", o.addr)
+
+	return nil
+}
+
+func (o *Broker) Shutdown() error {
+	close(o.done)
+
+	if o.listener != nil {
+		if err := o.listener.Close(); err != nil {
+			return errors.Wrap(err, "Broker.Shutdown")
+		}
+	}
+
+	o.mu.RLock()
+	sessions := make([]*session, 0, len(o.sessions))
+	for _, s := range o.sessions {
+		sessions = append(sessions, s)
+	}
+	o.mu.RUnlock()
+
+	for _, s := range sessions {
+		s.close()
+	}
+
+	o.wg.Wait()
+
+	o.logger.Infof("MQTT broker (%s): брокер остановлен", o.addr)
+
+	return nil
+}
+
+// Dial Устанавливает соединение с брокером внутри процесса
+func (o *Broker) Dial() (net.Conn, error) {
+	select {
+	case <-o.done:
+		return nil, errors.Wrap(errors.New("broker is stopped"), "Broker.Dial")
+	default:
+	}
+
+	client, server := net.Pipe()
+
+	o.wg.Add(1)
+	go o.serve(server)
+
+	return client, nil
+}
+
+func (o *Broker) acceptLoop() {
+	defer o.wg.Done()
+
+	for {
+		conn, err := o.listener.Accept()
+		if err != nil {
+			select {
+			case <-o.done:
+				return
+			default:
+			}
+
+			o.logger.Error(errors.Wrap(err, "Broker.acceptLoop"))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		o.wg.Add(1)
+		go o.serve(conn)
+	}
+}
+
+func (o *Broker) serve(conn net.Conn) {
+	defer o.wg.Done()
+	defer conn.Close()
+
+	// Клиент должен представиться сразу после подключения
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		o.logger.Debugf("MQTT broker: read CONNECT from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	connect, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		o.logger.Debugf("MQTT broker: expected CONNECT from %s, got %s", conn.RemoteAddr(), p)
+		return
+	}
+
+	code := connect.Validate()
+	if code == packets.Accepted {
+		code = o.authenticate(connect)
+	}
+
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = code
+
+	if code != packets.Accepted {
+		_ = ack.Write(conn)
+		o.logger.Debugf("MQTT broker: client %q rejected: %s", connect.ClientIdentifier, packets.ConnackReturnCodes[code])
+		return
+	}
+
+	clientID := connect.ClientIdentifier
+	if clientID == "" {
+		clientID = "auto-" + randomID()
+	}
+
+	// Сессия регистрируется до отправки CONNACK, чтобы клиент был известен брокеру сразу после подключения
+	s := newSession(o, conn, clientID, connect)
+	o.addSession(s)
+
+	if err := ack.Write(conn); err != nil {
+		o.removeSession(s)
+		return
+	}
+
+	o.logger.Debugf("MQTT broker: client %q connected", clientID)
+
+	s.run()
+
+	o.removeSession(s)
+
+	// При обрыве соединения публикуем завещание клиента (но не при остановке брокера)
+	select {
+	case <-o.done:
+	default:
+		if !s.gracefulDisconnect && s.will != nil {
+			o.publish(s.will)
+		}
+	}
+
+	o.logger.Debugf("MQTT broker: client %q disconnected", clientID)
+}
+
+func (o *Broker) authenticate(connect *packets.ConnectPacket) byte {
+	if !connect.UsernameFlag {
+		if o.allowAnonymous {
+			return packets.Accepted
+		}
+
+		return packets.ErrRefusedNotAuthorised
+	}
+
+	password, ok := o.users[connect.Username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), connect.Password) != 1 {
+		return packets.ErrRefusedBadUsernameOrPassword
+	}
+
+	return packets.Accepted
+}
+
+func (o *Broker) addSession(s *session) {
+	o.mu.Lock()
+	prev := o.sessions[s.clientID]
+	o.sessions[s.clientID] = s
+	o.mu.Unlock()
+
+	// Новое подключение с тем же clientID вытесняет старое
+	if prev != nil {
+		prev.close()
+	}
+}
+
+func (o *Broker) removeSession(s *session) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.sessions[s.clientID] == s {
+		delete(o.sessions, s.clientID)
+	}
+}
+
+// publish Сохраняет retained-сообщение и рассылает сообщение подписчикам
+func (o *Broker) publish(p *packets.PublishPacket) {
+	o.received.Add(1)
+
+	o.mu.Lock()
+
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(o.retained, p.TopicName)
+		} else {
+			o.retained[p.TopicName] = p
+		}
+	}
+
+	type target struct {
+		s   *session
+		qos byte
+	}
+
+	var targets []target
+	shared := make(map[string][]target)
+
+	for _, s := range o.sessions {
+		qos, ok, groups := s.match(p.TopicName)
+		if ok {
+			targets = append(targets, target{s, min(qos, p.Qos)})
+		}
+
+		for key, qos := range groups {
+			shared[key] = append(shared[key], target{s, min(qos, p.Qos)})
+		}
+	}
+
+	// Сообщение общей подписки получает один участник группы
+	for key, items := range shared {
+		// Порядок обхода сессий случайный, поэтому упорядочиваем участников группы
+		sort.Slice(items, func(i, j int) bool { return items[i].s.clientID < items[j].s.clientID })
+
+		i := o.shareNext[key] % len(items)
+		o.shareNext[key]++
+		targets = append(targets, items[i])
+	}
+
+	o.mu.Unlock()
+
+	for _, t := range targets {
+		t.s.deliver(p.TopicName, p.Payload, t.qos, false)
+	}
+}
+
+// getRetained Возвращает retained-сообщения, подходящие под фильтр
+func (o *Broker) getRetained(filter string) []*packets.PublishPacket {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var r []*packets.PublishPacket
+	for topic, p := range o.retained {
+		if topicMatch(filter, topic) {
+			r = append(r, p)
+		}
+	}
+
+	return r
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,258 @@
+package broker
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func newTestBroker(t *testing.T, cfg map[string]string) *Broker {
+	t.Helper()
+
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = b.Shutdown() })
+
+	return b
+}
+
+func newTestClient(t *testing.T, clientID, connString string, will *mqtt.Will) (mqtt.Client, error) {
+	t.Helper()
+
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := mqtt.NewWithWill(clientID, connString, time.Second, 1, will, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetIgnoreSelfMsgs(false)
+
+	return c, nil
+}
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	newTestBroker(t, map[string]string{"mqtt_broker_users": "svc:secret"})
+
+	if _, err := newTestClient(t, "bad", "embedded://svc:wrong@/", nil); err == nil {
+		t.Fatal("connection with bad password must fail")
+	}
+
+	pub, err := newTestClient(t, "pub", "embedded://svc:secret@/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Shutdown()
+
+	// Retained-сообщение должно прийти подписчику, подключившемуся позже
+	if err := pub.SendRaw("object_manager/state/relay/5", messages.QoSMinimumOne, true, []byte("on")); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := newTestClient(t, "sub", "embedded://svc:secret@/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Shutdown()
+
+	msgs, err := sub.Subscribe("object_manager/#", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-msgs.C():
+		if !msg.Retained() || string(msg.Payload()) != "on" {
+			t.Fatalf("unexpected retained message %v %q", msg.Retained(), msg.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retained message not delivered")
+	}
+
+	for _, qos := range []messages.QoS{messages.QoSNotGuaranteed, messages.QoSMinimumOne, messages.QoSGuaranteedOne} {
+		if err := pub.SendRaw("object_manager/event/relay", qos, false, []byte("event")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case msg := <-msgs.C():
+			if msg.Topic() != "object_manager/event/relay" || string(msg.Payload()) != "event" {
+				t.Fatalf("QoS %d: unexpected message [%s] %q", qos, msg.Topic(), msg.Payload())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("QoS %d: message not delivered", qos)
+		}
+	}
+}
+
+func TestBroker_Will(t *testing.T) {
+	b := newTestBroker(t, map[string]string{})
+
+	watcher, err := newTestClient(t, "watcher", "embedded:///", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Shutdown()
+
+	msgs, err := watcher.Subscribe("service/leader/#", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	will := &mqtt.Will{Topic: "service/leader/poller", Payload: []byte("released"), QoS: messages.QoSMinimumOne, Retained: true}
+	if _, err := newTestClient(t, "leader", "embedded:///", will); err != nil {
+		t.Fatal(err)
+	}
+
+	// Обрываем соединение клиента без DISCONNECT
+	b.mu.RLock()
+	s := b.sessions["leader"]
+	b.mu.RUnlock()
+	s.close()
+
+	select {
+	case msg := <-msgs.C():
+		if string(msg.Payload()) != "released" {
+			t.Fatalf("unexpected will %q", msg.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("will not published")
+	}
+
+	if s := b.GetStats(); s.Retained != 1 {
+		t.Fatalf("retained = %d, want 1", s.Retained)
+	}
+}
+
+func TestBroker_SharedSubscription(t *testing.T) {
+	newTestBroker(t, map[string]string{})
+
+	pub, err := newTestClient(t, "pub", "embedded:///", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Shutdown()
+
+	var chans []<-chan paho.Message
+	for _, id := range []string{"r1", "r2"} {
+		c, err := newTestClient(t, id, "embedded:///", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Shutdown()
+
+		msgs, err := c.Subscribe("$share/routers/action_router/#", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chans = append(chans, msgs.C())
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := pub.SendRaw("action_router/command", messages.QoSNotGuaranteed, false, []byte("cmd")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Сообщения распределяются между участниками группы поровну
+	for i, c := range chans {
+		if n := len(c); n != 2 {
+			t.Fatalf("replica %d received %d messages, want 2", i, n)
+		}
+	}
+}
+
+func TestSession_SlowClient(t *testing.T) {
+	b := newTestBroker(t, map[string]string{})
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	// Очередь отправки не разбирается - клиент ничего не читает
+	s := newSession(b, conn, "slow", packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket))
+	for i := 0; i < sessionQueueSize; i++ {
+		s.deliver("a", nil, 0, false)
+	}
+
+	// Лишнее QoS 0 сообщение отбрасывается, клиент остается подключенным
+	s.deliver("a", nil, 0, false)
+
+	select {
+	case <-s.done:
+		t.Fatal("session closed on QoS 0 overflow")
+	default:
+	}
+
+	// Подтверждение отбросить нельзя - клиент отключается
+	s.send(packets.NewControlPacket(packets.Pingresp))
+
+	select {
+	case <-s.done:
+	default:
+		t.Fatal("slow session not closed")
+	}
+
+	if st := b.GetStats(); st.Dropped != 1 || st.Slow != 1 {
+		t.Fatalf("dropped = %d, slow = %d, want 1, 1", st.Dropped, st.Slow)
+	}
+}
+
+func TestSession_SubscribeACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(path, []byte("user svc\ntopic read object_manager/#\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestBroker(t, map[string]string{"mqtt_broker_users": "svc:secret", "mqtt_broker_acl_file": path})
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.Username = "svc"
+	s := newSession(b, conn, "svc", connect)
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"object_manager/event/#", "#", "service/info"}
+	sub.Qoss = []byte{1, 1, 1}
+
+	if err := s.processSubscribe(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	ack := (<-s.out).(*packets.SubackPacket)
+	if want := []byte{1, 0x80, 0x80}; string(ack.ReturnCodes) != string(want) {
+		t.Fatalf("return codes %v, want %v", ack.ReturnCodes, want)
+	}
+
+	if _, ok := s.subs["#"]; ok {
+		t.Fatal("denied filter is subscribed")
+	}
+}
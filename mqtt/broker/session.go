@@ -0,0 +1,374 @@
+package broker
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/VladimirDronik/touchon-server/mqtt/acl"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/pkg/errors"
+)
+
+// Размер очереди исходящих пакетов клиента
+const sessionQueueSize = 1000
+
+func newSession(broker *Broker, conn net.Conn, clientID string, connect *packets.ConnectPacket) *session {
+	s := &session{
+		broker:    broker,
+		conn:      conn,
+		clientID:  clientID,
+		username:  connect.Username,
+		keepalive: time.Duration(connect.Keepalive) * time.Second,
+		subs:      make(map[string]byte),
+		qos2:      make(map[uint16]bool),
+		out:       make(chan packets.ControlPacket, sessionQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	if broker.acl != nil {
+		s.acl = broker.acl.Get(s.username)
+	}
+
+	if connect.WillFlag {
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = connect.WillTopic
+		will.Payload = connect.WillMessage
+		will.Qos = connect.WillQos
+		will.Retain = connect.WillRetain
+
+		if s.acl.CanPublish(will.TopicName, clientID, s.username) {
+			s.will = will
+		}
+	}
+
+	return s
+}
+
+// session Подключение клиента к брокеру
+type session struct {
+	broker    *Broker
+	conn      net.Conn
+	clientID  string
+	username  string
+	keepalive time.Duration
+	will      *packets.PublishPacket
+	acl       *acl.ACL
+
+	mu     sync.Mutex
+	subs   map[string]byte // Фильтр подписки -> QoS
+	qos2   map[uint16]bool // Входящие QoS 2 сообщения, ожидающие PUBREL
+	lastID uint16
+
+	gracefulDisconnect bool
+
+	out       chan packets.ControlPacket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (o *session) close() {
+	o.closeOnce.Do(func() {
+		close(o.done)
+		_ = o.conn.Close()
+	})
+}
+
+// run Обрабатывает пакеты клиента до отключения
+func (o *session) run() {
+	go o.writeLoop()
+	defer o.close()
+
+	for {
+		// Клиент должен присылать пакеты не реже, чем раз в полтора keepalive
+		if o.keepalive > 0 {
+			_ = o.conn.SetReadDeadline(time.Now().Add(o.keepalive * 3 / 2))
+		} else {
+			_ = o.conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := packets.ReadPacket(o.conn)
+		if err != nil {
+			return
+		}
+
+		if err := o.process(p); err != nil {
+			o.broker.logger.Debugf("MQTT broker: client %q: %v", o.clientID, err)
+			return
+		}
+
+		if o.gracefulDisconnect {
+			return
+		}
+	}
+}
+
+func (o *session) writeLoop() {
+	for {
+		select {
+		case p := <-o.out:
+			_ = o.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := p.Write(o.conn); err != nil {
+				o.close()
+				return
+			}
+
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// send Ставит пакет в очередь отправки
+func (o *session) send(p packets.ControlPacket) bool {
+	select {
+	case o.out <- p:
+		return true
+	case <-o.done:
+		return false
+	default:
+	}
+
+	// Клиент не успевает забирать сообщения: QoS 0 сообщения можно потерять,
+	// остальные пакеты (подтверждения, QoS 1-2) отбрасывать нельзя - отключаем клиента
+	if p, ok := p.(*packets.PublishPacket); ok && p.Qos == 0 {
+		o.broker.dropped.Add(1)
+		return false
+	}
+
+	o.broker.logger.Warnf("MQTT broker: client %q is too slow, disconnecting", o.clientID)
+	o.broker.slow.Add(1)
+	o.close()
+
+	return false
+}
+
+func (o *session) process(p packets.ControlPacket) error {
+	switch p := p.(type) {
+	case *packets.PublishPacket:
+		return o.processPublish(p)
+
+	case *packets.PubrelPacket:
+		o.mu.Lock()
+		delete(o.qos2, p.MessageID)
+		o.mu.Unlock()
+
+		ack := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		ack.MessageID = p.MessageID
+		o.send(ack)
+
+	case *packets.PubrecPacket:
+		// Ответ клиента на исходящее QoS 2 сообщение
+		rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		rel.MessageID = p.MessageID
+		o.send(rel)
+
+	case *packets.PubackPacket, *packets.PubcompPacket:
+		// Исходящие сообщения не хранятся, подтверждения не требуют обработки
+
+	case *packets.SubscribePacket:
+		return o.processSubscribe(p)
+
+	case *packets.UnsubscribePacket:
+		o.mu.Lock()
+		for _, filter := range p.Topics {
+			delete(o.subs, filter)
+		}
+		o.mu.Unlock()
+
+		ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		ack.MessageID = p.MessageID
+		o.send(ack)
+
+	case *packets.PingreqPacket:
+		o.send(packets.NewControlPacket(packets.Pingresp))
+
+	case *packets.DisconnectPacket:
+		o.gracefulDisconnect = true
+
+	default:
+		return errors.Wrap(errors.Errorf("unexpected packet %s", p), "session.process")
+	}
+
+	return nil
+}
+
+func (o *session) processPublish(p *packets.PublishPacket) error {
+	if p.TopicName == "" || strings.ContainsAny(p.TopicName, "+#") {
+		return errors.Wrap(errors.Errorf("bad topic name %q", p.TopicName), "session.processPublish")
+	}
+
+	// Сообщения в запрещенные топики отбрасываются (MQTT 3.1.1 не позволяет сообщить об этом клиенту)
+	allowed := o.acl.CanPublish(p.TopicName, o.clientID, o.username)
+	if !allowed {
+		o.broker.logger.Debugf("MQTT broker: client %q: publish to %q denied by ACL", o.clientID, p.TopicName)
+		o.broker.dropped.Add(1)
+	}
+
+	switch p.Qos {
+	case 0:
+		if allowed {
+			o.broker.publish(p)
+		}
+
+	case 1:
+		if allowed {
+			o.broker.publish(p)
+		}
+
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.MessageID = p.MessageID
+		o.send(ack)
+
+	case 2:
+		// Повторно присланное сообщение (до PUBREL) не публикуем
+		o.mu.Lock()
+		dup := o.qos2[p.MessageID]
+		o.qos2[p.MessageID] = true
+		o.mu.Unlock()
+
+		if !dup && allowed {
+			o.broker.publish(p)
+		}
+
+		ack := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		ack.MessageID = p.MessageID
+		o.send(ack)
+
+	default:
+		return errors.Wrap(errors.Errorf("bad QoS %d", p.Qos), "session.processPublish")
+	}
+
+	return nil
+}
+
+func (o *session) processSubscribe(p *packets.SubscribePacket) error {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+	ack.ReturnCodes = make([]byte, len(p.Topics))
+
+	accepted := make(map[string]byte, len(p.Topics))
+
+	o.mu.Lock()
+	for i, filter := range p.Topics {
+		if !validFilter(filter) || !o.acl.CanSubscribe(filter, o.clientID, o.username) {
+			ack.ReturnCodes[i] = 0x80
+			continue
+		}
+
+		qos := min(p.Qoss[i], 2)
+		o.subs[filter] = qos
+		ack.ReturnCodes[i] = qos
+		accepted[filter] = qos
+	}
+	o.mu.Unlock()
+
+	o.send(ack)
+
+	// После подписки отправляем подходящие retained-сообщения (кроме общих подписок)
+	for filter, qos := range accepted {
+		if strings.HasPrefix(filter, "$share/") {
+			continue
+		}
+
+		for _, r := range o.broker.getRetained(filter) {
+			if !o.acl.CanRead(r.TopicName, o.clientID, o.username) {
+				continue
+			}
+
+			o.deliver(r.TopicName, r.Payload, min(qos, r.Qos), true)
+		}
+	}
+
+	return nil
+}
+
+// match Проверяет подписки клиента на топик. Возвращает максимальный QoS
+// обычных подписок и QoS подходящих общих подписок по ключу группы.
+func (o *session) match(topic string) (byte, bool, map[string]byte) {
+	if !o.acl.CanRead(topic, o.clientID, o.username) {
+		return 0, false, nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var qos byte
+	var ok bool
+	var groups map[string]byte
+
+	for filter, q := range o.subs {
+		if !topicMatch(filter, topic) {
+			continue
+		}
+
+		if strings.HasPrefix(filter, "$share/") {
+			if groups == nil {
+				groups = make(map[string]byte)
+			}
+			groups[filter] = max(groups[filter], q)
+			continue
+		}
+
+		ok = true
+		qos = max(qos, q)
+	}
+
+	return qos, ok, groups
+}
+
+// deliver Отправляет сообщение клиенту
+func (o *session) deliver(topic string, payload []byte, qos byte, retained bool) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Qos = qos
+	p.Retain = retained
+
+	if qos > 0 {
+		o.mu.Lock()
+		o.lastID++
+		if o.lastID == 0 {
+			o.lastID++
+		}
+		p.MessageID = o.lastID
+		o.mu.Unlock()
+	}
+
+	if o.send(p) {
+		o.broker.delivered.Add(1)
+	}
+}
+
+func topicMatch(filter, topic string) bool {
+	return topics.TopicMatch(filter, topic)
+}
+
+// validFilter Проверяет корректность фильтра подписки
+func validFilter(filter string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		items := strings.SplitN(filter, "/", 3)
+		if len(items) < 3 || items[1] == "" || strings.ContainsAny(items[1], "+#") {
+			return false
+		}
+		filter = items[2]
+	}
+
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return false
+		case level != "#" && level != "+" && strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+
+	return true
+}
@@ -6,13 +6,15 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/VladimirDronik/touchon-server/info"
+	"github.com/VladimirDronik/touchon-server/metrics"
+	"github.com/VladimirDronik/touchon-server/mqtt/acl"
 	"github.com/VladimirDronik/touchon-server/mqtt/messages"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
@@ -25,28 +27,77 @@ var I Client
 type Client interface {
 	GetIgnoreSelfMsgs() bool
 	SetIgnoreSelfMsgs(v bool)
-	Subscribe(topic string, bufferSize int) (<-chan mqtt.Message, error)
-	Unsubscribe(topics ...string) error
+	Subscribe(topic string, bufferSize int) (*Subscription, error) // Подписка отменяется через Subscription.Unsubscribe
+	Unsubscribe(topics ...string) error                            // Отменяет все подписки клиента на топики
 	Send(msg messages.Message) error
 	SendRaw(topic string, qos messages.QoS, retained bool, payload interface{}) error
 	GetTopicFromConnectionString() string
 	Shutdown() error
+
+	State() State                               // Текущее состояние соединения
+	SubscribeState(bufferSize int) <-chan State // Подписка на изменения состояния соединения
+	GetStats() *Stats                           // Статистика соединения
+
+	SetSigner(signer Signer)           // Подпись отправляемых сообщений (nil - без подписи)
+	SetACL(rules *acl.ACL)             // Правила доступа к топикам (nil - без ограничений)
+	SetTTL(ttl messages.TTL)           // Время жизни отправляемых сообщений по типу (nil - без ограничения)
+	SetCodecs(codecs *messages.Codecs) // Форматы отправляемых сообщений (nil - JSON)
+}
+
+// Signer Подписывает сообщения перед отправкой (см. пакет mqtt/signature)
+type Signer interface {
+	Sign(msg messages.Message) error
+}
+
+var dialersMu sync.RWMutex
+var dialers = make(map[string]func() (net.Conn, error))
+
+// RegisterDialer Регистрирует функцию установки соединения для схемы строки подключения
+func RegisterDialer(scheme string, dial func() (net.Conn, error)) {
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	dialers[scheme] = dial
+}
+
+func getDialer(scheme string) func() (net.Conn, error) {
+	dialersMu.RLock()
+	defer dialersMu.RUnlock()
+	return dialers[scheme]
+}
+
+// Will Сообщение, которое брокер опубликует от имени клиента при обрыве соединения (LWT)
+type Will struct {
+	Topic    string
+	Payload  []byte
+	QoS      messages.QoS
+	Retained bool
 }
 
 func New(clientID, connString string, timeout time.Duration, tries int, logger *logrus.Logger) (Client, error) {
+	c, err := NewWithWill(clientID, connString, timeout, tries, nil, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "New")
+	}
+
+	return c, nil
+}
+
+// NewWithWill Создает клиента, для которого брокер опубликует will при обрыве соединения
+func NewWithWill(clientID, connString string, timeout time.Duration, tries int, will *Will, logger *logrus.Logger) (Client, error) {
 	o := &ClientImpl{
 		clientID:       clientID,
 		timeout:        timeout,
 		tries:          tries,
-		chans:          make(map[string][]chan mqtt.Message),
+		subs:           make(map[string][]*Subscription),
 		logger:         logger,
 		ignoreSelfMsgs: true,
+		state:          newStateTracker(StateConnecting),
 	}
 
 	var err error
 	o.connString, err = url.Parse(connString)
 	if err != nil {
-		return nil, errors.Wrap(err, "ClientImpl.New")
+		return nil, errors.Wrap(err, "NewWithWill")
 	}
 
 	password, _ := o.connString.User.Password()
@@ -57,8 +108,26 @@ func New(clientID, connString string, timeout time.Duration, tries int, logger *
 		SetClientID(clientID).
 		SetResumeSubs(true)
 
+	// Для схем с зарегистрированной функцией подключения (например, встроенный брокер)
+	// соединение устанавливается этой функцией
+	if dial := getDialer(o.connString.Scheme); dial != nil {
+		opts.SetCustomOpenConnectionFn(func(*url.URL, mqtt.ClientOptions) (net.Conn, error) {
+			return dial()
+		})
+	}
+
+	if will != nil {
+		opts.SetBinaryWill(will.Topic, will.Payload, byte(will.QoS), will.Retained)
+	}
+
 	opts.OnConnectionLost = func(client mqtt.Client, reason error) {
-		o.logger.Debugf("mqtt.ClientImpl: connection lost: %v", reason)
+		o.logger.Warnf("mqtt.ClientImpl: connection lost: %v", reason)
+		o.state.set(StateReconnecting)
+	}
+
+	opts.OnReconnecting = func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		o.logger.Debugf("mqtt.ClientImpl: reconnecting")
+		o.state.set(StateReconnecting)
 	}
 
 	opts.OnConnectAttempt = func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
@@ -68,15 +137,27 @@ func New(clientID, connString string, timeout time.Duration, tries int, logger *
 
 	opts.OnConnect = func(client mqtt.Client) {
 		o.logger.Debugf("mqtt.ClientImpl: connected = %t", client.IsConnected())
+
+		// Брокер не хранит подписки клиента с чистой сессией, восстанавливаем их сами
+		if o.state.get() == StateReconnecting {
+			o.resubscribe()
+			o.logger.Infof("mqtt.ClientImpl: connection restored")
+		}
+
+		o.state.set(StateConnected)
 	}
 
 	o.client = mqtt.NewClient(opts)
 
 	token := o.client.Connect()
 	if err := o.processToken(token); err != nil {
-		return nil, errors.Wrap(err, "New")
+		return nil, errors.Wrap(err, "NewWithWill")
 	}
 
+	o.state.set(StateConnected)
+
+	metrics.RegisterCollector("mqtt_client:"+clientID, o.collectMetrics)
+
 	return o, nil
 }
 
@@ -89,8 +170,64 @@ type ClientImpl struct {
 	logger         *logrus.Logger
 	ignoreSelfMsgs bool
 
-	mu    sync.Mutex
-	chans map[string][]chan mqtt.Message
+	mu     sync.Mutex
+	subMu  sync.Mutex // Упорядочивает подписку и отписку в брокере
+	subs   map[string][]*Subscription
+	state  *stateTracker
+	signer Signer
+	acl    *acl.ACL
+	ttl    messages.TTL
+	codecs *messages.Codecs
+
+	metrics clientMetrics
+}
+
+func (o *ClientImpl) SetACL(rules *acl.ACL) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.acl = rules
+}
+
+func (o *ClientImpl) getACL() *acl.ACL {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.acl
+}
+
+func (o *ClientImpl) SetSigner(signer Signer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.signer = signer
+}
+
+func (o *ClientImpl) getSigner() Signer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.signer
+}
+
+func (o *ClientImpl) SetTTL(ttl messages.TTL) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ttl = ttl
+}
+
+func (o *ClientImpl) SetCodecs(codecs *messages.Codecs) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.codecs = codecs
+}
+
+func (o *ClientImpl) State() State {
+	return o.state.get()
+}
+
+func (o *ClientImpl) SubscribeState(bufferSize int) <-chan State {
+	return o.state.subscribe(bufferSize)
+}
+
+func (o *ClientImpl) GetStats() *Stats {
+	return o.state.stats()
 }
 
 func (o *ClientImpl) GetIgnoreSelfMsgs() bool {
@@ -101,18 +238,57 @@ func (o *ClientImpl) SetIgnoreSelfMsgs(v bool) {
 	o.ignoreSelfMsgs = v
 }
 
-func (o *ClientImpl) pushChan(topic string, ch chan mqtt.Message) {
+func (o *ClientImpl) pushSub(sub *Subscription) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.subs[sub.topic] = append(o.subs[sub.topic], sub)
+}
+
+func (o *ClientImpl) getSubs(topic string) []*Subscription {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	o.chans[topic] = append(o.chans[topic], ch)
+	return o.subs[topic]
+}
+
+// removeSub Удаляет подписку. Возвращает true, если удалена последняя подписка на топик.
+func (o *ClientImpl) removeSub(sub *Subscription) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	subs := o.subs[sub.topic]
+	for i, v := range subs {
+		if v == sub {
+			o.subs[sub.topic] = append(subs[:i:i], subs[i+1:]...)
+			if len(o.subs[sub.topic]) == 0 {
+				delete(o.subs, sub.topic)
+				return true
+			}
+
+			return false
+		}
+	}
+
+	return false
 }
 
-func (o *ClientImpl) popChans(topic string) []chan mqtt.Message {
+func (o *ClientImpl) getTopics() []string {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	chans := o.chans[topic]
-	delete(o.chans, topic)
-	return chans
+
+	topics := make([]string, 0, len(o.subs))
+	for topic := range o.subs {
+		topics = append(topics, topic)
+	}
+
+	return topics
+}
+
+func (o *ClientImpl) popSubs(topic string) []*Subscription {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	subs := o.subs[topic]
+	delete(o.subs, topic)
+	return subs
 }
 
 // processToken Синхронно ожидает результата
@@ -138,39 +314,111 @@ func (o *ClientImpl) processToken(token mqtt.Token) error {
 	return nil
 }
 
-// Subscribe Подписывает на топики
-func (o *ClientImpl) Subscribe(topic string, bufferSize int) (<-chan mqtt.Message, error) {
-	c := make(chan mqtt.Message, bufferSize)
+// Subscribe Подписывает на топики.
+// На один топик можно подписаться несколько раз, каждый канал получит все сообщения.
+func (o *ClientImpl) Subscribe(topic string, bufferSize int) (*Subscription, error) {
+	if !o.getACL().CanSubscribe(topic, o.clientID, o.connString.User.Username()) {
+		return nil, errors.Wrapf(acl.ErrDenied, "Subscribe(%s)", topic)
+	}
+
+	o.subMu.Lock()
+	defer o.subMu.Unlock()
+
+	sub := newSubscription(topic, bufferSize, o.unsubscribe)
+
+	// Сохраняем канал, чтобы можно было его закрыть
+	o.pushSub(sub)
+
+	if err := o.subscribeTopic(topic); err != nil {
+		o.removeSub(sub)
+		sub.close()
+		return nil, errors.Wrap(err, "Subscribe")
+	}
+
+	return sub, nil
+}
+
+// unsubscribe Отменяет одну подписку. Подписка в брокере отменяется,
+// только если на топик не осталось других подписок.
+func (o *ClientImpl) unsubscribe(sub *Subscription) error {
+	o.subMu.Lock()
+	defer o.subMu.Unlock()
+
+	last := o.removeSub(sub)
+	sub.close()
+
+	if !last {
+		return nil
+	}
+
+	if err := o.processToken(o.client.Unsubscribe(sub.topic)); err != nil {
+		return errors.Wrap(err, "unsubscribe")
+	}
+
+	return nil
+}
+
+// subscribeTopic Подписывается на топик в брокере и проверяет, что брокер принял подписку
+func (o *ClientImpl) subscribeTopic(topic string) error {
+	token := o.client.Subscribe(topic, 0, o.messageHandler(topic))
+
+	if err := o.processToken(token); err != nil {
+		return errors.Wrap(err, "subscribeTopic")
+	}
+
+	if t, ok := token.(*mqtt.SubscribeToken); ok {
+		if code, ok := t.Result()[topic]; ok && code == mqttSubscribeFailure {
+			return errors.Wrap(errors.Errorf("broker rejected subscription to %q", topic), "subscribeTopic")
+		}
+	}
+
+	return nil
+}
+
+// Код ответа SUBACK, означающий отказ в подписке
+const mqttSubscribeFailure = 0x80
 
-	token := o.client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
+func (o *ClientImpl) messageHandler(topic string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
 		// Свои сообщения игнорируем
-		if !o.ignoreSelfMsgs || !strings.HasPrefix(msg.Topic(), info.Name) {
-			msgInfo := getMetaInfoFromRawMsg(msg.Payload())
-
-			switch o.logger.Level {
-			case logrus.DebugLevel:
-				o.logger.Debugf("mqtt.ClientImpl.Receive: [%s]%s", msg.Topic(), msgInfo)
-			case logrus.TraceLevel:
-				o.logger.Tracef("mqtt.ClientImpl.Receive: [%s]%s %s", msg.Topic(), msgInfo, string(msg.Payload()))
-			}
+		if o.ignoreSelfMsgs && strings.HasPrefix(msg.Topic(), info.Name) {
+			return
+		}
 
-			// for non blocking
-			go func() { c <- msg }()
+		switch o.logger.Level {
+		case logrus.DebugLevel:
+			o.logger.Debugf("mqtt.ClientImpl.Receive: [%s]%s", msg.Topic(), getMetaInfoFromRawMsg(msg.Payload()))
+		case logrus.TraceLevel:
+			o.logger.Tracef("mqtt.ClientImpl.Receive: [%s]%s %s", msg.Topic(), getMetaInfoFromRawMsg(msg.Payload()), string(msg.Payload()))
 		}
-	})
 
-	if err := o.processToken(token); err != nil {
-		return nil, errors.Wrap(err, "Subscribe")
+		o.metrics.received.Inc()
+
+		for _, sub := range o.getSubs(topic) {
+			sub.push(msg)
+		}
 	}
+}
 
-	// Сохраняем канал, чтобы можно было его закрыть
-	o.pushChan(topic, c)
+// resubscribe Восстанавливает подписки после переподключения
+func (o *ClientImpl) resubscribe() {
+	for _, topic := range o.getTopics() {
+		if err := o.subscribeTopic(topic); err != nil {
+			o.state.addResubscribeError()
+			o.logger.Error(errors.Wrap(err, "mqtt.ClientImpl.resubscribe"))
+			continue
+		}
 
-	return c, nil
+		o.logger.Debugf("mqtt.ClientImpl: resubscribed to %s", topic)
+	}
 }
 
-// Unsubscribe Отменяет подписку на топики
+// Unsubscribe Отменяет все подписки клиента на топики.
+// Чтобы отменить одну подписку, используйте Subscription.Unsubscribe.
 func (o *ClientImpl) Unsubscribe(topics ...string) error {
+	o.subMu.Lock()
+	defer o.subMu.Unlock()
+
 	token := o.client.Unsubscribe(topics...)
 
 	if err := o.processToken(token); err != nil {
@@ -179,8 +427,8 @@ func (o *ClientImpl) Unsubscribe(topics ...string) error {
 
 	// Закрываем каналы, чтобы обработчики сообщений могли завершиться
 	for _, topic := range topics {
-		for _, ch := range o.popChans(topic) {
-			close(ch)
+		for _, sub := range o.popSubs(topic) {
+			sub.close()
 		}
 	}
 
@@ -190,36 +438,40 @@ func (o *ClientImpl) Unsubscribe(topics ...string) error {
 // Send Отправляет сообщения в топик
 // sync - to track delivery of the message to the broker
 func (o *ClientImpl) Send(msg messages.Message) error {
+	o.mu.Lock()
+	signer, ttl, codecs := o.signer, o.ttl, o.codecs
+	o.mu.Unlock()
+
 	msg.SetSentAt(time.Now())
+	ttl.Apply(msg)
+
+	if signer != nil {
+		if err := signer.Sign(msg); err != nil {
+			return errors.Wrap(err, "Send")
+		}
+	}
+
+	data, err := codecs.Encode(msg)
+	if err != nil {
+		return errors.Wrap(err, "Send")
+	}
 
-	if err := o.SendRaw(msg.GetTopic(), msg.GetQoS(), msg.GetRetained(), msg); err != nil {
+	if err := o.SendRaw(msg.GetTopic(), msg.GetQoS(), msg.GetRetained(), data); err != nil {
 		return errors.Wrap(err, "Send")
 	}
 
 	return nil
 }
 
-var patternTargetType = regexp.MustCompile(`"target_type"\s*:\s*"([^"]+)"`)
-var patternTargetID = regexp.MustCompile(`"target_id"\s*:\s*(\d+)`)
-var patternName = regexp.MustCompile(`"name"\s*:\s*"([^"]+)"`)
-
+// getMetaInfoFromRawMsg Возвращает цель и название сообщения для журнала.
+// Полезная нагрузка при этом не разбирается.
 func getMetaInfoFromRawMsg(data []byte) string {
-	var targetType string
-	if r := patternTargetType.FindStringSubmatch(string(data)); len(r) == 2 {
-		targetType = r[1]
-	}
-
-	var targetID string
-	if r := patternTargetID.FindStringSubmatch(string(data)); len(r) == 2 {
-		targetID = r[1]
-	}
-
-	var name string
-	if r := patternName.FindStringSubmatch(string(data)); len(r) == 2 {
-		name = r[1]
+	m, err := messages.Decode(data)
+	if err != nil {
+		return " [//]"
 	}
 
-	return fmt.Sprintf(" [%s/%s/%s]", targetType, targetID, name)
+	return fmt.Sprintf(" [%s/%d/%s]", m.GetTargetType(), m.GetTargetID(), m.GetName())
 }
 
 // SendRaw Отправляет сообщения в топик
@@ -229,33 +481,48 @@ func (o *ClientImpl) SendRaw(topic string, qos messages.QoS, retained bool, payl
 		return errors.Wrap(errors.New("topic is empty"), "SendRaw")
 	}
 
-	switch v := payload.(type) {
-	case []byte:
-	default:
-		var err error
-		payload, err = json.Marshal(v)
-		if err != nil {
-			return errors.Wrap(err, "SendRaw")
-		}
+	if !o.getACL().CanPublish(topic, o.clientID, o.connString.User.Username()) {
+		o.metrics.sendErrors.Inc()
+		return errors.Wrapf(acl.ErrDenied, "SendRaw(%s)", topic)
 	}
 
-	msgInfo := getMetaInfoFromRawMsg(payload.([]byte))
+	data, err := encodePayload(payload)
+	if err != nil {
+		return errors.Wrap(err, "SendRaw")
+	}
 
 	switch o.logger.Level {
 	case logrus.DebugLevel:
-		o.logger.Debugf("mqtt.ClientImpl.Send: [%s]%s", topic, msgInfo)
+		o.logger.Debugf("mqtt.ClientImpl.Send: [%s]%s", topic, getMetaInfoFromRawMsg(data))
 	case logrus.TraceLevel:
-		o.logger.Tracef("mqtt.ClientImpl.Send: [%s]%s %s", topic, msgInfo, string(payload.([]byte)))
+		o.logger.Tracef("mqtt.ClientImpl.Send: [%s]%s %s", topic, getMetaInfoFromRawMsg(data), string(data))
 	}
 
-	token := o.client.Publish(topic, byte(qos), retained, payload)
+	token := o.client.Publish(topic, byte(qos), retained, data)
 	if err := o.processToken(token); err != nil {
+		o.metrics.sendErrors.Inc()
 		return errors.Wrap(err, "SendRaw")
 	}
 
+	o.metrics.sent.Inc()
+
 	return nil
 }
 
+// encodePayload Возвращает данные для отправки, сериализуя в JSON все, кроме []byte
+func encodePayload(payload interface{}) ([]byte, error) {
+	if v, ok := payload.([]byte); ok {
+		return v, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "encodePayload")
+	}
+
+	return data, nil
+}
+
 func (o *ClientImpl) GetTopicFromConnectionString() string {
 	topic := "#"
 	if len(o.connString.Path) > 1 {
@@ -266,12 +533,7 @@ func (o *ClientImpl) GetTopicFromConnectionString() string {
 
 func (o *ClientImpl) Shutdown() error {
 	// Получаем список топиков
-	o.mu.Lock()
-	topics := make([]string, 0, len(o.chans))
-	for topic := range o.chans {
-		topics = append(topics, topic)
-	}
-	o.mu.Unlock()
+	topics := o.getTopics()
 
 	errs := make([]error, 0, 5)
 
@@ -280,8 +542,12 @@ func (o *ClientImpl) Shutdown() error {
 		errs = append(errs, err)
 	}
 
+	metrics.UnregisterCollector("mqtt_client:" + o.clientID)
+
 	// Отключаемся от шины
 	o.client.Disconnect(uint(o.timeout.Milliseconds()))
+	o.state.set(StateDisconnected)
+	o.state.close()
 
 	if len(errs) > 0 {
 		return errors.Wrap(errs[0], "mqttClient.Shutdown")
@@ -0,0 +1,241 @@
+package client_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBroker Минимальный брокер для проверки переподключения: отвечает на CONNECT, SUBSCRIBE,
+// UNSUBSCRIBE и PINGREQ, по команде теста обрывает соединение и отклоняет подписки.
+type fakeBroker struct {
+	subscribed chan string // Фильтры полученных SUBSCRIBE
+
+	mu     sync.Mutex
+	conn   net.Conn        // Текущее соединение
+	reject map[string]bool // Фильтры, подписка на которые отклоняется
+}
+
+func newFakeBroker(t *testing.T, scheme string) *fakeBroker {
+	o := &fakeBroker{
+		subscribed: make(chan string, 10),
+		reject:     make(map[string]bool),
+	}
+
+	client.RegisterDialer(scheme, o.dial)
+	t.Cleanup(o.drop)
+
+	return o
+}
+
+func (o *fakeBroker) dial() (net.Conn, error) {
+	c, s := net.Pipe()
+
+	o.mu.Lock()
+	o.conn = s
+	o.mu.Unlock()
+
+	go o.serve(s)
+
+	return c, nil
+}
+
+func (o *fakeBroker) serve(conn net.Conn) {
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			o.write(conn, packets.NewControlPacket(packets.Connack))
+
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+
+			o.mu.Lock()
+			for _, filter := range p.Topics {
+				code := byte(0)
+				if o.reject[filter] {
+					code = 0x80
+				}
+				ack.ReturnCodes = append(ack.ReturnCodes, code)
+			}
+			o.mu.Unlock()
+
+			o.write(conn, ack)
+
+			for _, filter := range p.Topics {
+				o.subscribed <- filter
+			}
+
+		case *packets.UnsubscribePacket:
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			o.write(conn, ack)
+
+		case *packets.PingreqPacket:
+			o.write(conn, packets.NewControlPacket(packets.Pingresp))
+
+		case *packets.DisconnectPacket:
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+func (o *fakeBroker) write(conn net.Conn, p packets.ControlPacket) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_ = p.Write(conn)
+}
+
+// publish Отправляет сообщение клиенту по текущему соединению
+func (o *fakeBroker) publish(topic string, payload []byte) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+
+	o.mu.Lock()
+	conn := o.conn
+	o.mu.Unlock()
+
+	o.write(conn, p)
+}
+
+// drop Обрывает текущее соединение
+func (o *fakeBroker) drop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.conn != nil {
+		_ = o.conn.Close()
+	}
+}
+
+func (o *fakeBroker) setReject(filter string, v bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reject[filter] = v
+}
+
+func (o *fakeBroker) expectSubscribe(t *testing.T, filter string) {
+	t.Helper()
+
+	select {
+	case f := <-o.subscribed:
+		if f != filter {
+			t.Fatalf("subscribed to %q, want %q", f, filter)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no subscription to %q", filter)
+	}
+}
+
+func newFakeClient(t *testing.T, scheme string) client.Client {
+	t.Helper()
+
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := client.New("c", scheme+":///", time.Second, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetIgnoreSelfMsgs(false)
+	t.Cleanup(func() { _ = c.Shutdown() })
+
+	return c
+}
+
+func expectState(t *testing.T, states <-chan client.State, want client.State) {
+	t.Helper()
+
+	select {
+	case s := <-states:
+		if s != want {
+			t.Fatalf("state = %s, want %s", s, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no state %s", want)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	b := newFakeBroker(t, "fake-reconnect")
+	c := newFakeClient(t, "fake-reconnect")
+	states := c.SubscribeState(10)
+
+	sub, err := c.Subscribe("object_manager/#", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.expectSubscribe(t, "object_manager/#")
+
+	b.drop()
+
+	expectState(t, states, client.StateReconnecting)
+	expectState(t, states, client.StateConnected)
+
+	// Подписка восстановлена в брокере, сообщения приходят в прежний канал
+	b.expectSubscribe(t, "object_manager/#")
+	b.publish("object_manager/event/relay", []byte("{}"))
+
+	select {
+	case msg := <-sub.C():
+		if msg.Topic() != "object_manager/event/relay" {
+			t.Fatalf("unexpected topic %q", msg.Topic())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not delivered after reconnect")
+	}
+
+	if s := c.GetStats(); s.Reconnects != 1 || s.ConnectionLosses != 1 || s.ResubscribeErrors != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestClient_SubscribeRejected(t *testing.T) {
+	b := newFakeBroker(t, "fake-reject")
+	c := newFakeClient(t, "fake-reject")
+	states := c.SubscribeState(10)
+
+	b.setReject("denied/#", true)
+
+	if _, err := c.Subscribe("denied/#", 10); err == nil {
+		t.Fatal("rejected subscription must fail")
+	}
+
+	b.expectSubscribe(t, "denied/#")
+
+	if _, err := c.Subscribe("allowed/#", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	b.expectSubscribe(t, "allowed/#")
+
+	// После переподключения брокер отклоняет восстановление подписки
+	b.setReject("allowed/#", true)
+	b.drop()
+
+	expectState(t, states, client.StateReconnecting)
+	expectState(t, states, client.StateConnected)
+
+	// Отклоненная при подписке подписка не восстанавливается
+	b.expectSubscribe(t, "allowed/#")
+
+	if s := c.GetStats(); s.ResubscribeErrors != 1 {
+		t.Fatalf("resubscribe errors = %d, want 1", s.ResubscribeErrors)
+	}
+}
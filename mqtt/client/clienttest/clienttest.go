@@ -0,0 +1,147 @@
+// Пакет с хэлперами для тестов, использующих шину в памяти процесса (client.Bus).
+
+package clienttest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+)
+
+// Matcher Условие отбора сообщения
+type Matcher func(m messages.Message) bool
+
+// Name Отбирает сообщения с указанным названием события или команды
+func Name(name string) Matcher {
+	return func(m messages.Message) bool { return m.GetName() == name }
+}
+
+// Type Отбирает сообщения указанного типа (event, command)
+func Type(msgType messages.MessageType) Matcher {
+	return func(m messages.Message) bool { return m.GetType() == msgType }
+}
+
+// Target Отбирает сообщения для указанной цели
+func Target(targetType messages.TargetType, targetID int) Matcher {
+	return func(m messages.Message) bool {
+		return m.GetTargetType() == targetType && m.GetTargetID() == targetID
+	}
+}
+
+// TargetID Отбирает сообщения для цели с указанным ID
+func TargetID(targetID int) Matcher {
+	return func(m messages.Message) bool { return m.GetTargetID() == targetID }
+}
+
+// Topic Отбирает сообщения, опубликованные в указанный топик
+func Topic(topic string) Matcher {
+	return func(m messages.Message) bool { return m.GetTopic() == topic }
+}
+
+// Prop Отбирает сообщения, у которых значение свойства совпадает с указанным
+func Prop(name string, value interface{}) Matcher {
+	return func(m messages.Message) bool {
+		v, ok := m.GetPayload()[name]
+		return ok && fmt.Sprint(v) == fmt.Sprint(value)
+	}
+}
+
+// All Объединяет условия
+func All(matchers ...Matcher) Matcher {
+	return func(m messages.Message) bool {
+		for _, match := range matchers {
+			if !match(m) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// Wait Ожидает публикации сообщения, удовлетворяющего всем условиям.
+// Публикации, которые не являются сообщениями шины, пропускаются.
+func Wait(bus *client.Bus, timeout time.Duration, matchers ...Matcher) (messages.Message, error) {
+	match := All(matchers...)
+
+	var found messages.Message
+
+	_, err := bus.WaitFor(timeout, func(p *client.Publication) bool {
+		m, ok := decode(p)
+		if ok && match(m) {
+			found = m
+			return true
+		}
+
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// Expect Проверяет, что в течение timeout было опубликовано сообщение, удовлетворяющее условиям.
+//
+//	clienttest.Expect(t, bus, time.Second, clienttest.Name("object.relay.on_state_on"), clienttest.TargetID(5))
+func Expect(t testing.TB, bus *client.Bus, timeout time.Duration, matchers ...Matcher) messages.Message {
+	t.Helper()
+
+	m, err := Wait(bus, timeout, matchers...)
+	if err != nil {
+		t.Fatalf("expected message was not published within %s; published: %s", timeout, dumpHistory(bus))
+	}
+
+	return m
+}
+
+// ExpectEvent Проверяет, что в течение timeout было опубликовано событие name для цели targetID
+func ExpectEvent(t testing.TB, bus *client.Bus, name string, targetID int, timeout time.Duration) messages.Message {
+	t.Helper()
+	return Expect(t, bus, timeout, Type(messages.MessageTypeEvent), Name(name), TargetID(targetID))
+}
+
+// ExpectCommand Проверяет, что в течение timeout была отправлена команда name для цели targetID
+func ExpectCommand(t testing.TB, bus *client.Bus, name string, targetID int, timeout time.Duration) messages.Message {
+	t.Helper()
+	return Expect(t, bus, timeout, Type(messages.MessageTypeCommand), Name(name), TargetID(targetID))
+}
+
+// ExpectNone Проверяет, что в течение timeout не было опубликовано сообщение, удовлетворяющее условиям
+func ExpectNone(t testing.TB, bus *client.Bus, timeout time.Duration, matchers ...Matcher) {
+	t.Helper()
+
+	if m, err := Wait(bus, timeout, matchers...); err == nil {
+		t.Fatalf("unexpected message was published: %s", m)
+	}
+}
+
+func decode(p *client.Publication) (messages.Message, bool) {
+	m, err := messages.Decode(p.Payload)
+	if err != nil {
+		return nil, false
+	}
+
+	m.SetTopic(p.Topic)
+	m.SetQoS(p.QoS)
+	m.SetRetained(p.Retained)
+
+	return m, true
+}
+
+func dumpHistory(bus *client.Bus) string {
+	s := ""
+	for _, p := range bus.GetHistory() {
+		s += fmt.Sprintf("\n  [%s] %s", p.Topic, string(p.Payload))
+	}
+
+	if s == "" {
+		return "none"
+	}
+
+	return s
+}
@@ -0,0 +1,573 @@
+package client
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/info"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/VladimirDronik/touchon-server/mqtt/acl"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// DefaultHistorySize Количество последних публикаций, хранимых шиной по умолчанию
+const DefaultHistorySize = 10000
+
+// NewBus Создает шину в памяти процесса. Шина заменяет брокер в тестах:
+// к ней можно подключить несколько клиентов (и сервисов) одного процесса.
+func NewBus() *Bus {
+	return &Bus{
+		clients:     make(map[*MemoryClient]bool),
+		retained:    make(map[string]*memoryMessage),
+		changed:     make(chan struct{}),
+		historySize: DefaultHistorySize,
+		shareNext:   make(map[string]int),
+	}
+}
+
+type Bus struct {
+	publishMu     sync.Mutex // Публикации доставляются по одной, все подписчики получают их в одном порядке
+	mu            sync.RWMutex
+	clients       map[*MemoryClient]bool
+	retained      map[string]*memoryMessage
+	history       []*Publication
+	historySize   int            // Максимальное количество хранимых публикаций
+	historyOffset int            // Количество публикаций, удаленных из истории
+	shareNext     map[string]int // Очередность доставки для общих подписок
+	changed       chan struct{}  // Закрывается и пересоздается при каждой публикации
+	lastID        uint16
+	stats         BusStats
+}
+
+// Publication Опубликованное в шину сообщение
+type Publication struct {
+	ClientID    string
+	Topic       string
+	QoS         messages.QoS
+	Retained    bool
+	Payload     []byte
+	PublishedAt time.Time
+}
+
+// BusStats Статистика шины
+type BusStats struct {
+	Published    int                  // Количество опубликованных сообщений
+	Delivered    int                  // Количество доставленных подписчикам сообщений
+	PublishedQoS map[messages.QoS]int // Количество опубликованных сообщений по QoS
+	Retained     int                  // Количество хранимых сообщений
+}
+
+// NewClient Создает клиента шины. name используется для отбрасывания своих сообщений
+// (аналог info.Name для клиента, подключенного к брокеру), topic - топик сервиса.
+func (o *Bus) NewClient(clientID, name, topic string) *MemoryClient {
+	if name == "" {
+		name = info.Name
+	}
+
+	if topic == "" {
+		topic = "#"
+	}
+
+	c := &MemoryClient{
+		bus:            o,
+		clientID:       clientID,
+		name:           name,
+		topic:          topic,
+		ignoreSelfMsgs: true,
+		subs:           make(map[string][]*Subscription),
+		state:          newStateTracker(StateConnecting),
+	}
+
+	c.state.set(StateConnected)
+
+	o.mu.Lock()
+	o.clients[c] = true
+	o.mu.Unlock()
+
+	return c
+}
+
+// SetHistorySize Задает количество хранимых публикаций, старые публикации удаляются из истории
+func (o *Bus) SetHistorySize(size int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.historySize = max(size, 0)
+	o.trimHistory()
+}
+
+func (o *Bus) trimHistory() {
+	if n := len(o.history) - o.historySize; n > 0 {
+		o.history = o.history[n:]
+		o.historyOffset += n
+	}
+}
+
+// GetHistory Возвращает последние сообщения (не больше размера истории),
+// опубликованные с момента создания шины или вызова ClearHistory
+func (o *Bus) GetHistory() []*Publication {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	r := make([]*Publication, len(o.history))
+	copy(r, o.history)
+
+	return r
+}
+
+func (o *Bus) ClearHistory() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.historyOffset += len(o.history)
+	o.history = nil
+}
+
+func (o *Bus) GetStats() *BusStats {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	s := o.stats
+	s.Retained = len(o.retained)
+	s.PublishedQoS = make(map[messages.QoS]int, len(o.stats.PublishedQoS))
+	for k, v := range o.stats.PublishedQoS {
+		s.PublishedQoS[k] = v
+	}
+
+	return &s
+}
+
+// WaitFor Ожидает публикации сообщения, удовлетворяющего условию.
+// Сначала проверяются уже опубликованные сообщения из истории.
+func (o *Bus) WaitFor(timeout time.Duration, match func(p *Publication) bool) (*Publication, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	checked := 0 // Номер первой непроверенной публикации с учетом удаленных из истории
+
+	for {
+		o.mu.RLock()
+		history := o.history
+		offset := o.historyOffset
+		changed := o.changed
+		o.mu.RUnlock()
+
+		// Публикации могли быть удалены из истории до проверки
+		for _, p := range history[max(checked-offset, 0):] {
+			if match(p) {
+				return p, nil
+			}
+		}
+
+		checked = offset + len(history)
+
+		select {
+		case <-changed:
+		case <-t.C:
+			return nil, errors.Wrap(errors.Errorf("no matching message within %s", timeout), "Bus.WaitFor")
+		}
+	}
+}
+
+func (o *Bus) publish(from *MemoryClient, topic string, qos messages.QoS, retained bool, payload []byte) {
+	o.publishMu.Lock()
+	defer o.publishMu.Unlock()
+
+	o.mu.Lock()
+
+	p := &Publication{
+		ClientID:    from.clientID,
+		Topic:       topic,
+		QoS:         qos,
+		Retained:    retained,
+		Payload:     payload,
+		PublishedAt: time.Now(),
+	}
+
+	o.history = append(o.history, p)
+	o.trimHistory()
+	o.stats.Published++
+	if o.stats.PublishedQoS == nil {
+		o.stats.PublishedQoS = make(map[messages.QoS]int, 3)
+	}
+	o.stats.PublishedQoS[qos]++
+
+	var id uint16
+	if qos > messages.QoSNotGuaranteed {
+		o.lastID++
+		id = o.lastID
+	}
+
+	msg := &memoryMessage{topic: topic, qos: byte(qos), messageID: id, payload: payload}
+
+	if retained {
+		// Пустое сообщение удаляет хранимое
+		if len(payload) == 0 {
+			delete(o.retained, topic)
+		} else {
+			o.retained[topic] = &memoryMessage{topic: topic, qos: byte(qos), retained: true, payload: payload}
+		}
+	}
+
+	clients := make([]*MemoryClient, 0, len(o.clients))
+	for c := range o.clients {
+		clients = append(clients, c)
+	}
+
+	close(o.changed)
+	o.changed = make(chan struct{})
+
+	o.mu.Unlock()
+
+	// Клиенты упорядочиваются, чтобы очередность доставки в общих подписках не зависела от обхода карты
+	sort.Slice(clients, func(i, j int) bool { return clients[i].clientID < clients[j].clientID })
+
+	recipients := make(map[*MemoryClient][]*Subscription, len(clients))
+	shared := make(map[string][]sharedRecipient)
+
+	for _, c := range clients {
+		subs, groups := c.match(topic)
+		if len(subs) > 0 {
+			recipients[c] = subs
+		}
+
+		for filter, items := range groups {
+			for _, sub := range items {
+				shared[filter] = append(shared[filter], sharedRecipient{client: c, sub: sub})
+			}
+		}
+	}
+
+	// Сообщение общей подписки получает один участник группы
+	if len(shared) > 0 {
+		o.mu.Lock()
+		for filter, items := range shared {
+			r := items[o.shareNext[filter]%len(items)]
+			o.shareNext[filter]++
+			recipients[r.client] = append(recipients[r.client], r.sub)
+		}
+		o.mu.Unlock()
+	}
+
+	for _, subs := range recipients {
+		for _, sub := range subs {
+			// Подписка выполняется с QoS 0, поэтому сообщение доставляется с QoS 0
+			sub.push(&memoryMessage{topic: msg.topic, messageID: msg.messageID, payload: msg.payload})
+		}
+	}
+
+	o.mu.Lock()
+	o.stats.Delivered += len(recipients)
+	o.mu.Unlock()
+}
+
+// sharedRecipient Участник общей подписки
+type sharedRecipient struct {
+	client *MemoryClient
+	sub    *Subscription
+}
+
+func (o *Bus) getRetained(filter string) []*memoryMessage {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var r []*memoryMessage
+	for topic, msg := range o.retained {
+		if topics.TopicMatch(filter, topic) {
+			r = append(r, msg)
+		}
+	}
+
+	return r
+}
+
+func (o *Bus) removeClient(c *MemoryClient) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.clients, c)
+}
+
+// MemoryClient Клиент шины в памяти процесса, реализует интерфейс Client
+type MemoryClient struct {
+	bus            *Bus
+	clientID       string
+	name           string
+	topic          string
+	ignoreSelfMsgs bool
+
+	mu     sync.Mutex
+	subs   map[string][]*Subscription
+	state  *stateTracker
+	signer Signer
+	acl    *acl.ACL
+	ttl    messages.TTL
+	codecs *messages.Codecs
+}
+
+func (o *MemoryClient) SetACL(rules *acl.ACL) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.acl = rules
+}
+
+func (o *MemoryClient) getACL() *acl.ACL {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.acl
+}
+
+func (o *MemoryClient) SetSigner(signer Signer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.signer = signer
+}
+
+func (o *MemoryClient) SetTTL(ttl messages.TTL) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ttl = ttl
+}
+
+func (o *MemoryClient) SetCodecs(codecs *messages.Codecs) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.codecs = codecs
+}
+
+func (o *MemoryClient) GetIgnoreSelfMsgs() bool {
+	return o.ignoreSelfMsgs
+}
+
+func (o *MemoryClient) SetIgnoreSelfMsgs(v bool) {
+	o.ignoreSelfMsgs = v
+}
+
+func (o *MemoryClient) Subscribe(topic string, bufferSize int) (*Subscription, error) {
+	if o.State() != StateConnected {
+		return nil, errors.Wrap(errors.New("not connected"), "MemoryClient.Subscribe")
+	}
+
+	if !o.getACL().CanSubscribe(topic, o.clientID, "") {
+		return nil, errors.Wrapf(acl.ErrDenied, "MemoryClient.Subscribe(%s)", topic)
+	}
+
+	sub := newSubscription(topic, bufferSize, o.unsubscribe)
+
+	o.mu.Lock()
+	o.subs[topic] = append(o.subs[topic], sub)
+	o.mu.Unlock()
+
+	// Брокер отправляет хранимые сообщения при подписке
+	for _, msg := range o.bus.getRetained(topic) {
+		if !o.isSelf(msg.topic) {
+			sub.push(msg)
+		}
+	}
+
+	return sub, nil
+}
+
+// unsubscribe Отменяет одну подписку
+func (o *MemoryClient) unsubscribe(sub *Subscription) error {
+	o.mu.Lock()
+	subs := o.subs[sub.topic]
+	for i, v := range subs {
+		if v == sub {
+			o.subs[sub.topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+
+	if len(o.subs[sub.topic]) == 0 {
+		delete(o.subs, sub.topic)
+	}
+	o.mu.Unlock()
+
+	sub.close()
+
+	return nil
+}
+
+func (o *MemoryClient) Unsubscribe(topics ...string) error {
+	for _, topic := range topics {
+		o.mu.Lock()
+		subs := o.subs[topic]
+		delete(o.subs, topic)
+		o.mu.Unlock()
+
+		for _, sub := range subs {
+			sub.close()
+		}
+	}
+
+	return nil
+}
+
+func (o *MemoryClient) Send(msg messages.Message) error {
+	o.mu.Lock()
+	signer, ttl, codecs := o.signer, o.ttl, o.codecs
+	o.mu.Unlock()
+
+	msg.SetSentAt(time.Now())
+	ttl.Apply(msg)
+
+	if signer != nil {
+		if err := signer.Sign(msg); err != nil {
+			return errors.Wrap(err, "MemoryClient.Send")
+		}
+	}
+
+	data, err := codecs.Encode(msg)
+	if err != nil {
+		return errors.Wrap(err, "MemoryClient.Send")
+	}
+
+	if err := o.SendRaw(msg.GetTopic(), msg.GetQoS(), msg.GetRetained(), data); err != nil {
+		return errors.Wrap(err, "MemoryClient.Send")
+	}
+
+	return nil
+}
+
+func (o *MemoryClient) SendRaw(topic string, qos messages.QoS, retained bool, payload interface{}) error {
+	switch {
+	case topic == "":
+		return errors.Wrap(errors.New("topic is empty"), "MemoryClient.SendRaw")
+	case strings.ContainsAny(topic, "+#"):
+		return errors.Wrap(errors.Errorf("topic %q contains wildcards", topic), "MemoryClient.SendRaw")
+	case qos < messages.QoSNotGuaranteed || qos > messages.QoSGuaranteedOne:
+		return errors.Wrap(errors.Errorf("unexpected QoS %d", qos), "MemoryClient.SendRaw")
+	case o.State() != StateConnected:
+		return errors.Wrap(errors.New("not connected"), "MemoryClient.SendRaw")
+	case !o.getACL().CanPublish(topic, o.clientID, ""):
+		return errors.Wrapf(acl.ErrDenied, "MemoryClient.SendRaw(%s)", topic)
+	}
+
+	data, err := encodePayload(payload)
+	if err != nil {
+		return errors.Wrap(err, "MemoryClient.SendRaw")
+	}
+
+	o.bus.publish(o, topic, qos, retained, data)
+
+	return nil
+}
+
+func (o *MemoryClient) GetTopicFromConnectionString() string {
+	return o.topic
+}
+
+func (o *MemoryClient) Shutdown() error {
+	o.mu.Lock()
+	topics := make([]string, 0, len(o.subs))
+	for topic := range o.subs {
+		topics = append(topics, topic)
+	}
+	o.mu.Unlock()
+
+	if err := o.Unsubscribe(topics...); err != nil {
+		return errors.Wrap(err, "MemoryClient.Shutdown")
+	}
+
+	o.bus.removeClient(o)
+	o.state.set(StateDisconnected)
+	o.state.close()
+
+	return nil
+}
+
+func (o *MemoryClient) State() State {
+	return o.state.get()
+}
+
+func (o *MemoryClient) SubscribeState(bufferSize int) <-chan State {
+	return o.state.subscribe(bufferSize)
+}
+
+func (o *MemoryClient) GetStats() *Stats {
+	return o.state.stats()
+}
+
+// SetState Имитирует изменение состояния соединения.
+// Пока клиент не подключен, сообщения ему не доставляются, а отправка завершается ошибкой.
+func (o *MemoryClient) SetState(state State) {
+	o.state.set(state)
+}
+
+func (o *MemoryClient) isSelf(topic string) bool {
+	return o.ignoreSelfMsgs && strings.HasPrefix(topic, o.name)
+}
+
+// match Возвращает обычные подписки клиента, подходящие под топик,
+// и подходящие общие подписки ($share/<группа>/<фильтр>) по фильтру
+func (o *MemoryClient) match(topic string) ([]*Subscription, map[string][]*Subscription) {
+	if o.State() != StateConnected || o.isSelf(topic) {
+		return nil, nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var subs []*Subscription
+	var groups map[string][]*Subscription
+
+	for filter, items := range o.subs {
+		if !topics.TopicMatch(filter, topic) {
+			continue
+		}
+
+		if topics.TrimShared(filter) == filter {
+			subs = append(subs, items...)
+			continue
+		}
+
+		if groups == nil {
+			groups = make(map[string][]*Subscription)
+		}
+
+		groups[filter] = append(groups[filter], items...)
+	}
+
+	return subs, groups
+}
+
+// memoryMessage Реализует интерфейс сообщения paho
+type memoryMessage struct {
+	topic     string
+	qos       byte
+	retained  bool
+	messageID uint16
+	payload   []byte
+}
+
+func (o *memoryMessage) Duplicate() bool {
+	return false
+}
+
+func (o *memoryMessage) Qos() byte {
+	return o.qos
+}
+
+func (o *memoryMessage) Retained() bool {
+	return o.retained
+}
+
+func (o *memoryMessage) Topic() string {
+	return o.topic
+}
+
+func (o *memoryMessage) MessageID() uint16 {
+	return o.messageID
+}
+
+func (o *memoryMessage) Payload() []byte {
+	return o.payload
+}
+
+func (o *memoryMessage) Ack() {}
+
+var _ Client = (*MemoryClient)(nil)
+var _ mqtt.Message = (*memoryMessage)(nil)
@@ -0,0 +1,208 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/client/clienttest"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestBus_Wildcards(t *testing.T) {
+	bus := client.NewBus()
+	pub := bus.NewClient("pub", "object_manager", "")
+	sub := bus.NewClient("sub", "action_router", "")
+
+	plus, err := sub.Subscribe("object_manager/+/relay", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := sub.Subscribe("object_manager/#", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pub.SendRaw("object_manager/event/relay", messages.QoSMinimumOne, false, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]<-chan paho.Message{"+": plus.C(), "#": hash.C()} {
+		select {
+		case msg := <-c:
+			if msg.Topic() != "object_manager/event/relay" {
+				t.Fatalf("%s: unexpected topic %q", name, msg.Topic())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: message not delivered", name)
+		}
+	}
+
+	if s := bus.GetStats(); s.Published != 1 || s.PublishedQoS[messages.QoSMinimumOne] != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestBus_Retained(t *testing.T) {
+	bus := client.NewBus()
+	pub := bus.NewClient("pub", "object_manager", "")
+
+	if err := pub.SendRaw("service/leader/poller", messages.QoSMinimumOne, true, []byte(`{"holder":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := bus.NewClient("sub", "action_router", "")
+	c, err := sub.Subscribe("service/leader/#", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-c.C():
+		if !msg.Retained() || string(msg.Payload()) != `{"holder":"a"}` {
+			t.Fatalf("unexpected message %v %q", msg.Retained(), msg.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retained message not delivered")
+	}
+
+	// Пустое сообщение удаляет хранимое
+	if err := pub.SendRaw("service/leader/poller", messages.QoSMinimumOne, true, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := bus.GetStats(); s.Retained != 0 {
+		t.Fatalf("retained = %d, want 0", s.Retained)
+	}
+}
+
+func TestBus_IgnoreSelfMsgs(t *testing.T) {
+	bus := client.NewBus()
+	c := bus.NewClient("self", "object_manager", "")
+
+	msgs, err := c.Subscribe("#", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := messages.NewEvent("object.relay.on_state_on", messages.TargetTypeObject, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetTopic("object_manager/event/relay")
+
+	if err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	clienttest.ExpectEvent(t, bus, "object.relay.on_state_on", 5, time.Second)
+
+	select {
+	case msg := <-msgs.C():
+		t.Fatalf("own message delivered: %s", msg.Topic())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBus_State(t *testing.T) {
+	bus := client.NewBus()
+	c := bus.NewClient("c", "object_manager", "")
+	states := c.SubscribeState(10)
+
+	c.SetState(client.StateReconnecting)
+	if err := c.SendRaw("object_manager/event", messages.QoSNotGuaranteed, false, []byte("{}")); err == nil {
+		t.Fatal("send must fail while disconnected")
+	}
+
+	c.SetState(client.StateConnected)
+
+	if s := <-states; s != client.StateReconnecting {
+		t.Fatalf("state = %s, want %s", s, client.StateReconnecting)
+	}
+
+	if s := <-states; s != client.StateConnected {
+		t.Fatalf("state = %s, want %s", s, client.StateConnected)
+	}
+
+	if s := c.GetStats(); s.Reconnects != 1 || s.ConnectionLosses != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestBus_SharedSubscription(t *testing.T) {
+	bus := client.NewBus()
+	pub := bus.NewClient("pub", "object_manager", "")
+
+	// Две реплики одной группы, одна реплика другой группы и обычный подписчик
+	subs := make(map[string]*client.Subscription)
+	for id, filter := range map[string]string{
+		"a1":    "$share/a/object_manager/#",
+		"a2":    "$share/a/object_manager/#",
+		"b1":    "$share/b/object_manager/#",
+		"plain": "object_manager/#",
+	} {
+		sub, err := bus.NewClient(id, id, "").Subscribe(filter, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subs[id] = sub
+	}
+
+	const n = 4
+	for i := 0; i < n; i++ {
+		if err := pub.SendRaw("object_manager/event/relay", messages.QoSNotGuaranteed, false, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(map[string]int)
+	for id, sub := range subs {
+		for done := false; !done; {
+			select {
+			case <-sub.C():
+				received[id]++
+			case <-time.After(50 * time.Millisecond):
+				done = true
+			}
+		}
+	}
+
+	// Сообщения группы распределяются между ее участниками
+	if received["a1"]+received["a2"] != n || received["a1"] == 0 || received["a2"] == 0 {
+		t.Fatalf("group a received %d + %d, want %d in total", received["a1"], received["a2"], n)
+	}
+
+	if received["b1"] != n || received["plain"] != n {
+		t.Fatalf("b1 received %d, plain received %d, want %d", received["b1"], received["plain"], n)
+	}
+}
+
+func TestBus_HistorySize(t *testing.T) {
+	bus := client.NewBus()
+	bus.SetHistorySize(2)
+	pub := bus.NewClient("pub", "object_manager", "")
+
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := pub.SendRaw("object_manager/event", messages.QoSNotGuaranteed, false, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history := bus.GetHistory()
+	if len(history) != 2 || string(history[0].Payload) != "2" || string(history[1].Payload) != "3" {
+		t.Fatalf("unexpected history %v", history)
+	}
+
+	// Удаленные из истории публикации не мешают ожиданию новых
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = pub.SendRaw("object_manager/event", messages.QoSNotGuaranteed, false, []byte("4"))
+	}()
+
+	if _, err := bus.WaitFor(time.Second, func(p *client.Publication) bool { return string(p.Payload) == "4" }); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"sort"
+
+	"github.com/VladimirDronik/touchon-server/metrics"
+)
+
+// clientMetrics Счетчики сообщений клиента
+type clientMetrics struct {
+	sent       metrics.Counter // Отправлено сообщений
+	sendErrors metrics.Counter // Ошибок отправки
+	received   metrics.Counter // Получено сообщений
+}
+
+// collectMetrics Записывает метрики клиента в формате Prometheus
+func (o *ClientImpl) collectMetrics(w *metrics.Writer) {
+	w.Counter("mqtt_client_sent_total", "Total number of messages published to the broker.", float64(o.metrics.sent.Get()), "client", o.clientID)
+	w.Counter("mqtt_client_send_errors_total", "Total number of failed publications.", float64(o.metrics.sendErrors.Get()), "client", o.clientID)
+	w.Counter("mqtt_client_received_total", "Total number of messages received from the broker.", float64(o.metrics.received.Get()), "client", o.clientID)
+
+	connected := 0.0
+	if o.State() == StateConnected {
+		connected = 1
+	}
+
+	w.Gauge("mqtt_client_connected", "Whether the client is connected to the broker.", connected, "client", o.clientID)
+
+	o.mu.Lock()
+	depths := make(map[string]int, len(o.subs))
+	for topic, subs := range o.subs {
+		for _, sub := range subs {
+			depths[topic] += sub.depth()
+		}
+	}
+	o.mu.Unlock()
+
+	topics := make([]string, 0, len(depths))
+	for topic := range depths {
+		topics = append(topics, topic)
+	}
+
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		w.Gauge("mqtt_client_queue_depth", "Number of received messages waiting to be read from the subscription.", float64(depths[topic]), "client", o.clientID, "topic", topic)
+	}
+}
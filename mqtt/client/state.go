@@ -0,0 +1,169 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// State Состояние соединения с брокером
+type State string
+
+const (
+	StateConnecting   State = "connecting"   // Первое подключение
+	StateConnected    State = "connected"    // Соединение установлено
+	StateReconnecting State = "reconnecting" // Соединение потеряно, идет переподключение
+	StateDisconnected State = "disconnected" // Клиент отключен
+)
+
+// Stats Статистика соединения с брокером
+type Stats struct {
+	State              State
+	Connects           int    // Количество успешных подключений
+	Reconnects         int    // Количество переподключений после потери соединения
+	ConnectionLosses   int    // Количество потерь соединения
+	ResubscribeErrors  int    // Количество ошибок восстановления подписок
+	LastConnectedAt    string //
+	LastDisconnectedAt string //
+	DisconnectedTime   string // Суммарное время без соединения
+}
+
+func newStateTracker(state State) *stateTracker {
+	return &stateTracker{
+		state:             state,
+		disconnectedSince: time.Now(),
+	}
+}
+
+// stateTracker Хранит состояние соединения, ведет статистику
+// и рассылает изменения состояния подписчикам.
+type stateTracker struct {
+	mu                 sync.Mutex
+	state              State
+	listeners          []chan State
+	connects           int
+	reconnects         int
+	losses             int
+	resubscribeErrors  int
+	lastConnectedAt    time.Time
+	lastDisconnectedAt time.Time
+	disconnectedSince  time.Time
+	disconnectedTotal  time.Duration
+}
+
+func (o *stateTracker) get() State {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.state
+}
+
+func (o *stateTracker) set(state State) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.state == state {
+		return
+	}
+
+	now := time.Now()
+	prev := o.state
+	o.state = state
+
+	switch {
+	case state == StateConnected:
+		o.connects++
+		if prev == StateReconnecting {
+			o.reconnects++
+		}
+		o.lastConnectedAt = now
+		o.disconnectedTotal += now.Sub(o.disconnectedSince)
+
+	case prev == StateConnected:
+		if state == StateReconnecting {
+			o.losses++
+		}
+		o.lastDisconnectedAt = now
+		o.disconnectedSince = now
+	}
+
+	for _, c := range o.listeners {
+		notify(c, state)
+	}
+}
+
+// notify Отправляет состояние подписчику, не блокируясь.
+// Если буфер подписчика заполнен, самое старое состояние отбрасывается.
+func notify(c chan State, state State) {
+	for {
+		select {
+		case c <- state:
+			return
+		default:
+		}
+
+		select {
+		case <-c:
+		default:
+		}
+	}
+}
+
+func (o *stateTracker) subscribe(bufferSize int) <-chan State {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	c := make(chan State, bufferSize)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.listeners = append(o.listeners, c)
+
+	return c
+}
+
+func (o *stateTracker) addResubscribeError() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.resubscribeErrors++
+}
+
+// close Закрывает каналы подписчиков
+func (o *stateTracker) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, c := range o.listeners {
+		close(c)
+	}
+
+	o.listeners = nil
+}
+
+func (o *stateTracker) stats() *Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	disconnected := o.disconnectedTotal
+	if o.state != StateConnected {
+		disconnected += time.Since(o.disconnectedSince)
+	}
+
+	s := &Stats{
+		State:             o.state,
+		Connects:          o.connects,
+		Reconnects:        o.reconnects,
+		ConnectionLosses:  o.losses,
+		ResubscribeErrors: o.resubscribeErrors,
+		DisconnectedTime:  disconnected.Round(time.Millisecond).String(),
+	}
+
+	if !o.lastConnectedAt.IsZero() {
+		s.LastConnectedAt = o.lastConnectedAt.Format("02.01.2006 15:04:05")
+	}
+
+	if !o.lastDisconnectedAt.IsZero() {
+		s.LastDisconnectedAt = o.lastDisconnectedAt.Format("02.01.2006 15:04:05")
+	}
+
+	return s
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func newSubscription(topic string, bufferSize int, release func(*Subscription) error) *Subscription {
+	return &Subscription{
+		topic:   topic,
+		c:       make(chan mqtt.Message, bufferSize),
+		done:    make(chan struct{}),
+		release: release,
+	}
+}
+
+// Subscription Подписка на топик, возвращаемая Client.Subscribe.
+// Сообщения доставляются неблокирующе и в порядке получения: если канал заполнен,
+// они копятся в очереди, которую разбирает отдельная горутина. Канал закрывается
+// только после ее завершения, поэтому отписка не приводит к записи в закрытый канал.
+type Subscription struct {
+	topic   string
+	c       chan mqtt.Message
+	done    chan struct{}
+	release func(*Subscription) error // Удаляет подписку из клиента
+
+	mu       sync.Mutex
+	closed   bool
+	queue    []mqtt.Message // Сообщения, ожидающие места в канале
+	draining bool           // Очередь разбирается горутиной drain
+	wg       sync.WaitGroup
+}
+
+// Topic Возвращает фильтр подписки
+func (o *Subscription) Topic() string {
+	return o.topic
+}
+
+// C Возвращает канал сообщений подписки. Канал закрывается после отмены подписки.
+func (o *Subscription) C() <-chan mqtt.Message {
+	return o.c
+}
+
+// Unsubscribe Отменяет только эту подписку. Другие подписки клиента на тот же топик
+// продолжают получать сообщения, подписка в брокере отменяется вместе с последней из них.
+func (o *Subscription) Unsubscribe() error {
+	if o.release == nil {
+		o.close()
+		return nil
+	}
+
+	return o.release(o)
+}
+
+// depth Возвращает количество сообщений, ожидающих обработки
+func (o *Subscription) depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.c) + len(o.queue)
+}
+
+func (o *Subscription) push(msg mqtt.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+
+	// Пока очередь разбирается, новые сообщения встают за ней, чтобы не нарушить порядок
+	if !o.draining {
+		select {
+		case o.c <- msg:
+			return
+		default:
+		}
+
+		o.draining = true
+		o.wg.Add(1)
+		go o.drain()
+	}
+
+	o.queue = append(o.queue, msg)
+}
+
+// drain Переносит сообщения из очереди в канал по мере его освобождения
+func (o *Subscription) drain() {
+	defer o.wg.Done()
+
+	for {
+		o.mu.Lock()
+		if len(o.queue) == 0 || o.closed {
+			o.queue = nil
+			o.draining = false
+			o.mu.Unlock()
+			return
+		}
+
+		msg := o.queue[0]
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+
+		select {
+		case o.c <- msg:
+		case <-o.done:
+			return
+		}
+	}
+}
+
+func (o *Subscription) close() {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	o.closed = true
+	o.mu.Unlock()
+
+	close(o.done)
+	o.wg.Wait()
+	close(o.c)
+}
@@ -0,0 +1,78 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/broker"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+)
+
+func TestSubscription_Unsubscribe(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := broker.New(map[string]string{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	connected, err := client.New("sub", "embedded:///", time.Second, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connected.Shutdown()
+
+	clients := map[string]client.Client{
+		"memory": client.NewBus().NewClient("sub", "sub", ""),
+		"broker": connected,
+	}
+
+	for name, c := range clients {
+		c.SetIgnoreSelfMsgs(false)
+
+		first, err := c.Subscribe("service/info", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		second, err := c.Subscribe("service/info", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := first.Unsubscribe(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if _, ok := <-first.C(); ok {
+			t.Fatalf("%s: channel of canceled subscription is not closed", name)
+		}
+
+		if err := c.SendRaw("service/info", messages.QoSMinimumOne, false, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case msg := <-second.C():
+			if msg.Topic() != "service/info" {
+				t.Fatalf("%s: unexpected topic %q", name, msg.Topic())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: other subscription to the same topic stopped receiving messages", name)
+		}
+
+		if err := second.Unsubscribe(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+// Пакет для выбора лидера среди реплик сервиса через MQTT.
+// Лидер удерживает retained-блокировку в топике service/leader/<группа>
+// и периодически продлевает аренду. При обрыве соединения брокер публикует
+// will-сообщение об освобождении блокировки, и лидером становится другая реплика.
+
+package leader
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/info"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// New Создает участника выбора лидера в группе group.
+// Для участника открывается отдельное соединение с брокером, чтобы will-сообщение
+// освобождало только блокировку лидера.
+func New(group, connString string, lease time.Duration, logger *logrus.Logger) (*Elector, error) {
+	o, err := newElector(group, lease, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "leader.New")
+	}
+
+	o.connString = connString
+
+	return o, nil
+}
+
+// NewWithClient Создает участника выбора лидера, использующего уже подключенный клиент
+// (например, клиент шины в памяти в тестах). Клиент не закрывается при остановке участника.
+// Will-сообщение в этом случае не публикуется, блокировка освобождается по окончании аренды.
+// Настройки клиента не меняются: он должен доставлять участнику все сообщения топика блокировки,
+// свои заявки участник отличает от чужих по идентификатору держателя.
+func NewWithClient(group string, client mqtt.Client, lease time.Duration, logger *logrus.Logger) (*Elector, error) {
+	if client == nil {
+		return nil, errors.Wrap(errors.New("client is nil"), "leader.NewWithClient")
+	}
+
+	o, err := newElector(group, lease, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "leader.NewWithClient")
+	}
+
+	o.client = client
+
+	return o, nil
+}
+
+func newElector(group string, lease time.Duration, logger *logrus.Logger) (*Elector, error) {
+	switch {
+	case group == "":
+		return nil, errors.Wrap(errors.New("group is empty"), "newElector")
+	case lease < time.Second:
+		return nil, errors.Wrap(errors.New("lease < 1s"), "newElector")
+	case logger == nil:
+		return nil, errors.Wrap(errors.New("logger is nil"), "newElector")
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "newElector")
+	}
+
+	suffix := hex.EncodeToString(b)
+
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+
+	o := &Elector{
+		group:    group,
+		id:       info.Name + "@" + host + "#" + suffix,
+		clientID: "leader_" + group + "_" + suffix,
+		topic:    topics.TopicServiceLeader + "/" + group,
+		lease:    lease,
+		logger:   logger,
+		done:     make(chan struct{}),
+		changed:  make(chan struct{}, 1),
+	}
+
+	return o, nil
+}
+
+type Elector struct {
+	group      string
+	id         string // Уникальный идентификатор участника
+	clientID   string
+	topic      string
+	connString string
+	lease      time.Duration
+	logger     *logrus.Logger
+	client     mqtt.Client
+	ownClient  bool // Клиент создан участником и закрывается при остановке
+	sub        *mqtt.Subscription
+
+	onElected []func()
+	onDemoted []func()
+
+	// Обработчики вызываются вне цикла выборов, чтобы долгий обработчик не мешал продлению аренды
+	changesMu sync.Mutex
+	changes   []bool        // Смены лидерства, ожидающие вызова обработчиков
+	changed   chan struct{} // Сигнал о новых сменах лидерства
+	callbacks sync.WaitGroup
+
+	mu            sync.RWMutex
+	holder        string    // Текущий держатель блокировки
+	holderExpiry  time.Time // Окончание аренды держателя (по локальным часам)
+	isLeader      bool
+	claimedAt     time.Time // Время последней отправки своей заявки
+	confirmedAt   time.Time // Время последнего получения своей заявки от брокера
+	leaderSince   time.Time
+	electionCount int
+
+	done         chan struct{}
+	wg           sync.WaitGroup
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// lock Содержимое retained-блокировки
+type lock struct {
+	Holder   string `json:"holder"`
+	Service  string `json:"service"`
+	Lease    int64  `json:"lease_ms"`
+	Released bool   `json:"released,omitempty"`
+}
+
+// Status Состояние выбора лидера
+type Status struct {
+	Group       string
+	Candidate   string
+	Leader      string
+	IsLeader    bool
+	LeaderSince string
+	Elections   int
+}
+
+// OnElected Добавляет обработчик, вызываемый при получении лидерства
+func (o *Elector) OnElected(f func()) {
+	o.onElected = append(o.onElected, f)
+}
+
+// OnDemoted Добавляет обработчик, вызываемый при потере лидерства
+func (o *Elector) OnDemoted(f func()) {
+	o.onDemoted = append(o.onDemoted, f)
+}
+
+func (o *Elector) GetID() string {
+	return o.id
+}
+
+func (o *Elector) IsLeader() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.isLeader
+}
+
+func (o *Elector) GetLeader() string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.holder
+}
+
+func (o *Elector) GetStatus() *Status {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	s := &Status{
+		Group:     o.group,
+		Candidate: o.id,
+		Leader:    o.holder,
+		IsLeader:  o.isLeader,
+		Elections: o.electionCount,
+	}
+
+	if o.isLeader {
+		s.LeaderSince = o.leaderSince.Format("02.01.2006 15:04:05")
+	}
+
+	return s
+}
+
+func (o *Elector) Start() error {
+	will, err := json.Marshal(&lock{Holder: o.id, Service: info.Name, Released: true})
+	if err != nil {
+		return errors.Wrap(err, "Elector.Start")
+	}
+
+	if o.client == nil {
+		o.client, err = mqtt.NewWithWill(o.clientID, o.connString, 5*time.Second, 3, &mqtt.Will{
+			Topic:    o.topic,
+			Payload:  will,
+			QoS:      messages.QoSMinimumOne,
+			Retained: true,
+		}, o.logger)
+		if err != nil {
+			return errors.Wrap(err, "Elector.Start")
+		}
+
+		// Свои заявки нужны для подтверждения лидерства, поэтому собственный клиент их не отбрасывает
+		o.client.SetIgnoreSelfMsgs(false)
+		o.ownClient = true
+	}
+
+	if o.sub, err = o.client.Subscribe(o.topic, 10); err != nil {
+		return errors.Wrap(err, "Elector.Start")
+	}
+
+	info.AddSection(o.sectionName(), func() interface{} { return o.GetStatus() })
+
+	o.callbacks.Add(1)
+	go o.runCallbacks()
+
+	o.wg.Add(1)
+	go o.run(o.sub.C())
+
+	o.logger.Infof("Leader(%s): участник %s запущен", o.group, o.id)
+
+	return nil
+}
+
+// Shutdown Останавливает участника. Повторные вызовы ничего не делают.
+func (o *Elector) Shutdown() error {
+	if o.sub == nil {
+		return nil
+	}
+
+	o.shutdownOnce.Do(func() { o.shutdownErr = o.shutdown() })
+
+	return o.shutdownErr
+}
+
+func (o *Elector) shutdown() error {
+	close(o.done)
+	o.wg.Wait()
+
+	info.RemoveSection(o.sectionName())
+
+	// Освобождаем блокировку, чтобы другие участники не ждали окончания аренды
+	if o.IsLeader() {
+		o.setLeader(false)
+
+		if err := o.publish(true); err != nil {
+			o.logger.Error(errors.Wrap(err, "Elector.shutdown"))
+		}
+	}
+
+	// Дожидаемся обработчиков, в том числе обработчика потери лидерства
+	close(o.changed)
+	o.callbacks.Wait()
+
+	if !o.ownClient {
+		if err := o.sub.Unsubscribe(); err != nil {
+			return errors.Wrap(err, "Elector.shutdown")
+		}
+
+		return nil
+	}
+
+	if err := o.client.Shutdown(); err != nil {
+		return errors.Wrap(err, "Elector.shutdown")
+	}
+
+	return nil
+}
+
+func (o *Elector) sectionName() string {
+	return "leader_" + o.group
+}
+
+func (o *Elector) run(msgs <-chan paho.Message) {
+	defer o.wg.Done()
+
+	t := time.NewTicker(o.lease / 10)
+	defer t.Stop()
+
+	// Первая заявка откладывается, чтобы успела прийти retained-блокировка текущего лидера
+	o.mu.Lock()
+	o.claimedAt = time.Now()
+	o.mu.Unlock()
+
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			o.processLock(msg.Payload())
+
+		case <-t.C:
+			o.tick()
+
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// processLock Обрабатывает изменение блокировки
+func (o *Elector) processLock(data []byte) {
+	l := &lock{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, l); err != nil {
+			o.logger.Error(errors.Wrap(err, "Elector.processLock"))
+			return
+		}
+	}
+
+	o.mu.Lock()
+
+	switch {
+	case l.Holder == "" || l.Released && l.Holder == o.holder:
+		// Блокировка освобождена
+		o.holder = ""
+		o.holderExpiry = time.Time{}
+
+	case l.Released:
+		// Запоздавшее освобождение чужой блокировки затерло актуальную, восстанавливаем ее
+		if o.holder == o.id {
+			o.mu.Unlock()
+			o.claim()
+			return
+		}
+
+	default:
+		o.holder = l.Holder
+		o.holderExpiry = time.Now().Add(time.Duration(l.Lease) * time.Millisecond)
+		if l.Holder == o.id {
+			o.confirmedAt = time.Now()
+		}
+	}
+
+	isLeader := o.isLeader
+	holder := o.holder
+
+	o.mu.Unlock()
+
+	// Блокировку перехватил другой участник
+	if isLeader && holder != o.id {
+		o.setLeader(false)
+	}
+}
+
+func (o *Elector) tick() {
+	now := time.Now()
+
+	o.mu.RLock()
+	holder := o.holder
+	expired := holder == "" || now.After(o.holderExpiry)
+	isLeader := o.isLeader
+	claimedAt := o.claimedAt
+	confirmedAt := o.confirmedAt
+	o.mu.RUnlock()
+
+	switch {
+	case isLeader && now.Sub(confirmedAt) > o.lease:
+		// Не смогли продлить аренду (например, потеряна связь с брокером)
+		o.setLeader(false)
+
+	case isLeader && now.Sub(claimedAt) >= o.lease/3:
+		o.claim()
+
+	case !isLeader && holder == o.id && !expired && now.Sub(confirmedAt) >= o.settleTime():
+		// Наша заявка продержалась достаточно долго, чтобы считать выборы завершенными
+		o.setLeader(true)
+
+	case !isLeader && holder != o.id && expired && now.Sub(claimedAt) >= o.settleTime():
+		o.claim()
+	}
+}
+
+// settleTime Время, в течение которого заявка не должна быть перебита другими участниками
+func (o *Elector) settleTime() time.Duration {
+	return o.lease / 5
+}
+
+func (o *Elector) claim() {
+	o.mu.Lock()
+	o.claimedAt = time.Now()
+	o.mu.Unlock()
+
+	if err := o.publish(false); err != nil {
+		o.logger.Error(errors.Wrap(err, "Elector.claim"))
+	}
+}
+
+func (o *Elector) publish(released bool) error {
+	data, err := json.Marshal(&lock{
+		Holder:   o.id,
+		Service:  info.Name,
+		Lease:    o.lease.Milliseconds(),
+		Released: released,
+	})
+	if err != nil {
+		return errors.Wrap(err, "publish")
+	}
+
+	if err := o.client.SendRaw(o.topic, messages.QoSMinimumOne, true, data); err != nil {
+		return errors.Wrap(err, "publish")
+	}
+
+	return nil
+}
+
+func (o *Elector) setLeader(v bool) {
+	o.mu.Lock()
+	if o.isLeader == v {
+		o.mu.Unlock()
+		return
+	}
+
+	o.isLeader = v
+	if v {
+		o.leaderSince = time.Now()
+		o.electionCount++
+	}
+	o.mu.Unlock()
+
+	if v {
+		o.logger.Infof("Leader(%s): %s стал лидером", o.group, o.id)
+	} else {
+		o.logger.Infof("Leader(%s): %s больше не лидер", o.group, o.id)
+	}
+
+	o.changesMu.Lock()
+	o.changes = append(o.changes, v)
+	o.changesMu.Unlock()
+
+	select {
+	case o.changed <- struct{}{}:
+	default:
+	}
+}
+
+// runCallbacks Вызывает обработчики смены лидерства в порядке смен
+func (o *Elector) runCallbacks() {
+	defer o.callbacks.Done()
+
+	for range o.changed {
+		o.changesMu.Lock()
+		changes := o.changes
+		o.changes = nil
+		o.changesMu.Unlock()
+
+		for _, v := range changes {
+			handlers := o.onDemoted
+			if v {
+				handlers = o.onElected
+			}
+
+			for _, f := range handlers {
+				f()
+			}
+		}
+	}
+}
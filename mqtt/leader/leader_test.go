@@ -0,0 +1,181 @@
+package leader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+)
+
+const testLease = time.Second
+
+func newTestElector(t *testing.T, bus *mqtt.Bus, name string) (*Elector, *mqtt.MemoryClient) {
+	t.Helper()
+
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := bus.NewClient(name, name, "")
+
+	o, err := NewWithClient("test", c, testLease, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return o, c
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+
+	t.Fatalf("%s: not within %s", what, timeout)
+}
+
+// leaders Возвращает участников, считающих себя лидером
+func leaders(electors ...*Elector) []*Elector {
+	var r []*Elector
+	for _, e := range electors {
+		if e.IsLeader() {
+			r = append(r, e)
+		}
+	}
+
+	return r
+}
+
+func TestElector_Election(t *testing.T) {
+	bus := mqtt.NewBus()
+	a, ca := newTestElector(t, bus, "a")
+	b, _ := newTestElector(t, bus, "b")
+
+	for _, e := range []*Elector{a, b} {
+		if err := e.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer e.Shutdown()
+	}
+
+	// Переданный клиент не перенастраивается
+	if !ca.GetIgnoreSelfMsgs() {
+		t.Fatal("elector changed client settings")
+	}
+
+	waitFor(t, 3*testLease, "leader elected", func() bool { return len(leaders(a, b)) == 1 })
+
+	// Выборы завершены, лидер не меняется и известен обоим участникам
+	time.Sleep(testLease)
+
+	l := leaders(a, b)
+	if len(l) != 1 {
+		t.Fatalf("%d leaders", len(l))
+	}
+
+	if a.GetLeader() != l[0].GetID() || b.GetLeader() != l[0].GetID() {
+		t.Fatalf("leader %q, %q, want %q", a.GetLeader(), b.GetLeader(), l[0].GetID())
+	}
+}
+
+func TestElector_Failover(t *testing.T) {
+	bus := mqtt.NewBus()
+	a, ca := newTestElector(t, bus, "a")
+	b, _ := newTestElector(t, bus, "b")
+
+	demoted := make(chan struct{}, 1)
+	a.OnDemoted(func() { demoted <- struct{}{} })
+
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Shutdown()
+
+	waitFor(t, 3*testLease, "a elected", a.IsLeader)
+
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	// Лидер теряет связь с брокером и перестает продлевать аренду
+	ca.SetState(mqtt.StateReconnecting)
+
+	waitFor(t, 3*testLease, "b elected after lease expiry", b.IsLeader)
+
+	select {
+	case <-demoted:
+	case <-time.After(2 * testLease):
+		t.Fatal("a is not demoted")
+	}
+
+	if a.IsLeader() {
+		t.Fatal("a is still leader")
+	}
+}
+
+func TestElector_ReleaseOnShutdown(t *testing.T) {
+	bus := mqtt.NewBus()
+	a, _ := newTestElector(t, bus, "a")
+	b, _ := newTestElector(t, bus, "b")
+
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 3*testLease, "a elected", a.IsLeader)
+
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	waitFor(t, testLease, "b sees a", func() bool { return b.GetLeader() == a.GetID() })
+
+	if err := a.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Повторная остановка не должна приводить к панике
+	if err := a.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Освобожденная блокировка перехватывается раньше окончания аренды
+	waitFor(t, testLease*3/4, "b elected after release", b.IsLeader)
+}
+
+func TestElector_SlowCallback(t *testing.T) {
+	bus := mqtt.NewBus()
+	a, _ := newTestElector(t, bus, "a")
+	b, _ := newTestElector(t, bus, "b")
+
+	release := make(chan struct{})
+	a.OnElected(func() { <-release })
+
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Shutdown()
+	defer close(release)
+
+	waitFor(t, 3*testLease, "a elected", a.IsLeader)
+
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	// Обработчик все еще выполняется, но аренда продлевается
+	time.Sleep(2 * testLease)
+
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("a leader = %v, b leader = %v", a.IsLeader(), b.IsLeader())
+	}
+}
@@ -0,0 +1,428 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Названия форматов сообщений
+const (
+	CodecJSON    = "json"
+	CodecCBOR    = "cbor"
+	CodecMsgPack = "msgpack"
+)
+
+// Codec Формат сериализации конверта сообщения
+type Codec interface {
+	Name() string
+	Encode(m Message) ([]byte, error)
+	Decode(data []byte, m *MessageImpl) error
+}
+
+var codecs = map[string]Codec{
+	CodecJSON:    jsonCodec{},
+	CodecCBOR:    cborCodec{},
+	CodecMsgPack: msgpackCodec{},
+}
+
+// GetCodec Возвращает формат по названию
+func GetCodec(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, errors.Wrap(errors.Errorf("unknown codec %q", name), "GetCodec")
+	}
+
+	return c, nil
+}
+
+// DetectCodec Определяет формат сообщения по первому байту: конверт сообщения - всегда объект,
+// а начальные байты объекта в JSON, CBOR и MessagePack не пересекаются.
+func DetectCodec(data []byte) (Codec, error) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 {
+		return nil, errors.Wrap(errors.New("empty message"), "DetectCodec")
+	}
+
+	switch b := data[0]; {
+	case b == '{':
+		return codecs[CodecJSON], nil
+	case b >= 0xA0 && b <= 0xBF: // CBOR map
+		return codecs[CodecCBOR], nil
+	case b >= 0x80 && b <= 0x8F, b == 0xDE, b == 0xDF: // MessagePack fixmap, map16, map32
+		return codecs[CodecMsgPack], nil
+	default:
+		return nil, errors.Wrap(errors.Errorf("unknown message format (first byte 0x%02X)", b), "DetectCodec")
+	}
+}
+
+// topicCodec Формат для топиков, подходящих под фильтр
+type topicCodec struct {
+	filter string
+	codec  Codec
+}
+
+// Codecs Форматы отправки сообщений: по умолчанию и для отдельных топиков.
+// Задается клиенту шины (см. mqtt/client.Client.SetCodecs), nil - все сообщения в JSON.
+type Codecs struct {
+	def    Codec
+	topics []topicCodec
+}
+
+// ParseCodecs Разбирает формат отправляемых сообщений: по умолчанию (настройка mqtt_codec)
+// и для отдельных топиков (настройка mqtt_codec_topics вида "filter=codec;filter2=codec2").
+// Принимаются сообщения в любом формате.
+func ParseCodecs(defaultName, topicsCodecs string) (*Codecs, error) {
+	o := &Codecs{def: jsonCodec{}}
+	if defaultName != "" {
+		var err error
+		o.def, err = GetCodec(defaultName)
+		if err != nil {
+			return nil, errors.Wrap(err, "ParseCodecs")
+		}
+	}
+
+	for _, item := range strings.Split(topicsCodecs, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Wrap(errors.Errorf("bad topic codec %q, expected filter=codec", item), "ParseCodecs")
+		}
+
+		c, err := GetCodec(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, errors.Wrap(err, "ParseCodecs")
+		}
+
+		o.topics = append(o.topics, topicCodec{filter: strings.TrimSpace(kv[0]), codec: c})
+	}
+
+	return o, nil
+}
+
+// ForTopic Возвращает формат отправки сообщений в топик
+func (o *Codecs) ForTopic(topic string) Codec {
+	if o == nil {
+		return jsonCodec{}
+	}
+
+	for _, item := range o.topics {
+		if topics.TopicMatch(item.filter, topic) {
+			return item.codec
+		}
+	}
+
+	return o.def
+}
+
+// Encode Сериализует сообщение в формате, заданном для его топика
+func (o *Codecs) Encode(m Message) ([]byte, error) {
+	data, err := o.ForTopic(m.GetTopic()).Encode(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encode")
+	}
+
+	return data, nil
+}
+
+// Encode Сериализует сообщение в JSON
+func Encode(m Message) ([]byte, error) {
+	return (*Codecs)(nil).Encode(m)
+}
+
+// Decode Разбирает сообщение, определяя формат автоматически
+func Decode(data []byte) (*MessageImpl, error) {
+	c, err := DetectCodec(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decode")
+	}
+
+	m := &MessageImpl{}
+	if err := c.Decode(data, m); err != nil {
+		return nil, errors.Wrap(err, "Decode")
+	}
+
+	return m, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CodecJSON
+}
+
+func (jsonCodec) Encode(m Message) ([]byte, error) {
+	return m.MarshalJSON()
+}
+
+func (jsonCodec) Decode(data []byte, m *MessageImpl) error {
+	return m.UnmarshalJSON(data)
+}
+
+// binaryMessage Конверт сообщения для двоичных форматов. Время передается
+// в наносекундах unix-времени (0 - не задано). Названия полей совпадают с JSON.
+type binaryMessage struct {
+	Publisher     string                 `json:"publisher"`
+	Type          MessageType            `json:"type"`
+	Name          string                 `json:"name"`
+	TargetID      int                    `json:"target_id,omitempty"`
+	TargetType    TargetType             `json:"target_type,omitempty"`
+	Payload       map[string]interface{} `json:"payload,omitempty"`
+	SentAt        int64                  `json:"sent_at,omitempty"`
+	ReceivedAt    int64                  `json:"received_at,omitempty"`
+	ExpiresAt     int64                  `json:"expires_at,omitempty"`
+	Signature     string                 `json:"signature,omitempty"`
+	CorrelationID string                 `json:"correlation_id,omitempty"`
+}
+
+func newBinaryMessage(m Message) (*binaryMessage, error) {
+	payload, err := plainPayload(m.GetPayload())
+	if err != nil {
+		return nil, errors.Wrap(err, "newBinaryMessage")
+	}
+
+	return &binaryMessage{
+		Publisher:     m.GetPublisher(),
+		Type:          m.GetType(),
+		Name:          m.GetName(),
+		TargetID:      m.GetTargetID(),
+		TargetType:    m.GetTargetType(),
+		Payload:       payload,
+		SentAt:        unixNano(m.GetSentAt()),
+		ReceivedAt:    unixNano(m.GetReceivedAt()),
+		ExpiresAt:     unixNano(m.GetExpiresAt()),
+		Signature:     m.GetSignature(),
+		CorrelationID: m.GetCorrelationID(),
+	}, nil
+}
+
+func (o *binaryMessage) apply(m *MessageImpl) {
+	m.SetPublisher(o.Publisher)
+	m.SetType(o.Type)
+	m.SetName(o.Name)
+	m.SetTargetID(o.TargetID)
+	m.SetTargetType(o.TargetType)
+	m.SetPayload(normalizeMap(o.Payload))
+	m.SetSentAt(fromUnixNano(o.SentAt))
+	m.SetReceivedAt(fromUnixNano(o.ReceivedAt))
+	m.SetExpiresAt(fromUnixNano(o.ExpiresAt))
+	m.SetSignature(o.Signature)
+	m.SetCorrelationID(o.CorrelationID)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func fromUnixNano(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, v)
+}
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return CodecCBOR
+}
+
+func (cborCodec) Encode(m Message) ([]byte, error) {
+	b, err := newBinaryMessage(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "cborCodec.Encode")
+	}
+
+	data, err := cbor.Marshal(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "cborCodec.Encode")
+	}
+
+	return data, nil
+}
+
+func (cborCodec) Decode(data []byte, m *MessageImpl) error {
+	b := &binaryMessage{}
+	if err := cborDecMode.Unmarshal(data, b); err != nil {
+		return errors.Wrap(err, "cborCodec.Decode")
+	}
+
+	b.apply(m)
+
+	return nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return CodecMsgPack
+}
+
+func (msgpackCodec) Encode(m Message) ([]byte, error) {
+	b, err := newBinaryMessage(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "msgpackCodec.Encode")
+	}
+
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(b); err != nil {
+		return nil, errors.Wrap(err, "msgpackCodec.Encode")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(data []byte, m *MessageImpl) error {
+	b := &binaryMessage{}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	if err := dec.Decode(b); err != nil {
+		return errors.Wrap(err, "msgpackCodec.Decode")
+	}
+
+	b.apply(m)
+
+	return nil
+}
+
+// plainPayload Приводит значения полезной нагрузки к простым типам (строки, числа, списки, объекты).
+// Значения других типов (структуры, типы с собственной JSON-сериализацией) приводятся через JSON,
+// чтобы двоичные форматы передавали их так же, как JSON.
+func plainPayload(payload map[string]interface{}) (map[string]interface{}, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	r := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		p, err := plainValue(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "plainPayload(%s)", k)
+		}
+
+		r[k] = p
+	}
+
+	return r, nil
+}
+
+func plainValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float64:
+		return v, nil
+
+	case float32:
+		// JSON передает float32 кратчайшим десятичным представлением, делаем так же
+		return strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+
+	case map[string]interface{}:
+		return plainPayload(v)
+
+	case []interface{}:
+		r := make([]interface{}, len(v))
+		for i, item := range v {
+			p, err := plainValue(item)
+			if err != nil {
+				return nil, err
+			}
+
+			r[i] = p
+		}
+
+		return r, nil
+
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "plainValue")
+		}
+
+		var r interface{}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, errors.Wrap(err, "plainValue")
+		}
+
+		return r, nil
+	}
+}
+
+// normalizeMap Приводит числа к float64, как при разборе JSON, чтобы обработчики
+// получали одинаковые значения независимо от формата сообщения.
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		m[k] = normalizeValue(v)
+	}
+
+	return m
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case map[string]interface{}:
+		return normalizeMap(v)
+	case map[interface{}]interface{}:
+		r := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			r[fmt.Sprint(k)] = normalizeValue(item)
+		}
+		return r
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeValue(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
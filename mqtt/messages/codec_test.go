@@ -0,0 +1,113 @@
+package messages
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCodecs(t *testing.T) {
+	type args struct {
+		Level int `json:"level"`
+	}
+
+	sentAt := time.Date(2024, 3, 1, 10, 20, 30, 123456789, time.UTC)
+
+	m, err := NewCommand("set", TargetTypeObject, 5, map[string]interface{}{
+		"state": "on",
+		"value": 1,
+		"ratio": float32(0.1),
+		"list":  []interface{}{1, "a", true},
+		"args":  args{Level: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetPublisher("action_router")
+	m.SetSentAt(sentAt)
+	m.SetExpiresAt(sentAt.Add(time.Minute))
+	m.SetSignature("hmac:abc")
+	m.SetCorrelationID("c1")
+
+	// Значения полезной нагрузки после разбора JSON
+	want := map[string]interface{}{
+		"state": "on",
+		"value": float64(1),
+		"ratio": 0.1,
+		"list":  []interface{}{float64(1), "a", true},
+		"args":  map[string]interface{}{"level": float64(3)},
+	}
+
+	for _, name := range []string{CodecJSON, CodecCBOR, CodecMsgPack} {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := codec.Encode(m)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		detected, err := DetectCodec(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if detected.Name() != name {
+			t.Fatalf("%s: detected %s", name, detected.Name())
+		}
+
+		r, err := Decode(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		switch {
+		case r.GetPublisher() != "action_router", r.GetType() != MessageTypeCommand, r.GetName() != "set",
+			r.GetTargetType() != TargetTypeObject, r.GetTargetID() != 5, r.GetSignature() != "hmac:abc", r.GetCorrelationID() != "c1":
+			t.Fatalf("%s: unexpected envelope %+v", name, r)
+		case !r.GetSentAt().Equal(sentAt), !r.GetExpiresAt().Equal(sentAt.Add(time.Minute)):
+			t.Fatalf("%s: unexpected times %v, %v", name, r.GetSentAt(), r.GetExpiresAt())
+		case !r.GetReceivedAt().IsZero():
+			t.Fatalf("%s: unexpected received_at %v", name, r.GetReceivedAt())
+		case !reflect.DeepEqual(r.GetPayload(), want):
+			t.Fatalf("%s: got payload %#v, want %#v", name, r.GetPayload(), want)
+		}
+	}
+
+	if _, err := DetectCodec([]byte("on")); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestParseCodecs(t *testing.T) {
+	codecs, err := ParseCodecs(CodecMsgPack, "object_manager/event/#=cbor; +/command/#=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"object_manager/event/object": CodecCBOR,
+		"action_router/command/set":   CodecJSON,
+		"object_manager/item/change":  CodecMsgPack,
+	}
+
+	for topic, want := range tests {
+		if got := codecs.ForTopic(topic).Name(); got != want {
+			t.Fatalf("%s: got %s, want %s", topic, got, want)
+		}
+	}
+
+	if got := (*Codecs)(nil).ForTopic("object_manager/event/object").Name(); got != CodecJSON {
+		t.Fatalf("nil codecs: got %s, want %s", got, CodecJSON)
+	}
+
+	if _, err := ParseCodecs("xml", ""); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+
+	if _, err := ParseCodecs("", "object_manager/#"); err == nil {
+		t.Fatal("expected error for bad topic codec")
+	}
+}
@@ -0,0 +1,197 @@
+package messages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fastjson"
+)
+
+var parserPool fastjson.ParserPool
+
+// lazyPayload Исходное сообщение, полезная нагрузка которого разбирается при первом обращении
+type lazyPayload struct {
+	once sync.Once
+	data []byte
+}
+
+// decodePayload Разбирает отложенную полезную нагрузку и добавляет ее в payload
+func (o *MessageImpl) decodePayload() {
+	if o.lazy == nil {
+		return
+	}
+
+	o.lazy.once.Do(func() {
+		if o.payload == nil {
+			o.payload = make(map[string]interface{})
+		}
+
+		if o.lazy.data == nil {
+			return
+		}
+
+		p := parserPool.Get()
+		defer parserPool.Put(p)
+
+		// Сообщение уже проверено при разборе конверта
+		v, err := p.ParseBytes(o.lazy.data)
+		if err != nil {
+			return
+		}
+
+		v.GetObject("payload").Visit(func(key []byte, v *fastjson.Value) {
+			o.payload[string(key)] = toInterface(v)
+		})
+
+		o.lazy.data = nil
+	})
+}
+
+// toInterface Приводит значение к тем же типам, что и encoding/json
+func toInterface(v *fastjson.Value) interface{} {
+	switch v.Type() {
+	case fastjson.TypeObject:
+		r := make(map[string]interface{})
+		v.GetObject().Visit(func(key []byte, v *fastjson.Value) {
+			r[string(key)] = toInterface(v)
+		})
+		return r
+
+	case fastjson.TypeArray:
+		items := v.GetArray()
+		r := make([]interface{}, len(items))
+		for i, item := range items {
+			r[i] = toInterface(item)
+		}
+		return r
+
+	case fastjson.TypeString:
+		return string(v.GetStringBytes())
+	case fastjson.TypeNumber:
+		return v.GetFloat64()
+	case fastjson.TypeTrue:
+		return true
+	case fastjson.TypeFalse:
+		return false
+	default:
+		return nil
+	}
+}
+
+// decodeJSON Разбирает конверт сообщения парсером fastjson. Память выделяется под строки конверта
+// и копию сообщения, а полезная нагрузка разбирается в map только при первом обращении к ней
+// и тогда выделяет столько же, сколько encoding/json (см. BenchmarkDecode).
+func decodeJSON(data []byte, m *MessageImpl) error {
+	p := parserPool.Get()
+	defer parserPool.Put(p)
+
+	v, err := p.ParseBytes(data)
+	if err != nil {
+		return errors.Wrap(err, "decodeJSON")
+	}
+
+	obj, err := v.Object()
+	if err != nil {
+		return errors.Wrap(err, "decodeJSON")
+	}
+
+	var visitErr error
+	hasPayload := false
+
+	obj.Visit(func(key []byte, v *fastjson.Value) {
+		if visitErr != nil {
+			return
+		}
+
+		var err error
+
+		switch string(key) {
+		case "publisher":
+			m.publisher, err = getString(v)
+		case "type":
+			m.msgType, err = getString(v)
+		case "name":
+			m.name, err = getString(v)
+		case "target_type":
+			m.targetType, err = getString(v)
+		case "signature":
+			m.signature, err = getString(v)
+		case "correlation_id":
+			m.correlationID, err = getString(v)
+		case "target_id":
+			if v.Type() != fastjson.TypeNull {
+				m.targetID, err = v.Int()
+			}
+		case "sent_at":
+			m.sentAt, err = getTime(v)
+		case "received_at":
+			m.receivedAt, err = getTime(v)
+		case "expires_at":
+			m.expiresAt, err = getTime(v)
+		case "payload":
+			switch v.Type() {
+			case fastjson.TypeObject:
+				hasPayload = v.GetObject().Len() > 0
+			case fastjson.TypeNull:
+			default:
+				err = errors.Errorf("payload is %s, expected object", v.Type())
+			}
+		}
+
+		if err != nil {
+			visitErr = errors.Wrap(err, string(key))
+		}
+	})
+
+	if visitErr != nil {
+		return errors.Wrap(visitErr, "decodeJSON")
+	}
+
+	// Уже разобранная полезная нагрузка дополняется новой, как в SetPayload
+	m.decodePayload()
+	m.lazy = &lazyPayload{}
+
+	if hasPayload {
+		m.lazy.data = append([]byte(nil), data...)
+	}
+
+	return nil
+}
+
+func getString(v *fastjson.Value) (string, error) {
+	if v.Type() == fastjson.TypeNull {
+		return "", nil
+	}
+
+	b, err := v.StringBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// getTime Разбирает время так же, как timestamp.UnmarshalJSON
+func getTime(v *fastjson.Value) (time.Time, error) {
+	switch v.Type() {
+	case fastjson.TypeNull:
+		return time.Time{}, nil
+
+	case fastjson.TypeNumber:
+		ms, err := v.Int64()
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "bad unix milliseconds")
+		}
+
+		return time.UnixMilli(ms), nil
+
+	default:
+		b, err := v.StringBytes()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return ParseTime(string(b))
+	}
+}
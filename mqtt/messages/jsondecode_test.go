@@ -0,0 +1,105 @@
+package messages
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testMessage = []byte(`{"publisher":"object_manager","type":"event","name":"object.sensor.on_check",` +
+	`"target_id":82,"target_type":"object","payload":{"temperature":21.5,"humidity":40,"state":"on",` +
+	`"props":{"period":"10s","enabled":true},"list":[1,"a",null]},` +
+	`"sent_at":"2024-03-01T10:20:30.123456789+03:00","received_at":"","signature":"hmac:abc"}`)
+
+func TestDecodeJSON(t *testing.T) {
+	m := &MessageImpl{}
+	if err := m.UnmarshalJSON(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	switch {
+	case m.GetPublisher() != "object_manager", m.GetType() != MessageTypeEvent, m.GetName() != "object.sensor.on_check",
+		m.GetTargetID() != 82, m.GetTargetType() != TargetTypeObject, m.GetSignature() != "hmac:abc":
+		t.Fatalf("unexpected envelope %+v", m)
+	case m.GetSentAt().UnixNano() != time.Date(2024, 3, 1, 7, 20, 30, 123456789, time.UTC).UnixNano():
+		t.Fatalf("unexpected sent_at %v", m.GetSentAt())
+	case !m.GetReceivedAt().IsZero(), !m.GetExpiresAt().IsZero():
+		t.Fatalf("unexpected received_at %v, expires_at %v", m.GetReceivedAt(), m.GetExpiresAt())
+	case m.payload != nil:
+		t.Fatal("payload is decoded before access")
+	}
+
+	// Полезная нагрузка совпадает с результатом encoding/json
+	want := &message{}
+	if err := json.Unmarshal(testMessage, want); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(m.GetPayload(), want.Payload) {
+		t.Fatalf("got payload %#v, want %#v", m.GetPayload(), want.Payload)
+	}
+
+	if v, err := m.GetFloatValue("temperature"); err != nil || v != 21.5 {
+		t.Fatalf("temperature: got %v, %v", v, err)
+	}
+
+	// Пустая полезная нагрузка
+	m = &MessageImpl{}
+	if err := m.UnmarshalJSON([]byte(`{"type":"command","name":"check","payload":null,"target_id":null}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := m.GetPayload(); p == nil || len(p) != 0 {
+		t.Fatalf("got payload %#v, want empty map", p)
+	}
+
+	for _, data := range []string{
+		`[]`,
+		`{"name":1}`,
+		`{"target_id":"82"}`,
+		`{"target_id":8.2}`,
+		`{"payload":[1]}`,
+		`{"sent_at":"yesterday"}`,
+		`{"name":"check"`,
+	} {
+		if err := (&MessageImpl{}).UnmarshalJSON([]byte(data)); err == nil {
+			t.Fatalf("%s: expected error", data)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	b.Run("encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := &message{}
+			if err := json.Unmarshal(testMessage, m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("fastjson", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Decode(testMessage); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("fastjson+payload", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m, err := Decode(testMessage)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if _, err := m.GetFloatValue("temperature"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
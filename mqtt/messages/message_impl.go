@@ -5,15 +5,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/VladimirDronik/touchon-server/helpers/convert"
 	"github.com/VladimirDronik/touchon-server/info"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 )
 
+// NewFromMQTT Разбирает сообщение шины, определяя формат (JSON, CBOR, MessagePack) автоматически
 func NewFromMQTT(msg mqtt.Message) (Message, error) {
-	m := &MessageImpl{}
-
-	if err := json.Unmarshal(msg.Payload(), m); err != nil {
+	m, err := Decode(msg.Payload())
+	if err != nil {
 		return nil, errors.Wrap(err, "NewFromMQTT")
 	}
 	m.SetTopic(msg.Topic())
@@ -47,17 +48,21 @@ func NewMessage(msgType MessageType, name string, targetType TargetType, targetI
 }
 
 type MessageImpl struct {
-	retained   bool
-	publisher  string
-	topic      string
-	msgType    MessageType // event,command
-	name       string      // onChange,check
-	targetID   int         // 82
-	targetType TargetType
-	payload    map[string]interface{} //
-	qos        QoS
-	sentAt     time.Time
-	receivedAt time.Time
+	retained      bool
+	publisher     string
+	topic         string
+	msgType       MessageType // event,command
+	name          string      // onChange,check
+	targetID      int         // 82
+	targetType    TargetType
+	payload       map[string]interface{} //
+	lazy          *lazyPayload           // Неразобранная полезная нагрузка полученного сообщения
+	qos           QoS
+	sentAt        time.Time
+	receivedAt    time.Time
+	expiresAt     time.Time
+	signature     string
+	correlationID string
 }
 
 func (o *MessageImpl) GetRetained() bool {
@@ -89,6 +94,7 @@ func (o *MessageImpl) GetTargetType() TargetType {
 }
 
 func (o *MessageImpl) GetPayload() map[string]interface{} {
+	o.decodePayload()
 	return o.payload
 }
 
@@ -152,6 +158,8 @@ func (o *MessageImpl) SetTargetType(v TargetType) {
 }
 
 func (o *MessageImpl) SetPayload(v map[string]interface{}) {
+	o.decodePayload()
+
 	if o.payload == nil {
 		o.payload = make(map[string]interface{}, len(v))
 	}
@@ -165,68 +173,103 @@ func (o *MessageImpl) SetQoS(v QoS) {
 	o.qos = v
 }
 
-func (o *MessageImpl) GetFloatValue(name string) (float32, error) {
-	v, ok := o.GetPayload()[name]
+// GetValue Возвращает значение полезной нагрузки по имени или по пути вида "a.b.0"
+func (o *MessageImpl) GetValue(path string) (interface{}, error) {
+	v, ok := convert.Lookup(o.GetPayload(), path)
 	if !ok {
-		return 0, errors.Wrap(errors.Errorf("%s not found", name), "GetFloatValue")
+		return nil, errors.Wrap(errors.Errorf("%s not found", path), "GetValue")
 	}
 
-	switch v := v.(type) {
-	case float32:
-		return v, nil
-	case float64:
-		return float32(v), nil
-	case int:
-		return float32(v), nil
-	default:
-		return 0, errors.Wrap(errors.Errorf("unexpected data type %T", v), "GetFloatValue")
-	}
+	return v, nil
 }
 
-func (o *MessageImpl) GetStringValue(name string) (string, error) {
-	v, ok := o.GetPayload()[name]
-	if !ok {
-		return "", errors.Wrap(errors.Errorf("%s not found", name), "GetStringValue")
+// getValue Возвращает значение полезной нагрузки, приведенное к типу T
+func getValue[T any](o *MessageImpl, path string, conv func(interface{}) (T, error)) (T, error) {
+	var r T
+
+	v, err := o.GetValue(path)
+	if err != nil {
+		return r, err
 	}
 
-	switch v := v.(type) {
-	case string:
-		return v, nil
-	default:
-		return "", errors.Wrap(errors.Errorf("unexpected data type %T", v), "GetStringValue")
+	if r, err = conv(v); err != nil {
+		return r, errors.Wrap(err, path)
 	}
+
+	return r, nil
 }
 
-func (o *MessageImpl) GetIntValue(name string) (int, error) {
-	v, ok := o.GetPayload()[name]
-	if !ok {
-		return 0, errors.Wrap(errors.Errorf("%s not found", name), "GetIntValue")
+// getValueOr Возвращает значение полезной нагрузки, приведенное к типу T, или def
+func getValueOr[T any](o *MessageImpl, path string, def T, conv func(interface{}) (T, error)) T {
+	if r, err := getValue(o, path, conv); err == nil {
+		return r
 	}
 
-	switch v := v.(type) {
-	case float32:
-		return int(v), nil
-	case float64:
-		return int(v), nil
-	case int:
-		return v, nil
-	default:
-		return 0, errors.Wrap(errors.Errorf("unexpected data type %T", v), "GetIntValue")
-	}
+	return def
 }
 
-func (o *MessageImpl) GetBoolValue(name string) (bool, error) {
-	v, ok := o.GetPayload()[name]
-	if !ok {
-		return false, errors.Wrap(errors.Errorf("%s not found", name), "GetBoolValue")
-	}
+func (o *MessageImpl) GetFloatValue(path string) (float32, error) {
+	v, err := getValue(o, path, convert.ToFloat32)
+	return v, errors.Wrap(err, "GetFloatValue")
+}
 
-	switch v := v.(type) {
-	case bool:
-		return v, nil
-	default:
-		return false, errors.Wrap(errors.Errorf("unexpected data type %T", v), "GetBoolValue")
-	}
+func (o *MessageImpl) GetStringValue(path string) (string, error) {
+	v, err := getValue(o, path, convert.ToString)
+	return v, errors.Wrap(err, "GetStringValue")
+}
+
+func (o *MessageImpl) GetIntValue(path string) (int, error) {
+	v, err := getValue(o, path, convert.ToInt)
+	return v, errors.Wrap(err, "GetIntValue")
+}
+
+func (o *MessageImpl) GetBoolValue(path string) (bool, error) {
+	v, err := getValue(o, path, convert.ToBool)
+	return v, errors.Wrap(err, "GetBoolValue")
+}
+
+func (o *MessageImpl) GetTimeValue(path string) (time.Time, error) {
+	v, err := getValue(o, path, convert.ToTime)
+	return v, errors.Wrap(err, "GetTimeValue")
+}
+
+func (o *MessageImpl) GetDurationValue(path string) (time.Duration, error) {
+	v, err := getValue(o, path, convert.ToDuration)
+	return v, errors.Wrap(err, "GetDurationValue")
+}
+
+func (o *MessageImpl) GetListValue(path string) ([]interface{}, error) {
+	v, err := getValue(o, path, convert.ToSlice)
+	return v, errors.Wrap(err, "GetListValue")
+}
+
+func (o *MessageImpl) GetMapValue(path string) (map[string]interface{}, error) {
+	v, err := getValue(o, path, convert.ToMap)
+	return v, errors.Wrap(err, "GetMapValue")
+}
+
+func (o *MessageImpl) GetFloatValueOr(path string, def float32) float32 {
+	return getValueOr(o, path, def, convert.ToFloat32)
+}
+
+func (o *MessageImpl) GetStringValueOr(path string, def string) string {
+	return getValueOr(o, path, def, convert.ToString)
+}
+
+func (o *MessageImpl) GetIntValueOr(path string, def int) int {
+	return getValueOr(o, path, def, convert.ToInt)
+}
+
+func (o *MessageImpl) GetBoolValueOr(path string, def bool) bool {
+	return getValueOr(o, path, def, convert.ToBool)
+}
+
+func (o *MessageImpl) GetTimeValueOr(path string, def time.Time) time.Time {
+	return getValueOr(o, path, def, convert.ToTime)
+}
+
+func (o *MessageImpl) GetDurationValueOr(path string, def time.Duration) time.Duration {
+	return getValueOr(o, path, def, convert.ToDuration)
 }
 
 func (o *MessageImpl) GetSentAt() time.Time {
@@ -245,57 +288,61 @@ func (o *MessageImpl) SetReceivedAt(v time.Time) {
 	o.receivedAt = v
 }
 
-const TimeLabelFormat = "02.01.2006 15:04:05.000000 MST"
+func (o *MessageImpl) GetExpiresAt() time.Time {
+	return o.expiresAt
+}
 
-func (o *MessageImpl) MarshalJSON() ([]byte, error) {
-	m := &message{
-		Publisher:  o.GetPublisher(),
-		Type:       o.GetType(),
-		Name:       o.GetName(),
-		TargetID:   o.GetTargetID(),
-		TargetType: o.GetTargetType(),
-		Payload:    o.GetPayload(),
-	}
+func (o *MessageImpl) SetExpiresAt(v time.Time) {
+	o.expiresAt = v
+}
 
-	if !o.GetSentAt().IsZero() {
-		m.SentAt = o.GetSentAt().Format(TimeLabelFormat)
-	}
+func (o *MessageImpl) GetSignature() string {
+	return o.signature
+}
+
+func (o *MessageImpl) SetSignature(v string) {
+	o.signature = v
+}
 
-	if !o.GetReceivedAt().IsZero() {
-		m.ReceivedAt = o.GetReceivedAt().Format(TimeLabelFormat)
+func (o *MessageImpl) GetCorrelationID() string {
+	return o.correlationID
+}
+
+func (o *MessageImpl) SetCorrelationID(v string) {
+	o.correlationID = v
+}
+
+func (o *MessageImpl) MarshalJSON() ([]byte, error) {
+	m := &message{
+		Publisher:     o.GetPublisher(),
+		Type:          o.GetType(),
+		Name:          o.GetName(),
+		TargetID:      o.GetTargetID(),
+		TargetType:    o.GetTargetType(),
+		Payload:       o.GetPayload(),
+		SentAt:        timestamp(o.GetSentAt()),
+		ReceivedAt:    timestamp(o.GetReceivedAt()),
+		Signature:     o.GetSignature(),
+		CorrelationID: o.GetCorrelationID(),
 	}
 
 	if len(m.Payload) == 0 {
 		m.Payload = nil
 	}
 
+	if !o.GetExpiresAt().IsZero() {
+		expiresAt := timestamp(o.GetExpiresAt())
+		m.ExpiresAt = &expiresAt
+	}
+
 	return json.Marshal(m)
 }
 
 func (o *MessageImpl) UnmarshalJSON(data []byte) error {
-	m := &message{}
-
-	if err := json.Unmarshal(data, m); err != nil {
+	if err := decodeJSON(data, o); err != nil {
 		return errors.Wrap(err, "MessageImpl.UnmarshalJSON")
 	}
 
-	o.SetPublisher(m.Publisher)
-	o.SetType(m.Type)
-	o.SetName(m.Name)
-	o.SetTargetID(m.TargetID)
-	o.SetTargetType(m.TargetType)
-	o.SetPayload(m.Payload)
-
-	sentAt, err := time.Parse(TimeLabelFormat, m.SentAt)
-	if err == nil {
-		o.SetSentAt(sentAt)
-	}
-
-	receivedAt, err := time.Parse(TimeLabelFormat, m.ReceivedAt)
-	if err == nil {
-		o.SetReceivedAt(receivedAt)
-	}
-
 	return nil
 }
 
@@ -305,12 +352,15 @@ func (o *MessageImpl) String() string {
 }
 
 type message struct {
-	Publisher  string                 `json:"publisher"`
-	Type       MessageType            `json:"type"`
-	Name       string                 `json:"name"`
-	TargetID   int                    `json:"target_id,omitempty"`
-	TargetType TargetType             `json:"target_type,omitempty"`
-	Payload    map[string]interface{} `json:"payload,omitempty"`
-	SentAt     string                 `json:"sent_at"`
-	ReceivedAt string                 `json:"received_at"`
+	Publisher     string                 `json:"publisher"`
+	Type          MessageType            `json:"type"`
+	Name          string                 `json:"name"`
+	TargetID      int                    `json:"target_id,omitempty"`
+	TargetType    TargetType             `json:"target_type,omitempty"`
+	Payload       map[string]interface{} `json:"payload,omitempty"`
+	SentAt        timestamp              `json:"sent_at"`
+	ReceivedAt    timestamp              `json:"received_at"`
+	ExpiresAt     *timestamp             `json:"expires_at,omitempty"`
+	Signature     string                 `json:"signature,omitempty"`
+	CorrelationID string                 `json:"correlation_id,omitempty"`
 }
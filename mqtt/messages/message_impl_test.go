@@ -0,0 +1,58 @@
+package messages
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageImpl_Values(t *testing.T) {
+	m := &MessageImpl{}
+	if err := m.UnmarshalJSON([]byte(`{"type":"command","name":"set","payload":{"level":"5","ratio":2,` +
+		`"enabled":"true","delay":"1m","props":{"period":10,"ids":[1,2]}}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := m.GetIntValue("level"); err != nil || v != 5 {
+		t.Fatalf("level: got %v, %v", v, err)
+	}
+
+	if v, err := m.GetFloatValue("ratio"); err != nil || v != 2 {
+		t.Fatalf("ratio: got %v, %v", v, err)
+	}
+
+	if v, err := m.GetBoolValue("enabled"); err != nil || !v {
+		t.Fatalf("enabled: got %v, %v", v, err)
+	}
+
+	if v, err := m.GetDurationValue("delay"); err != nil || v != time.Minute {
+		t.Fatalf("delay: got %v, %v", v, err)
+	}
+
+	if v, err := m.GetDurationValue("props.period"); err != nil || v != 10*time.Second {
+		t.Fatalf("props.period: got %v, %v", v, err)
+	}
+
+	if v, err := m.GetIntValue("props.ids.1"); err != nil || v != 2 {
+		t.Fatalf("props.ids.1: got %v, %v", v, err)
+	}
+
+	if v, err := m.GetListValue("props.ids"); err != nil || len(v) != 2 {
+		t.Fatalf("props.ids: got %v, %v", v, err)
+	}
+
+	if _, err := m.GetIntValue("missing"); err == nil {
+		t.Fatal("missing: expected error")
+	}
+
+	if v := m.GetIntValueOr("missing", 7); v != 7 {
+		t.Fatalf("missing: got %v, want default", v)
+	}
+
+	if v := m.GetBoolValueOr("level", true); !v {
+		t.Fatalf("level as bool: got %v, want default", v)
+	}
+
+	if v := m.GetStringValueOr("level", ""); v != "5" {
+		t.Fatalf("level as string: got %q", v)
+	}
+}
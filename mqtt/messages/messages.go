@@ -1,6 +1,8 @@
 package messages
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -67,21 +69,73 @@ type Message interface {
 	SetPayload(map[string]interface{})
 	SetQoS(QoS)
 
-	GetFloatValue(name string) (float32, error)
-	GetStringValue(name string) (string, error)
-	GetIntValue(name string) (int, error)
-	GetBoolValue(name string) (bool, error)
+	// Значения полезной нагрузки по имени или по пути вида "a.b.0" (правила приведения типов см. в пакете helpers/convert)
+	GetValue(path string) (interface{}, error)
+	GetFloatValue(path string) (float32, error)
+	GetStringValue(path string) (string, error)
+	GetIntValue(path string) (int, error)
+	GetBoolValue(path string) (bool, error)
+	GetTimeValue(path string) (time.Time, error)
+	GetDurationValue(path string) (time.Duration, error)
+	GetListValue(path string) ([]interface{}, error)
+	GetMapValue(path string) (map[string]interface{}, error)
+
+	// Значения полезной нагрузки или def, если значения нет или его нельзя привести к типу
+	GetFloatValueOr(path string, def float32) float32
+	GetStringValueOr(path string, def string) string
+	GetIntValueOr(path string, def int) int
+	GetBoolValueOr(path string, def bool) bool
+	GetTimeValueOr(path string, def time.Time) time.Time
+	GetDurationValueOr(path string, def time.Duration) time.Duration
 
 	GetSentAt() time.Time
 	SetSentAt(time.Time)
 	GetReceivedAt() time.Time
 	SetReceivedAt(time.Time)
+	GetExpiresAt() time.Time // Время, после которого сообщение не должно обрабатываться (нулевое - без ограничения)
+	SetExpiresAt(time.Time)
+	GetSignature() string // Подпись конверта сообщения (см. пакет mqtt/signature)
+	SetSignature(string)
+	GetCorrelationID() string // ID запроса, на который отвечает сообщение (см. Correlate)
+	SetCorrelationID(string)
 
 	json.Marshaler
 	json.Unmarshaler
 	fmt.Stringer
 }
 
+// TTL Время жизни сообщений по типу, применяется при отправке сообщений без expires_at.
+// Задается клиенту шины (см. mqtt/client.Client.SetTTL, настройки mqtt_command_ttl, mqtt_event_ttl).
+type TTL map[MessageType]time.Duration
+
+// Apply Выставляет время истечения сообщения, если оно не задано и для типа сообщения задано время жизни
+func (o TTL) Apply(msg Message) {
+	if !msg.GetExpiresAt().IsZero() {
+		return
+	}
+
+	if ttl := o[msg.GetType()]; ttl > 0 {
+		msg.SetExpiresAt(msg.GetSentAt().Add(ttl))
+	}
+}
+
+// IsExpired Проверяет, истекло ли время жизни сообщения на момент now
+func IsExpired(msg Message, now time.Time) bool {
+	return !msg.GetExpiresAt().IsZero() && now.After(msg.GetExpiresAt())
+}
+
+// Correlate Копирует в ответ ID корреляции запроса, чтобы отправитель мог сопоставить ответ со своей командой
+func Correlate(reply, request Message) {
+	reply.SetCorrelationID(request.GetCorrelationID())
+}
+
+// NewCorrelationID Возвращает случайный ID корреляции для команды, ответ на которую нужно дождаться
+func NewCorrelationID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func NewCommand(method string, targetType TargetType, targetID int, methodArgs map[string]interface{}) (Message, error) {
 	m, err := NewMessage(MessageTypeCommand, method, targetType, targetID, methodArgs)
 	if err != nil {
@@ -0,0 +1,86 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeFormat Формат времени в сообщениях (sent_at, received_at)
+const TimeFormat = time.RFC3339Nano
+
+// TimeLabelFormat Прежний формат времени в сообщениях.
+//
+// Deprecated: аббревиатуры часовых поясов неоднозначны, используйте TimeFormat.
+// Сообщения в прежнем формате по-прежнему принимаются.
+const TimeLabelFormat = "02.01.2006 15:04:05.000000 MST"
+
+// timestamp Время в конверте сообщения. Записывается в формате TimeFormat,
+// читается в форматах TimeFormat, TimeLabelFormat и как unix-время в миллисекундах.
+type timestamp time.Time
+
+func (o timestamp) MarshalJSON() ([]byte, error) {
+	t := time.Time(o)
+	if t.IsZero() {
+		return []byte(`""`), nil
+	}
+
+	return json.Marshal(t.Format(TimeFormat))
+}
+
+func (o *timestamp) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) || bytes.Equal(data, []byte(`""`)) {
+		*o = timestamp{}
+		return nil
+	}
+
+	// Unix-время в миллисекундах
+	if data[0] != '"' {
+		ms, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "timestamp.UnmarshalJSON: bad unix milliseconds %s", data)
+		}
+
+		*o = timestamp(time.UnixMilli(ms))
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrap(err, "timestamp.UnmarshalJSON")
+	}
+
+	t, err := ParseTime(s)
+	if err != nil {
+		return errors.Wrap(err, "timestamp.UnmarshalJSON")
+	}
+
+	*o = timestamp(t)
+
+	return nil
+}
+
+// ParseTime Разбирает время в формате TimeFormat или в прежнем формате TimeLabelFormat
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(TimeFormat, s)
+	if err == nil {
+		return t, nil
+	}
+
+	// Аббревиатура часового пояса в прежнем формате определяется по локальному поясу
+	t, legacyErr := time.ParseInLocation(TimeLabelFormat, s, time.Local)
+	if legacyErr == nil {
+		return t, nil
+	}
+
+	return time.Time{}, errors.Wrap(errors.Errorf("bad time %q, expected RFC3339 or %q", s, TimeLabelFormat), "ParseTime")
+}
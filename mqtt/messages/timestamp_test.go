@@ -0,0 +1,49 @@
+package messages
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageImpl_Timestamps(t *testing.T) {
+	sentAt := time.Date(2024, 3, 1, 10, 20, 30, 123456789, time.FixedZone("", 3*3600))
+
+	m := &MessageImpl{msgType: MessageTypeEvent, name: "on_change"}
+	m.SetSentAt(sentAt)
+
+	data, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(data), `"sent_at":"2024-03-01T10:20:30.123456789+03:00"`) {
+		t.Fatalf("unexpected sent_at in %s", data)
+	}
+
+	tests := []struct {
+		data string
+		want time.Time
+	}{
+		{`{"sent_at":"2024-03-01T10:20:30.123456789+03:00"}`, sentAt},
+		{`{"sent_at":1709277630123}`, time.UnixMilli(1709277630123)},
+		{`{"sent_at":"01.03.2024 07:20:30.123456 UTC"}`, time.Date(2024, 3, 1, 7, 20, 30, 123456000, time.UTC)},
+		{`{"sent_at":""}`, time.Time{}},
+		{`{}`, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		m := &MessageImpl{}
+		if err := m.UnmarshalJSON([]byte(tt.data)); err != nil {
+			t.Fatalf("%s: %v", tt.data, err)
+		}
+
+		if !m.GetSentAt().Equal(tt.want) {
+			t.Fatalf("%s: sent_at = %s, want %s", tt.data, m.GetSentAt(), tt.want)
+		}
+	}
+
+	if err := (&MessageImpl{}).UnmarshalJSON([]byte(`{"sent_at":"yesterday"}`)); err == nil {
+		t.Fatal("bad sent_at must fail")
+	}
+}
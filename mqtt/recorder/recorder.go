@@ -0,0 +1,197 @@
+// Пакет записи трафика шины в файл и воспроизведения записи.
+// Используется для воспроизведения плавающих ошибок: запись снимается на объекте,
+// затем проигрывается на стенде (через брокер или шину в памяти процесса).
+//
+// Формат записи - JSONL, одна строка на сообщение:
+//
+//	{"topic":"object_manager/event/relay","qos":0,"retained":false,"received_at":"...","message":{...}}
+
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Record Записанное сообщение шины
+type Record struct {
+	Topic      string          `json:"topic"`
+	QoS        messages.QoS    `json:"qos"`
+	Retained   bool            `json:"retained"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Message    json.RawMessage `json:"message"`
+}
+
+// Decode Восстанавливает сообщение из записи
+func (o *Record) Decode() (messages.Message, error) {
+	m := &messages.MessageImpl{}
+	if err := m.UnmarshalJSON(o.Message); err != nil {
+		return nil, errors.Wrap(err, "Record.Decode")
+	}
+
+	m.SetTopic(o.Topic)
+	m.SetQoS(o.QoS)
+	m.SetRetained(o.Retained)
+	m.SetReceivedAt(o.ReceivedAt)
+
+	return m, nil
+}
+
+// NewRecorder Создает рекордер, который пишет сообщения из топиков topic (по умолчанию #) в w.
+// Чтобы в запись попадали сообщения своего сервиса, у клиента нужно отключить IgnoreSelfMsgs.
+func NewRecorder(client mqtt.Client, w io.Writer, topic string, logger *logrus.Logger) (*Recorder, error) {
+	switch {
+	case client == nil:
+		return nil, errors.Wrap(errors.New("client is nil"), "NewRecorder")
+	case w == nil:
+		return nil, errors.Wrap(errors.New("writer is nil"), "NewRecorder")
+	case logger == nil:
+		return nil, errors.Wrap(errors.New("logger is nil"), "NewRecorder")
+	}
+
+	if topic == "" {
+		topic = "#"
+	}
+
+	return &Recorder{
+		client: client,
+		w:      bufio.NewWriter(w),
+		topic:  topic,
+		logger: logger,
+	}, nil
+}
+
+type Recorder struct {
+	client mqtt.Client
+	w      *bufio.Writer
+	topic  string
+	logger *logrus.Logger
+	sub    *mqtt.Subscription
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	count   int // Количество записанных сообщений
+	skipped int // Количество пропущенных сообщений (не являющихся сообщениями шины)
+}
+
+func (o *Recorder) Start() error {
+	sub, err := o.client.Subscribe(o.topic, 1000)
+	if err != nil {
+		return errors.Wrap(err, "Recorder.Start")
+	}
+
+	o.sub = sub
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+
+		for msg := range sub.C() {
+			if err := o.write(msg.Topic(), messages.QoS(msg.Qos()), msg.Retained(), msg.Payload()); err != nil {
+				o.logger.Error(errors.Wrap(err, "Recorder"))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown Прекращает запись и сбрасывает буфер
+func (o *Recorder) Shutdown() error {
+	if err := o.sub.Unsubscribe(); err != nil {
+		return errors.Wrap(err, "Recorder.Shutdown")
+	}
+
+	o.wg.Wait()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.w.Flush(); err != nil {
+		return errors.Wrap(err, "Recorder.Shutdown")
+	}
+
+	return nil
+}
+
+// GetCount Возвращает количество записанных и пропущенных сообщений
+func (o *Recorder) GetCount() (int, int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count, o.skipped
+}
+
+func (o *Recorder) write(topic string, qos messages.QoS, retained bool, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Пишем только сообщения шины (в запись сообщение попадает в JSON, независимо от формата в шине)
+	m, err := messages.Decode(payload)
+	if err != nil {
+		o.skipped++
+		o.logger.Debugf("Recorder: skip [%s] %s", topic, string(payload))
+		return nil
+	}
+
+	msg, err := m.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "write")
+	}
+
+	data, err := json.Marshal(&Record{
+		Topic:      topic,
+		QoS:        qos,
+		Retained:   retained,
+		ReceivedAt: time.Now(),
+		Message:    msg,
+	})
+	if err != nil {
+		return errors.Wrap(err, "write")
+	}
+
+	if _, err := o.w.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "write")
+	}
+
+	o.count++
+
+	return nil
+}
+
+// ReadRecords Читает запись
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	var records []*Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return nil, errors.Wrapf(err, "ReadRecords: line %d", line)
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "ReadRecords")
+	}
+
+	return records, nil
+}
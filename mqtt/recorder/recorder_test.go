@@ -0,0 +1,83 @@
+package recorder_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/client/clienttest"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/VladimirDronik/touchon-server/mqtt/recorder"
+)
+
+func TestRecordReplay(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := client.NewBus()
+	pub := bus.NewClient("pub", "object_manager", "")
+	rc := bus.NewClient("recorder", "recorder", "")
+
+	buf := &bytes.Buffer{}
+	rec, err := recorder.NewRecorder(rc, buf, "#", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rec.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"object.relay.on_state_on", "object.relay.on_state_off", "object.relay.on_state_on"} {
+		msg, err := messages.NewEvent(name, messages.TargetTypeObject, i+1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.SetTopic("object_manager/event/relay")
+
+		if err := pub.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Не сообщение шины - не записывается
+	if err := pub.SendRaw("object_manager/raw", messages.QoSNotGuaranteed, false, []byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err := rec.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, skipped := rec.GetCount(); count != 3 || skipped != 1 {
+		t.Fatalf("count = %d, skipped = %d, want 3, 1", count, skipped)
+	}
+
+	records, err := recorder.ReadRecords(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayBus := client.NewBus()
+	sender := replayBus.NewClient("replayer", "replayer", "")
+
+	opts := &recorder.ReplayOptions{Speed: 10, Topics: []string{"object_manager/event/+"}, Names: []string{"object.relay.on_state_on"}}
+	sent, err := recorder.Replay(context.Background(), sender, records, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 2 {
+		t.Fatalf("sent = %d, want 2", sent)
+	}
+
+	clienttest.ExpectEvent(t, replayBus, "object.relay.on_state_on", 3, time.Second)
+	clienttest.ExpectNone(t, replayBus, 10*time.Millisecond, clienttest.Name("object.relay.on_state_off"))
+}
@@ -0,0 +1,116 @@
+package recorder
+
+import (
+	"context"
+	"time"
+
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/pkg/errors"
+)
+
+// ReplayOptions Параметры воспроизведения
+type ReplayOptions struct {
+	// Speed Скорость воспроизведения: 1 - оригинальный темп, 2 - в два раза быстрее,
+	// 0 - без пауз между сообщениями.
+	Speed float64
+
+	// Topics Фильтры топиков (допускаются + и #). Если не заданы, воспроизводятся все топики.
+	Topics []string
+
+	// Names Названия событий и команд. Если не заданы, воспроизводятся все сообщения.
+	Names []string
+}
+
+func (o *ReplayOptions) match(rec *Record, name string) bool {
+	if len(o.Topics) > 0 {
+		found := false
+		for _, filter := range o.Topics {
+			if topics.TopicMatch(filter, rec.Topic) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(o.Names) > 0 {
+		for _, v := range o.Names {
+			if v == name {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// Replay Публикует записанные сообщения, сохраняя интервалы между ними (с учетом скорости).
+// Время отправки сообщений заменяется на текущее. Возвращает количество опубликованных сообщений.
+func Replay(ctx context.Context, client mqtt.Client, records []*Record, opts *ReplayOptions) (int, error) {
+	if opts == nil {
+		opts = &ReplayOptions{Speed: 1}
+	}
+
+	if opts.Speed < 0 {
+		return 0, errors.Wrap(errors.Errorf("bad speed %v", opts.Speed), "Replay")
+	}
+
+	start := time.Now()
+	var first time.Time
+	sent := 0
+
+	for _, rec := range records {
+		msg, err := rec.Decode()
+		if err != nil {
+			return sent, errors.Wrap(err, "Replay")
+		}
+
+		if !opts.match(rec, msg.GetName()) {
+			continue
+		}
+
+		// Время получения проставит получатель воспроизведенного сообщения,
+		// время жизни отсчитывается от момента повторной отправки,
+		// подпись прежнего конверта недействительна (при необходимости сообщение подпишет клиент)
+		msg.SetReceivedAt(time.Time{})
+		msg.SetExpiresAt(time.Time{})
+		msg.SetSignature("")
+
+		if first.IsZero() {
+			first = rec.ReceivedAt
+		}
+
+		if opts.Speed > 0 {
+			offset := time.Duration(float64(rec.ReceivedAt.Sub(first)) / opts.Speed)
+			if d := time.Until(start.Add(offset)); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					return sent, ctx.Err()
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		default:
+		}
+
+		if err := client.Send(msg); err != nil {
+			return sent, errors.Wrap(err, "Replay")
+		}
+
+		sent++
+	}
+
+	return sent, nil
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/events"
+	"github.com/VladimirDronik/touchon-server/info"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultClockSkewWindow    = 50              // Количество последних сообщений отправителя для оценки расхождения
+	DefaultClockSkewThreshold = 5 * time.Second // Расхождение, при котором отправляется уведомление
+	clockSkewMinSamples       = 5               // Минимальное количество сообщений для оценки
+)
+
+func newClockSkewDetector(cfg map[string]string) (*clockSkewDetector, error) {
+	o := &clockSkewDetector{
+		window:     DefaultClockSkewWindow,
+		threshold:  DefaultClockSkewThreshold,
+		publishers: make(map[string]*skewWindow),
+	}
+
+	if v := cfg["mqtt_clock_skew_window"]; v != "" {
+		window, err := strconv.Atoi(v)
+		if err != nil || window < 1 {
+			return nil, errors.Wrap(errors.Errorf("bad mqtt_clock_skew_window %q", v), "newClockSkewDetector")
+		}
+
+		o.window = window
+	}
+
+	if v := cfg["mqtt_clock_skew_threshold"]; v != "" {
+		threshold, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "newClockSkewDetector")
+		}
+
+		o.threshold = threshold
+	}
+
+	return o, nil
+}
+
+// clockSkewDetector Оценивает расхождение часов с отправителями сообщений.
+// Расхождение - медиана времени доставки последних сообщений отправителя:
+// задержка доставки в локальной сети мала, поэтому большие (или отрицательные)
+// значения означают, что часы отправителя и получателя расходятся.
+type clockSkewDetector struct {
+	mu         sync.Mutex
+	window     int
+	threshold  time.Duration
+	publishers map[string]*skewWindow
+}
+
+type skewWindow struct {
+	samples  []time.Duration // Кольцевой буфер времени доставки
+	next     int
+	offset   time.Duration
+	alerted  bool // Уведомление о расхождении уже отправлено
+	lastSeen time.Time
+}
+
+// ClockSkew Оценка расхождения часов с отправителем.
+// Положительное значение - часы отправителя отстают, отрицательное - спешат.
+type ClockSkew struct {
+	Offset   string
+	Samples  int
+	Exceeded bool // Расхождение превышает mqtt_clock_skew_threshold
+	LastSeen string
+}
+
+// observe Учитывает время доставки сообщения отправителя. Возвращает оценку расхождения
+// и признак того, что расхождение только что превысило порог.
+func (o *clockSkewDetector) observe(publisher string, travelTime time.Duration) (time.Duration, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	w, ok := o.publishers[publisher]
+	if !ok {
+		w = &skewWindow{samples: make([]time.Duration, 0, o.window)}
+		o.publishers[publisher] = w
+	}
+
+	if len(w.samples) < o.window {
+		w.samples = append(w.samples, travelTime)
+	} else {
+		w.samples[w.next] = travelTime
+		w.next = (w.next + 1) % o.window
+	}
+
+	w.lastSeen = time.Now()
+	w.offset = median(w.samples)
+
+	if len(w.samples) < min(clockSkewMinSamples, o.window) {
+		return w.offset, false
+	}
+
+	exceeded := abs(w.offset) > o.threshold
+
+	switch {
+	case exceeded && !w.alerted:
+		w.alerted = true
+		return w.offset, true
+
+	case !exceeded && w.alerted && abs(w.offset) < o.threshold/2:
+		// Повторно уведомляем только после того, как часы синхронизировались
+		w.alerted = false
+	}
+
+	return w.offset, false
+}
+
+func (o *clockSkewDetector) get() map[string]*ClockSkew {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	r := make(map[string]*ClockSkew, len(o.publishers))
+	for publisher, w := range o.publishers {
+		r[publisher] = &ClockSkew{
+			Offset:   w.offset.Round(time.Millisecond).String(),
+			Samples:  len(w.samples),
+			Exceeded: w.alerted,
+			LastSeen: w.lastSeen.Format("02.01.2006 15:04:05"),
+		}
+	}
+
+	return r
+}
+
+func median(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
+
+// GetClockSkew Возвращает оценки расхождения часов по отправителям
+func (o *Service) GetClockSkew() map[string]*ClockSkew {
+	return o.clockSkew.get()
+}
+
+// sendClockSkewNotify Уведомляет о расхождении часов с отправителем
+func (o *Service) sendClockSkewNotify(publisher string, offset time.Duration) {
+	text := fmt.Sprintf("Расхождение часов сервисов %s и %s: %s", info.Name, publisher, offset.Round(time.Millisecond))
+	o.logger.Warn("MQTT: " + text)
+
+	msg, err := events.NewOnNotifyMessage(info.Name+"/"+topics.TopicEvent+"/service", text, events.NotifyTypeCritical)
+	if err != nil {
+		o.logger.Error(errors.Wrap(err, "sendClockSkewNotify"))
+		return
+	}
+
+	if err := o.client.Send(msg); err != nil {
+		o.logger.Error(errors.Wrap(err, "sendClockSkewNotify"))
+	}
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockSkewDetector(t *testing.T) {
+	d, err := newClockSkewDetector(map[string]string{"mqtt_clock_skew_window": "5", "mqtt_clock_skew_threshold": "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Часы отправителя спешат на 3 секунды, один выброс не влияет на оценку
+	alerts := 0
+	for _, v := range []time.Duration{-3 * time.Second, -3 * time.Second, time.Second, -3 * time.Second, -3 * time.Second, -3 * time.Second} {
+		if _, exceeded := d.observe("object_manager", v); exceeded {
+			alerts++
+		}
+	}
+
+	if alerts != 1 {
+		t.Fatalf("alerts = %d, want 1", alerts)
+	}
+
+	if s := d.get()["object_manager"]; s.Offset != "-3s" || !s.Exceeded {
+		t.Fatalf("unexpected skew %+v", s)
+	}
+
+	// После синхронизации часов уведомление отправляется повторно
+	for i := 0; i < 5; i++ {
+		d.observe("object_manager", 10*time.Millisecond)
+	}
+
+	if d.get()["object_manager"].Exceeded {
+		t.Fatal("skew must be reset")
+	}
+
+	alerts = 0
+	for i := 0; i < 5; i++ {
+		if _, exceeded := d.observe("object_manager", 2*time.Second); exceeded {
+			alerts++
+		}
+	}
+
+	if alerts != 1 {
+		t.Fatalf("alerts = %d, want 1", alerts)
+	}
+}
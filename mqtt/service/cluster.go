@@ -0,0 +1,91 @@
+package service
+
+import (
+	"time"
+
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultClusterInfoTimeout = 2 * time.Second  // Время ожидания ответов сервисов по умолчанию
+	MaxClusterInfoTimeout     = 10 * time.Second // Максимальное время ожидания ответов
+)
+
+// ClusterInfo Сводная информация о сервисах, ответивших на запрос
+type ClusterInfo struct {
+	RequestedAt string
+	Timeout     string
+	Services    map[string][]interface{} // Название сервиса -> информация о репликах сервиса
+}
+
+// CollectClusterInfo Отправляет всем сервисам команду info и собирает ответы, пришедшие в течение timeout
+// (не больше MaxClusterInfoTimeout). Ответы на другие запросы отбрасываются по ID корреляции,
+// поэтому сборы могут выполняться одновременно.
+func CollectClusterInfo(client mqtt.Client, timeout time.Duration) (*ClusterInfo, error) {
+	if client == nil {
+		return nil, errors.Wrap(errors.New("client is nil"), "CollectClusterInfo")
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultClusterInfoTimeout
+	}
+
+	timeout = min(timeout, MaxClusterInfoTimeout)
+
+	replies, err := client.Subscribe(topics.TopicServiceInfo, 100)
+	if err != nil {
+		return nil, errors.Wrap(err, "CollectClusterInfo")
+	}
+
+	// Отменяем только свою подписку, другие подписчики service/info продолжают получать ответы
+	defer func() { _ = replies.Unsubscribe() }()
+
+	cmd, err := messages.NewCommand("info", messages.TargetTypeService, 0, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "CollectClusterInfo")
+	}
+
+	cmd.SetTopic(topics.TopicServiceCommand)
+	cmd.SetCorrelationID(messages.NewCorrelationID())
+
+	requestedAt := time.Now()
+	if err := client.Send(cmd); err != nil {
+		return nil, errors.Wrap(err, "CollectClusterInfo")
+	}
+
+	r := &ClusterInfo{
+		RequestedAt: requestedAt.Format("02.01.2006 15:04:05"),
+		Timeout:     timeout.String(),
+		Services:    make(map[string][]interface{}),
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case msg, ok := <-replies.C():
+			if !ok {
+				return r, nil
+			}
+
+			m, err := messages.NewFromMQTT(msg)
+			if err != nil {
+				continue
+			}
+
+			if m.GetName() != "service.on_info" || m.GetPublisher() == "" || m.GetCorrelationID() != cmd.GetCorrelationID() {
+				continue
+			}
+
+			// Реплики сервиса отвечают под одним названием
+			r.Services[m.GetPublisher()] = append(r.Services[m.GetPublisher()], m.GetPayload()["info"])
+
+		case <-t.C:
+			return r, nil
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/events"
+	"github.com/VladimirDronik/touchon-server/info"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+// parseTTL Разбирает время жизни отправляемых сообщений по умолчанию
+// из настроек mqtt_command_ttl и mqtt_event_ttl (пусто или 0 - без ограничения).
+func parseTTL(cfg map[string]string) (messages.TTL, error) {
+	r := messages.TTL{}
+
+	for msgType, key := range map[messages.MessageType]string{
+		messages.MessageTypeCommand: "mqtt_command_ttl",
+		messages.MessageTypeEvent:   "mqtt_event_ttl",
+	} {
+		v := cfg[key]
+		if v == "" {
+			continue
+		}
+
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parseTTL(%s)", key)
+		}
+
+		r[msgType] = ttl
+	}
+
+	return r, nil
+}
+
+// processExpired Отбрасывает просроченное сообщение. Сообщение могло долго ждать в очереди брокера
+// (например, во время потери связи), и его выполнение сейчас может навредить.
+func (o *Service) processExpired(m messages.Message) {
+	o.metrics.expired.With(metricName(m)).Inc()
+
+	lateness := m.GetReceivedAt().Sub(m.GetExpiresAt()).Round(time.Millisecond)
+	o.logger.Warnf("MQTT: [%s] %s %q отброшено, время жизни истекло %s назад", m.GetTopic(), m.GetType(), m.GetName(), lateness)
+
+	if !o.reportExpired {
+		return
+	}
+
+	text := fmt.Sprintf("%s %q от %s отброшено: время жизни истекло %s назад", m.GetType(), m.GetName(), m.GetPublisher(), lateness)
+
+	msg, err := events.NewOnErrorMessage(info.Name+"/"+topics.TopicEvent+"/service", m.GetTargetType(), m.GetTargetID(), text)
+	if err != nil {
+		o.logger.Error(errors.Wrap(err, "processExpired"))
+		return
+	}
+
+	if err := o.client.Send(msg); err != nil {
+		o.logger.Error(errors.Wrap(err, "processExpired"))
+	}
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/event"
+	"github.com/VladimirDronik/touchon-server/events/service"
+	"github.com/VladimirDronik/touchon-server/metrics"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+// Интервал отправки сводки метрик в шину по умолчанию (0 - не отправлять).
+// Включается настройкой mqtt_metrics_interval.
+const DefaultMetricsInterval time.Duration = 0
+
+// Виды ошибок обработки сообщений
+const (
+	ErrorKindDecode  = "decode"  // Сообщение не удалось разобрать
+	ErrorKindHandler = "handler" // Обработчик вернул ошибку
+)
+
+// OtherMetricName Название в метриках для незарегистрированных событий
+const OtherMetricName = "other"
+
+func newServiceMetrics() *serviceMetrics {
+	return &serviceMetrics{
+		travelTime:   metrics.NewHistogram(),
+		handlingTime: metrics.NewHistogram(),
+		received:     metrics.NewCounterVec(),
+		errors:       metrics.NewCounterVec(),
+		expired:      metrics.NewCounterVec(),
+	}
+}
+
+type serviceMetrics struct {
+	travelTime   *metrics.Histogram  // Время доставки сообщений
+	handlingTime *metrics.Histogram  // Время обработки сообщений обработчиком сервиса
+	received     *metrics.CounterVec // Количество принятых сообщений по названию события или команды
+	errors       *metrics.CounterVec // Количество ошибок по виду
+	expired      *metrics.CounterVec // Количество отброшенных просроченных сообщений по названию
+	slow         metrics.Counter     // Количество сообщений, доставленных дольше mqtt_max_travel_time
+}
+
+// Metrics Метрики обработки сообщений сервисом
+type Metrics struct {
+	TravelTime   *metrics.HistogramSnapshot `json:"travel_time"`   // Время доставки, сек
+	HandlingTime *metrics.HistogramSnapshot `json:"handling_time"` // Время обработки, сек
+	Received     map[string]uint64          `json:"received"`      // Принятые сообщения по названию
+	Errors       map[string]uint64          `json:"errors"`        // Ошибки по виду
+	Expired      map[string]uint64          `json:"expired"`       // Отброшенные просроченные сообщения по названию
+	SlowMessages uint64                     `json:"slow_messages"` // Сообщения, доставленные дольше mqtt_max_travel_time
+}
+
+// metricName Возвращает название сообщения для метрик. Незарегистрированные события
+// собираются под общим названием other, чтобы не плодить метки.
+func metricName(m messages.Message) string {
+	if m.GetType() == messages.MessageTypeEvent {
+		if _, err := event.GetMaker(m.GetName()); err != nil {
+			return OtherMetricName
+		}
+	}
+
+	return m.GetName()
+}
+
+func (o *Service) GetMetrics() *Metrics {
+	return &Metrics{
+		TravelTime:   o.metrics.travelTime.Snapshot(),
+		HandlingTime: o.metrics.handlingTime.Snapshot(),
+		Received:     o.metrics.received.Snapshot(),
+		Errors:       o.metrics.errors.Snapshot(),
+		Expired:      o.metrics.expired.Snapshot(),
+		SlowMessages: o.metrics.slow.Get(),
+	}
+}
+
+func (o *Service) getMetricsInterval() (time.Duration, error) {
+	s := o.config["mqtt_metrics_interval"]
+	if s == "" {
+		return DefaultMetricsInterval, nil
+	}
+
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "getMetricsInterval")
+	}
+
+	return interval, nil
+}
+
+// sendMetricsLoop Периодически отправляет сводку метрик в шину
+func (o *Service) sendMetricsLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			msg, err := service.NewOnMetricsMessage(topics.TopicServiceMetrics, o.GetMetrics())
+			if err != nil {
+				o.logger.Error(errors.Wrap(err, "sendMetricsLoop"))
+				continue
+			}
+
+			if err := o.client.Send(msg); err != nil {
+				o.logger.Error(errors.Wrap(err, "sendMetricsLoop"))
+			}
+
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// collectMetrics Записывает метрики обработки сообщений в формате Prometheus
+func (o *Service) collectMetrics(w *metrics.Writer) {
+	received := o.metrics.received.Snapshot()
+	for _, name := range o.metrics.received.Labels() {
+		w.Counter("mqtt_service_received_total", "Total number of messages received by the service handler.", float64(received[name]), "name", name)
+	}
+
+	errs := o.metrics.errors.Snapshot()
+	for _, kind := range o.metrics.errors.Labels() {
+		w.Counter("mqtt_service_errors_total", "Total number of message processing errors by kind.", float64(errs[kind]), "kind", kind)
+	}
+
+	expired := o.metrics.expired.Snapshot()
+	for _, name := range o.metrics.expired.Labels() {
+		w.Counter("mqtt_service_expired_total", "Total number of dropped expired messages.", float64(expired[name]), "name", name)
+	}
+
+	w.Counter("mqtt_service_slow_messages_total", "Total number of messages delivered slower than mqtt_max_travel_time.", float64(o.metrics.slow.Get()))
+	w.Histogram("mqtt_service_travel_time_seconds", "Message delivery time in seconds.", o.metrics.travelTime.Snapshot())
+	w.Histogram("mqtt_service_handling_time_seconds", "Message handling time in seconds.", o.metrics.handlingTime.Snapshot())
+
+	if o.queue != nil {
+		w.Gauge("mqtt_service_queue_depth", "Number of received messages waiting for a worker.", float64(len(o.queue)))
+	}
+}
@@ -1,41 +1,104 @@
 package service
 
 import (
-	"encoding/json"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/VladimirDronik/touchon-server/events/service"
 	"github.com/VladimirDronik/touchon-server/info"
+	"github.com/VladimirDronik/touchon-server/metrics"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/VladimirDronik/touchon-server/mqtt/acl"
 	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
 	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/VladimirDronik/touchon-server/mqtt/signature"
+	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 func New(client mqtt.Client, cfg map[string]string, bufferSize int, threads int, logger *logrus.Logger) (*Service, error) {
 	o := &Service{
-		client:     client,
-		config:     cfg,
-		bufferSize: bufferSize,
-		topic:      client.GetTopicFromConnectionString(),
-		logger:     logger,
-		threads:    threads,
-		wg:         &sync.WaitGroup{},
+		client:          client,
+		config:          cfg,
+		bufferSize:      bufferSize,
+		topic:           client.GetTopicFromConnectionString(),
+		shareGroup:      cfg["mqtt_share_group"],
+		broadcastTopics: []string{topics.TopicServiceCommand},
+		logger:          logger,
+		threads:         threads,
+		wg:              &sync.WaitGroup{},
+		metrics:         newServiceMetrics(),
+		done:            make(chan struct{}),
+	}
+
+	var err error
+	o.clockSkew, err = newClockSkewDetector(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "mqttService.New")
+	}
+
+	ttl, err := parseTTL(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "mqttService.New")
+	}
+
+	client.SetTTL(ttl)
+
+	codecs, err := messages.ParseCodecs(cfg["mqtt_codec"], cfg["mqtt_codec_topics"])
+	if err != nil {
+		return nil, errors.Wrap(err, "mqttService.New")
+	}
+
+	client.SetCodecs(codecs)
+
+	o.reportExpired = cfg["mqtt_report_expired"] == "true"
+
+	if err := o.initSignature(cfg); err != nil {
+		return nil, errors.Wrap(err, "mqttService.New")
+	}
+
+	if v := cfg["mqtt_acl"]; v != "" {
+		rules, err := acl.Parse(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "mqttService.New")
+		}
+
+		client.SetACL(rules)
+	}
+
+	for _, topic := range strings.Split(cfg["mqtt_broadcast_topics"], ",") {
+		if topic = strings.TrimSpace(topic); topic != "" && !slices.Contains(o.broadcastTopics, topic) {
+			o.broadcastTopics = append(o.broadcastTopics, topic)
+		}
 	}
 
 	return o, nil
 }
 
 type Service struct {
-	client     mqtt.Client
-	config     map[string]string
-	bufferSize int
-	logger     *logrus.Logger
-	topic      string
-	threads    int
-	wg         *sync.WaitGroup
-	handler    func(messages.Message) error
+	client          mqtt.Client
+	config          map[string]string
+	bufferSize      int
+	logger          *logrus.Logger
+	topic           string
+	shareGroup      string   // Группа общей подписки на основной топик
+	broadcastTopics []string // Топики, на которые подписываются все реплики сервиса
+	threads         int
+	wg              *sync.WaitGroup
+	handler         func(messages.Message) error
+	metrics         *serviceMetrics
+	clockSkew       *clockSkewDetector
+	reportExpired   bool // Сообщать об отброшенных просроченных сообщениях событием on_error
+	signatureMode   string
+	verifier        *signature.Verifier    // Проверка подписей команд (nil - подписи не проверяются)
+	replayGuard     *signature.ReplayGuard // Проверка времени отправки и повторов подписанных команд (nil - не проверяются)
+	queue           <-chan paho.Message    // Очередь принятых сообщений для воркеров
+	done            chan struct{}
+	shutdownOnce    sync.Once
+	shutdownErr     error
 }
 
 func (o *Service) SetHandler(handler func(messages.Message) error) {
@@ -59,11 +122,13 @@ func (o *Service) Start() error {
 		return errors.Wrap(errors.New("handler is nil"), "Start")
 	}
 
-	msgs, err := o.client.Subscribe(o.topic, o.bufferSize)
+	msgs, err := o.subscribe()
 	if err != nil {
 		return errors.Wrap(err, "Start")
 	}
 
+	o.queue = msgs
+
 	maxTravelTime := 0xFFFF * time.Hour
 	if v := o.config["mqtt_max_travel_time"]; v != "" {
 		maxTravelTime, err = time.ParseDuration(v)
@@ -72,6 +137,11 @@ func (o *Service) Start() error {
 		}
 	}
 
+	metricsInterval, err := o.getMetricsInterval()
+	if err != nil {
+		return errors.Wrap(err, "Start")
+	}
+
 	o.wg.Add(o.threads)
 
 	// Запускаем воркеров
@@ -82,14 +152,25 @@ func (o *Service) Start() error {
 			for msg := range msgs {
 				m, err := messages.NewFromMQTT(msg)
 				if err != nil {
+					o.metrics.errors.With(ErrorKindDecode).Inc()
 					o.logger.Error(err)
 					continue
 				}
 
 				m.SetReceivedAt(time.Now())
+				m.SetRetained(msg.Retained())
 
 				travelTime := o.processTravelTime(m, maxTravelTime)
 
+				if messages.IsExpired(m, m.GetReceivedAt()) {
+					o.processExpired(m)
+					continue
+				}
+
+				if !o.verifySignature(m) {
+					continue
+				}
+
 				switch o.logger.Level {
 				case logrus.DebugLevel:
 					o.logger.Debugf("mqtt.Service.Receive: [%s] QoS=%d travelTime=%s", m.GetTopic(), m.GetQoS(), travelTime)
@@ -97,63 +178,191 @@ func (o *Service) Start() error {
 					o.logger.Tracef("mqtt.Service.Receive: [%s] QoS=%d travelTime=%s %s", m.GetTopic(), m.GetQoS(), travelTime, m.String())
 				}
 
-				if m.GetTargetType() == messages.TargetTypeService && m.GetType() == messages.MessageTypeCommand && m.GetName() == "info" {
-					m, err := service.NewOnInfoMessage("service/info")
-					if err != nil {
-						o.logger.Error(err)
-						continue
-					}
-
-					if err := o.client.Send(m); err != nil {
-						o.logger.Error(err)
-						continue
-					}
+				o.metrics.received.With(metricName(m)).Inc()
 
+				if o.processServiceCommand(m) {
 					continue
 				}
 
-				if err := o.handler(m); err != nil {
+				start := time.Now()
+				err = o.handler(m)
+				o.metrics.handlingTime.ObserveDuration(time.Since(start))
+
+				if err != nil {
+					o.metrics.errors.With(ErrorKindHandler).Inc()
 					o.logger.Error(err)
 				}
 			}
 		}()
 	}
 
+	info.AddSection("mqtt", func() interface{} { return o.client.GetStats() })
+	info.AddSection("mqtt_metrics", func() interface{} { return o.GetMetrics() })
+	info.AddSection("mqtt_clock_skew", func() interface{} { return o.GetClockSkew() })
+	metrics.Register("mqtt", func() interface{} { return o.GetMetrics() })
+	metrics.RegisterCollector("mqtt_service", o.collectMetrics)
+
+	// Нулевой интервал отключает отправку сводки метрик
+	if metricsInterval > 0 {
+		go o.sendMetricsLoop(metricsInterval)
+	}
+
+	go o.watchState(o.client.SubscribeState(10))
+
 	o.logger.Info("MQTT: сервис запущен")
 
 	return nil
 }
 
-func (o *Service) processTravelTime(m messages.Message, maxTravelTime time.Duration) string {
-	if m.GetSentAt().IsZero() {
-		return ""
+// watchState Журналирует изменения состояния соединения с брокером
+func (o *Service) watchState(states <-chan mqtt.State) {
+	for state := range states {
+		switch state {
+		case mqtt.StateConnected:
+			o.logger.Info("MQTT: соединение с брокером установлено")
+		case mqtt.StateReconnecting:
+			o.logger.Warn("MQTT: соединение с брокером потеряно, переподключаемся")
+		}
 	}
+}
+
+// processServiceCommand Обрабатывает служебные команды, адресованные сервисам.
+// Возвращает true, если команда обработана.
+func (o *Service) processServiceCommand(m messages.Message) bool {
+	if m.GetTargetType() != messages.TargetTypeService || m.GetType() != messages.MessageTypeCommand {
+		return false
+	}
+
+	switch m.GetName() {
+	case "info":
+		msg, err := service.NewOnInfoMessage(topics.TopicServiceInfo)
+		if err != nil {
+			o.logger.Error(err)
+			return true
+		}
+
+		messages.Correlate(msg, m)
 
-	travelTime := m.GetReceivedAt().Sub(m.GetSentAt())
+		if err := o.client.Send(msg); err != nil {
+			o.logger.Error(err)
+		}
 
-	if travelTime > maxTravelTime && o.GetLogger().Level >= logrus.DebugLevel {
-		type TravelTimeTooLong struct {
-			Duration string
-			Message  messages.Message
+	case "cluster_info":
+		// Команду выполняет только указанный сервис (или любой, если сервис не указан)
+		if name, _ := m.GetStringValue("service"); name != "" && name != info.Name {
+			return true
 		}
-		msg := TravelTimeTooLong{
-			Duration: travelTime.String(),
-			Message:  m,
+
+		timeout, err := o.getClusterInfoTimeout(m)
+		if err != nil {
+			o.logger.Error(errors.Wrap(err, "processServiceCommand"))
+			return true
 		}
 
-		data, _ := json.Marshal(msg)
+		// Сбор ответов занимает время, не блокируем воркера
+		go o.sendClusterInfo(m, timeout)
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (o *Service) getClusterInfoTimeout(m messages.Message) (time.Duration, error) {
+	s, _ := m.GetStringValue("timeout")
+	if s == "" {
+		s = o.config["mqtt_cluster_info_timeout"]
+	}
+
+	if s == "" {
+		return DefaultClusterInfoTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "getClusterInfoTimeout")
+	}
+
+	return timeout, nil
+}
+
+func (o *Service) sendClusterInfo(request messages.Message, timeout time.Duration) {
+	clusterInfo, err := CollectClusterInfo(o.client, timeout)
+	if err != nil {
+		o.logger.Error(errors.Wrap(err, "sendClusterInfo"))
+		return
+	}
 
-		if err := o.client.SendRaw("debug/travel_time_too_long/"+info.Name, messages.QoSNotGuaranteed, false, data); err != nil {
-			o.GetLogger().Error(err)
+	msg, err := service.NewOnClusterInfoMessage(topics.TopicServiceClusterInfo, clusterInfo)
+	if err != nil {
+		o.logger.Error(errors.Wrap(err, "sendClusterInfo"))
+		return
+	}
+
+	messages.Correlate(msg, request)
+
+	if err := o.client.Send(msg); err != nil {
+		o.logger.Error(errors.Wrap(err, "sendClusterInfo"))
+	}
+}
+
+// TravelTime Возвращает время доставки сообщения от отправителя до получателя.
+// Если время отправки или получения неизвестно, возвращает false.
+func TravelTime(m messages.Message) (time.Duration, bool) {
+	if m.GetSentAt().IsZero() || m.GetReceivedAt().IsZero() {
+		return 0, false
+	}
+
+	return m.GetReceivedAt().Sub(m.GetSentAt()), true
+}
+
+func (o *Service) processTravelTime(m messages.Message, maxTravelTime time.Duration) string {
+	travelTime, ok := TravelTime(m)
+	if !ok {
+		return ""
+	}
+
+	o.metrics.travelTime.ObserveDuration(travelTime)
+
+	// Retained-сообщения могли быть отправлены давно, для оценки расхождения часов они не подходят
+	if !m.GetRetained() {
+		publisher := m.GetPublisher()
+		if publisher == "" {
+			publisher = m.GetTopicPublisher()
+		}
+
+		if offset, exceeded := o.clockSkew.observe(publisher, travelTime); exceeded {
+			go o.sendClockSkewNotify(publisher, offset)
 		}
 	}
 
+	if travelTime > maxTravelTime {
+		o.metrics.slow.Inc()
+		o.logger.Debugf("mqtt.Service: [%s] travel time %s is too long: %s", m.GetTopic(), travelTime, m.String())
+	}
+
 	return travelTime.String()
 }
 
+// Shutdown Останавливает сервис. Повторные вызовы ничего не делают.
 func (o *Service) Shutdown() error {
+	o.shutdownOnce.Do(func() { o.shutdownErr = o.shutdown() })
+
+	return o.shutdownErr
+}
+
+func (o *Service) shutdown() error {
 	o.logger.Info("MQTT: Останавливаем сервис")
 
+	close(o.done)
+
+	info.RemoveSection("mqtt")
+	info.RemoveSection("mqtt_metrics")
+	info.RemoveSection("mqtt_clock_skew")
+	metrics.Unregister("mqtt")
+	metrics.UnregisterCollector("mqtt_service")
+
 	if err := o.client.Shutdown(); err != nil {
 		return errors.Wrap(err, "mqttService.Shutdown")
 	}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/events/object/relay"
+	"github.com/VladimirDronik/touchon-server/info"
+	"github.com/VladimirDronik/touchon-server/models"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/client/clienttest"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+)
+
+func TestService_HandlerSendsEvent(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := client.NewBus()
+
+	relayClient := bus.NewClient("object_manager", "object_manager", "action_router/command/#")
+	svc, err := New(relayClient, map[string]string{}, 10, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.SetHandler(func(m messages.Message) error {
+		if m.GetType() != messages.MessageTypeCommand || m.GetName() != "on" {
+			return nil
+		}
+
+		e, err := relay.NewOnStateMessage("object_manager/event/relay", m.GetTargetID())
+		if err != nil {
+			return err
+		}
+
+		return relayClient.Send(e)
+	})
+
+	if err := svc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Shutdown()
+
+	router := bus.NewClient("action_router", "action_router", "")
+
+	cmd, err := messages.NewCommand("on", messages.TargetTypeObject, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.SetTopic("action_router/command/relay")
+
+	if err := router.Send(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	clienttest.ExpectEvent(t, bus, "object.relay.on_state_on", 5, time.Second)
+	clienttest.ExpectNone(t, bus, 100*time.Millisecond, clienttest.Name("object.relay.on_state_on"), clienttest.TargetID(6))
+
+	m := svc.GetMetrics()
+	if m.Received["on"] != 1 || m.TravelTime.Count != 1 || m.HandlingTime.Count != 1 {
+		t.Fatalf("unexpected metrics: received=%v travel=%d handling=%d", m.Received, m.TravelTime.Count, m.HandlingTime.Count)
+	}
+}
+
+func TestService_DropsExpiredCommand(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := client.NewBus()
+
+	relayClient := bus.NewClient("object_manager", "object_manager", "action_router/command/#")
+	svc, err := New(relayClient, map[string]string{"mqtt_report_expired": "true"}, 10, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan messages.Message, 1)
+	svc.SetHandler(func(m messages.Message) error {
+		handled <- m
+		return nil
+	})
+
+	if err := svc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Shutdown()
+
+	router := bus.NewClient("action_router", "action_router", "")
+
+	cmd, err := messages.NewCommand("off", messages.TargetTypeObject, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.SetTopic("action_router/command/relay")
+	cmd.SetExpiresAt(time.Now().Add(-time.Minute))
+
+	if err := router.Send(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	clienttest.ExpectEvent(t, bus, "on_error", 5, time.Second)
+
+	select {
+	case m := <-handled:
+		t.Fatalf("expired command was handled: %s", m)
+	default:
+	}
+
+	if n := svc.GetMetrics().Expired["off"]; n != 1 {
+		t.Fatalf("expired = %d, want 1", n)
+	}
+
+	// Повторная остановка не паникует, разделы информации удаляются
+	for i := 0; i < 2; i++ {
+		if err := svc.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if inf, err := info.GetInfo(); err != nil || inf.Sections["mqtt"] != nil {
+		t.Fatalf("mqtt section is not removed: %v", err)
+	}
+}
+
+func TestService_ShareGroup(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := client.NewBus()
+	handled := make([]atomic.Int32, 2)
+
+	for i := range handled {
+		i := i
+		c := bus.NewClient("object_manager_"+string(rune('a'+i)), "object_manager", "action_router/command/#")
+		svc, err := New(c, map[string]string{"mqtt_share_group": "object_manager"}, 10, 1, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		svc.SetHandler(func(m messages.Message) error {
+			handled[i].Add(1)
+			return nil
+		})
+
+		if err := svc.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer svc.Shutdown()
+	}
+
+	router := bus.NewClient("action_router", "action_router", "")
+
+	const n = 4
+	for i := 0; i < n; i++ {
+		cmd, err := messages.NewCommand("on", messages.TargetTypeObject, 5, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.SetTopic("action_router/command/relay")
+
+		if err := router.Send(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Широковещательную команду получает каждая реплика
+	info, err := messages.NewCommand("info", messages.TargetTypeService, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.SetTopic(topics.TopicServiceCommand)
+
+	if err := router.Send(info); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for handled[0].Load()+handled[1].Load() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Каждую команду обрабатывает одна реплика группы
+	time.Sleep(100 * time.Millisecond)
+	if a, b := handled[0].Load(), handled[1].Load(); a+b != n || a == 0 || b == 0 {
+		t.Fatalf("handled %d + %d, want %d in total by both replicas", a, b, n)
+	}
+
+	replies := 0
+	for _, p := range bus.GetHistory() {
+		if p.Topic == topics.TopicServiceInfo {
+			replies++
+		}
+	}
+
+	if replies != len(handled) {
+		t.Fatalf("info replies = %d, want %d", replies, len(handled))
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	for _, c := range []struct {
+		msgType messages.MessageType
+		name    string
+		want    string
+	}{
+		{messages.MessageTypeCommand, "on", "on"},
+		{messages.MessageTypeEvent, "object.relay.on_state_on", "object.relay.on_state_on"},
+		{messages.MessageTypeEvent, "unknown_event", OtherMetricName},
+	} {
+		m, err := messages.NewMessage(c.msgType, c.name, messages.TargetTypeObject, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := metricName(m); got != c.want {
+			t.Errorf("%s %s: got %q, want %q", c.msgType, c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/VladimirDronik/touchon-server/mqtt/signature"
+	"github.com/pkg/errors"
+)
+
+// ErrorKindSignature Команда без подписи или с неверной подписью
+const ErrorKindSignature = "signature"
+
+// initSignature Настраивает подпись отправляемых сообщений и проверку подписей команд
+func (o *Service) initSignature(cfg map[string]string) error {
+	if key := cfg["mqtt_sign_key"]; key != "" {
+		signer, err := signature.NewSigner(key)
+		if err != nil {
+			return errors.Wrap(err, "initSignature")
+		}
+
+		o.client.SetSigner(signer)
+	}
+
+	o.signatureMode = cfg["mqtt_signature_mode"]
+	if o.signatureMode == "" {
+		o.signatureMode = signature.ModeOff
+	}
+
+	switch o.signatureMode {
+	case signature.ModeOff:
+		return nil
+	case signature.ModePermissive, signature.ModeEnforce:
+	default:
+		return errors.Wrap(errors.Errorf("unknown mqtt_signature_mode %q", o.signatureMode), "initSignature")
+	}
+
+	var err error
+	o.verifier, err = signature.NewVerifier(cfg["mqtt_signature_keys"])
+	if err != nil {
+		return errors.Wrap(err, "initSignature")
+	}
+
+	maxAge := signature.DefaultMaxAge
+	if v := cfg["mqtt_signature_max_age"]; v != "" {
+		if maxAge, err = time.ParseDuration(v); err != nil || maxAge < 0 {
+			return errors.Wrap(errors.Errorf("bad mqtt_signature_max_age %q", v), "initSignature")
+		}
+	}
+
+	if maxAge > 0 {
+		o.replayGuard = signature.NewReplayGuard(maxAge)
+	}
+
+	return nil
+}
+
+// verifySignature Проверяет подпись команды. Возвращает false, если команду нужно отбросить.
+func (o *Service) verifySignature(m messages.Message) bool {
+	if o.verifier == nil || m.GetType() != messages.MessageTypeCommand {
+		return true
+	}
+
+	err := o.verifier.Verify(m)
+	if err == nil && o.replayGuard != nil {
+		err = o.replayGuard.Check(m, m.GetReceivedAt())
+	}
+
+	if err == nil {
+		return true
+	}
+
+	o.metrics.errors.With(ErrorKindSignature).Inc()
+
+	if o.signatureMode == signature.ModePermissive {
+		o.logger.Warnf("MQTT: [%s] команда %q от %q: %v (режим %s, команда выполняется)", m.GetTopic(), m.GetName(), m.GetPublisher(), err, o.signatureMode)
+		return true
+	}
+
+	o.logger.Warnf("MQTT: [%s] команда %q от %q отброшена: %v", m.GetTopic(), m.GetName(), m.GetPublisher(), err)
+
+	return false
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/VladimirDronik/touchon-server/mqtt/signature"
+)
+
+func TestService_RejectsReplayedCommand(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "hmac:" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+
+	bus := client.NewBus()
+
+	relayClient := bus.NewClient("object_manager", "object_manager", "action_router/command/#")
+	svc, err := New(relayClient, map[string]string{
+		"mqtt_signature_mode":    signature.ModeEnforce,
+		"mqtt_signature_keys":    "action_router=" + key,
+		"mqtt_signature_max_age": "1m",
+	}, 10, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan messages.Message, 10)
+	svc.SetHandler(func(m messages.Message) error {
+		handled <- m
+		return nil
+	})
+
+	if err := svc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Shutdown()
+
+	signer, err := signature.NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := bus.NewClient("action_router", "action_router", "")
+
+	// signed Возвращает подписанную команду в том виде, в котором она уходит в шину
+	signed := func(sentAt time.Time) []byte {
+		cmd, err := messages.NewCommand("on", messages.TargetTypeObject, 5, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.SetTopic("action_router/command/relay")
+		cmd.SetPublisher("action_router")
+		cmd.SetSentAt(sentAt)
+
+		if err := signer.Sign(cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := messages.Encode(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return data
+	}
+
+	fresh := signed(time.Now())
+	stale := signed(time.Now().Add(-2 * time.Minute))
+
+	// Повтор перехваченной команды и команда, отправленная вне окна, отбрасываются
+	for _, data := range [][]byte{fresh, fresh, stale} {
+		if err := router.SendRaw("action_router/command/relay", messages.QoSNotGuaranteed, false, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("signed command was not handled")
+	}
+
+	select {
+	case m := <-handled:
+		t.Fatalf("replayed or stale command was handled: %s", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Подпись покрывает топик: команду нельзя переслать в другой топик
+	if err := router.SendRaw("action_router/command/sensor", messages.QoSNotGuaranteed, false, signed(time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-handled:
+		t.Fatalf("command with foreign topic was handled: %s", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if n := svc.GetMetrics().Errors[ErrorKindSignature]; n != 3 {
+		t.Fatalf("signature errors = %d, want 3", n)
+	}
+}
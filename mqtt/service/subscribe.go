@@ -0,0 +1,152 @@
+package service
+
+import (
+	"crypto/sha1"
+	"sync"
+	"time"
+
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// subscribe Подписывается на основной топик сервиса (при заданной группе - общей подпиской)
+// и на широковещательные топики, объединяет сообщения из подписок в один канал.
+func (o *Service) subscribe() (<-chan paho.Message, error) {
+	mainTopic := topics.SharedTopic(o.shareGroup, o.topic)
+
+	mainMsgs, err := o.client.Subscribe(mainTopic, o.bufferSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "subscribe")
+	}
+
+	broadcastTopics := make([]string, 0, len(o.broadcastTopics))
+	for _, topic := range o.broadcastTopics {
+		// Без общей подписки основной топик и так доставляет сообщения каждой реплике
+		if o.shareGroup == "" && topics.TopicMatch(o.topic, topic) {
+			continue
+		}
+
+		broadcastTopics = append(broadcastTopics, topic)
+	}
+
+	if len(broadcastTopics) == 0 {
+		return mainMsgs.C(), nil
+	}
+
+	sources := make([]<-chan paho.Message, 0, len(broadcastTopics))
+	for _, topic := range broadcastTopics {
+		c, err := o.client.Subscribe(topic, o.bufferSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "subscribe")
+		}
+
+		sources = append(sources, c.C())
+	}
+
+	msgs := make(chan paho.Message, o.bufferSize)
+	wg := &sync.WaitGroup{}
+	wg.Add(1 + len(sources))
+
+	go func() {
+		defer wg.Done()
+
+		for msg := range mainMsgs.C() {
+			// Эти сообщения приходят через широковещательную подписку
+			if o.shareGroup != "" && o.isBroadcast(msg.Topic()) {
+				continue
+			}
+
+			msgs <- msg
+		}
+	}()
+
+	// Брокер может прислать по копии сообщения на каждую пересекающуюся подписку,
+	// а клиент раздает каждую копию во все подходящие подписки, поэтому убираем дубли.
+	// Копии приходят почти одновременно, поэтому повтор того же сообщения позже окна не отбрасывается.
+	seen := newRecentSet(256, dedupWindow)
+
+	for _, c := range sources {
+		go func(c <-chan paho.Message) {
+			defer wg.Done()
+
+			for msg := range c {
+				if seen.Add(msg.Topic(), msg.Payload()) {
+					msgs <- msg
+				}
+			}
+		}(c)
+	}
+
+	// Закрываем общий канал после закрытия всех подписок
+	go func() {
+		wg.Wait()
+		close(msgs)
+	}()
+
+	return msgs, nil
+}
+
+func (o *Service) isBroadcast(topic string) bool {
+	for _, filter := range o.broadcastTopics {
+		if topics.TopicMatch(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dedupWindow Время, в течение которого одинаковые сообщения из разных подписок считаются копиями
+const dedupWindow = time.Second
+
+func newRecentSet(size int, window time.Duration) *recentSet {
+	return &recentSet{
+		keys:   make([][sha1.Size]byte, size),
+		index:  make(map[[sha1.Size]byte]time.Time, size),
+		window: window,
+	}
+}
+
+// recentSet Хранит отпечатки последних size сообщений и время их получения
+type recentSet struct {
+	mu     sync.Mutex
+	keys   [][sha1.Size]byte
+	index  map[[sha1.Size]byte]time.Time
+	window time.Duration
+	next   int
+}
+
+// Add Добавляет отпечаток сообщения. Возвращает false, если такое же сообщение встречалось в течение окна.
+func (o *recentSet) Add(topic string, payload []byte) bool {
+	h := sha1.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+
+	var key [sha1.Size]byte
+	copy(key[:], h.Sum(nil))
+
+	now := time.Now()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if seenAt, ok := o.index[key]; ok {
+		if now.Sub(seenAt) < o.window {
+			return false
+		}
+
+		// Повтор после окна - новое сообщение, отпечаток уже лежит в кольце
+		o.index[key] = now
+
+		return true
+	}
+
+	delete(o.index, o.keys[o.next])
+	o.keys[o.next] = key
+	o.index[key] = now
+	o.next = (o.next + 1) % len(o.keys)
+
+	return true
+}
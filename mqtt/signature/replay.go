@@ -0,0 +1,69 @@
+package signature
+
+import (
+	"sync"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+)
+
+// DefaultMaxAge Допустимое расхождение времени отправки подписанной команды со временем получения по умолчанию
+const DefaultMaxAge = 5 * time.Minute
+
+// NewReplayGuard Создает защиту от повторной отправки подписанных сообщений
+func NewReplayGuard(maxAge time.Duration) *ReplayGuard {
+	return &ReplayGuard{
+		maxAge: maxAge,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// ReplayGuard Отбрасывает подписанные сообщения, отправленные вне окна maxAge от времени получения,
+// и повторы уже принятых подписей. Подписи хранятся, пока сообщение с ними укладывается в окно,
+// поэтому размер кеша ограничен количеством команд за 2*maxAge.
+type ReplayGuard struct {
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]time.Time // Подпись -> время, после которого она выходит из окна
+	order []seenSignature      // Подписи в порядке получения для очистки кеша
+}
+
+type seenSignature struct {
+	signature string
+	expiresAt time.Time
+}
+
+// Check Проверяет время отправки сообщения и запоминает его подпись.
+// Вызывается после проверки подписи (Verifier.Verify), чтобы неверные подписи не попадали в кеш.
+func (o *ReplayGuard) Check(m messages.Message, now time.Time) error {
+	sentAt := m.GetSentAt()
+	if sentAt.IsZero() || now.Sub(sentAt) > o.maxAge || sentAt.Sub(now) > o.maxAge {
+		return ErrStale
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.cleanup(now)
+
+	if _, ok := o.seen[m.GetSignature()]; ok {
+		return ErrReplay
+	}
+
+	expiresAt := sentAt.Add(o.maxAge)
+	o.seen[m.GetSignature()] = expiresAt
+	o.order = append(o.order, seenSignature{signature: m.GetSignature(), expiresAt: expiresAt})
+
+	return nil
+}
+
+// cleanup Удаляет подписи, вышедшие из окна
+func (o *ReplayGuard) cleanup(now time.Time) {
+	n := 0
+	for ; n < len(o.order) && now.After(o.order[n].expiresAt); n++ {
+		delete(o.seen, o.order[n].signature)
+	}
+
+	o.order = o.order[n:]
+}
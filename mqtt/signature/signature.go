@@ -0,0 +1,295 @@
+// Пакет подписи сообщений шины.
+//
+// Подписывается канонический вид конверта сообщения: топик, отправитель, тип, название, цель,
+// полезная нагрузка, время отправки и время истечения. Время получения в подпись не входит,
+// так как его выставляет получатель. Топик входит в подпись, чтобы команду нельзя было
+// переслать в другой топик. Подпись передается в поле signature конверта
+// в виде "<алгоритм>:<base64>".
+//
+// Ключи задаются строками вида "hmac:<base64 секрета>" или "ed25519:<base64 ключа>".
+// Для подписи ed25519 используется закрытый ключ (seed 32 байта или ключ 64 байта),
+// для проверки - открытый ключ (32 байта).
+//
+// Настройки:
+//
+//	mqtt_sign_key          = "ed25519:..."                                   # Ключ подписи отправляемых сообщений
+//	mqtt_signature_keys    = "object_manager=ed25519:...;action_router=hmac:..." # Ключи проверки по отправителю
+//	mqtt_signature_mode    = off | permissive | enforce
+//	mqtt_signature_max_age = 5m # Допустимое расхождение sent_at команды со временем получения, 0 - не проверять.
+//	                            # Повторы подписей в этом окне отбрасываются (см. ReplayGuard)
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+const (
+	AlgHMAC    = "hmac"    // HMAC-SHA256, общий секрет отправителя и получателей
+	AlgEd25519 = "ed25519" // Ed25519, получатели знают только открытый ключ отправителя
+)
+
+// Режимы проверки подписей
+const (
+	ModeOff        = "off"        // Подписи не проверяются
+	ModePermissive = "permissive" // Ошибки подписи журналируются, команды выполняются
+	ModeEnforce    = "enforce"    // Команды без подписи или с неверной подписью отбрасываются
+)
+
+var (
+	ErrUnsigned         = errors.New("message is not signed")
+	ErrUnknownPublisher = errors.New("no key for publisher")
+	ErrInvalid          = errors.New("invalid signature")
+	ErrStale            = errors.New("sent_at is outside of the allowed window")
+	ErrReplay           = errors.New("signature has already been used")
+)
+
+// envelope Канонический вид конверта сообщения
+type envelope struct {
+	Topic      string      `json:"topic"`
+	Publisher  string      `json:"publisher"`
+	Type       string      `json:"type"`
+	Name       string      `json:"name"`
+	TargetType string      `json:"target_type"`
+	TargetID   int         `json:"target_id"`
+	Payload    interface{} `json:"payload"`
+	SentAt     string      `json:"sent_at"`
+	ExpiresAt  string      `json:"expires_at"`
+	// Поле добавлено позже остальных, пустое значение не включается, чтобы не менять подпись старых сообщений
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// Canonical Возвращает подписываемые данные сообщения
+func Canonical(m messages.Message) ([]byte, error) {
+	// Полезная нагрузка приводится к виду, в котором ее увидит получатель
+	// (числа - float64, структуры - отсортированные по ключам объекты).
+	var payload interface{}
+	if len(m.GetPayload()) > 0 {
+		data, err := json.Marshal(m.GetPayload())
+		if err != nil {
+			return nil, errors.Wrap(err, "Canonical")
+		}
+
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, errors.Wrap(err, "Canonical")
+		}
+	}
+
+	e := &envelope{
+		Topic:         m.GetTopic(),
+		Publisher:     m.GetPublisher(),
+		Type:          m.GetType(),
+		Name:          m.GetName(),
+		TargetType:    m.GetTargetType(),
+		TargetID:      m.GetTargetID(),
+		Payload:       payload,
+		SentAt:        formatTime(m.GetSentAt()),
+		ExpiresAt:     formatTime(m.GetExpiresAt()),
+		CorrelationID: m.GetCorrelationID(),
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "Canonical")
+	}
+
+	return data, nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Key Ключ подписи или проверки
+type Key struct {
+	alg        string
+	secret     []byte
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+// ParseKey Разбирает ключ вида "<алгоритм>:<base64>".
+// Для ed25519 ключ длиной 32 байта считается открытым, если private = false, и seed'ом закрытого ключа иначе.
+func ParseKey(s string, private bool) (*Key, error) {
+	kv := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(kv) != 2 {
+		return nil, errors.Wrap(errors.New("expected <alg>:<base64>"), "ParseKey")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(kv[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "ParseKey")
+	}
+
+	switch kv[0] {
+	case AlgHMAC:
+		if len(data) < 16 {
+			return nil, errors.Wrap(errors.New("hmac secret is shorter than 16 bytes"), "ParseKey")
+		}
+
+		return &Key{alg: AlgHMAC, secret: data}, nil
+
+	case AlgEd25519:
+		switch {
+		case len(data) == ed25519.PrivateKeySize:
+			k := ed25519.PrivateKey(data)
+			return &Key{alg: AlgEd25519, privateKey: k, publicKey: k.Public().(ed25519.PublicKey)}, nil
+
+		case len(data) == ed25519.SeedSize && private:
+			k := ed25519.NewKeyFromSeed(data)
+			return &Key{alg: AlgEd25519, privateKey: k, publicKey: k.Public().(ed25519.PublicKey)}, nil
+
+		case len(data) == ed25519.PublicKeySize:
+			return &Key{alg: AlgEd25519, publicKey: data}, nil
+
+		default:
+			return nil, errors.Wrap(errors.Errorf("bad ed25519 key size %d", len(data)), "ParseKey")
+		}
+
+	default:
+		return nil, errors.Wrap(errors.Errorf("unknown algorithm %q", kv[0]), "ParseKey")
+	}
+}
+
+func (o *Key) sign(data []byte) ([]byte, error) {
+	switch o.alg {
+	case AlgHMAC:
+		mac := hmac.New(sha256.New, o.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+
+	case AlgEd25519:
+		if o.privateKey == nil {
+			return nil, errors.Wrap(errors.New("ed25519 private key is not set"), "sign")
+		}
+
+		return ed25519.Sign(o.privateKey, data), nil
+
+	default:
+		return nil, errors.Wrap(errors.Errorf("unknown algorithm %q", o.alg), "sign")
+	}
+}
+
+func (o *Key) verify(data, sig []byte) bool {
+	switch o.alg {
+	case AlgHMAC:
+		expected, _ := o.sign(data)
+		return hmac.Equal(expected, sig)
+
+	case AlgEd25519:
+		return ed25519.Verify(o.publicKey, data, sig)
+
+	default:
+		return false
+	}
+}
+
+func NewSigner(key string) (*Signer, error) {
+	k, err := ParseKey(key, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewSigner")
+	}
+
+	if k.alg == AlgEd25519 && k.privateKey == nil {
+		return nil, errors.Wrap(errors.New("ed25519 private key expected"), "NewSigner")
+	}
+
+	return &Signer{key: k}, nil
+}
+
+// Signer Подписывает отправляемые сообщения
+type Signer struct {
+	key *Key
+}
+
+func (o *Signer) Sign(m messages.Message) error {
+	data, err := Canonical(m)
+	if err != nil {
+		return errors.Wrap(err, "Signer.Sign")
+	}
+
+	sig, err := o.key.sign(data)
+	if err != nil {
+		return errors.Wrap(err, "Signer.Sign")
+	}
+
+	m.SetSignature(o.key.alg + ":" + base64.StdEncoding.EncodeToString(sig))
+
+	return nil
+}
+
+// NewVerifier Создает проверяющего подписи по списку ключей отправителей
+// вида "publisher=<алгоритм>:<base64>;publisher2=...".
+func NewVerifier(keys string) (*Verifier, error) {
+	o := &Verifier{keys: make(map[string]*Key)}
+
+	for _, item := range strings.Split(keys, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Wrap(errors.Errorf("bad key %q, expected publisher=<alg>:<base64>", item), "NewVerifier")
+		}
+
+		k, err := ParseKey(kv[1], false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "NewVerifier(%s)", kv[0])
+		}
+
+		o.keys[strings.TrimSpace(kv[0])] = k
+	}
+
+	return o, nil
+}
+
+// Verifier Проверяет подписи сообщений
+type Verifier struct {
+	keys map[string]*Key
+}
+
+// Verify Проверяет подпись сообщения ключом его отправителя
+func (o *Verifier) Verify(m messages.Message) error {
+	if m.GetSignature() == "" {
+		return ErrUnsigned
+	}
+
+	k, ok := o.keys[m.GetPublisher()]
+	if !ok {
+		return errors.Wrap(ErrUnknownPublisher, m.GetPublisher())
+	}
+
+	kv := strings.SplitN(m.GetSignature(), ":", 2)
+	if len(kv) != 2 || kv[0] != k.alg {
+		return ErrInvalid
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(kv[1])
+	if err != nil {
+		return ErrInvalid
+	}
+
+	data, err := Canonical(m)
+	if err != nil {
+		return errors.Wrap(err, "Verifier.Verify")
+	}
+
+	if !k.verify(data, sig) {
+		return ErrInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+func TestSignVerify(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		signKey   string
+		verifyKey string
+	}{
+		{"hmac:" + secret, "hmac:" + secret},
+		{"ed25519:" + base64.StdEncoding.EncodeToString(priv.Seed()), "ed25519:" + base64.StdEncoding.EncodeToString(pub)},
+	}
+
+	for _, tt := range tests {
+		signer, err := NewSigner(tt.signKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verifier, err := NewVerifier("action_router=" + tt.verifyKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type args struct {
+			Level int `json:"level"`
+		}
+
+		m, err := messages.NewCommand("set", messages.TargetTypeObject, 5, map[string]interface{}{"state": "on", "value": 1, "args": args{Level: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetTopic("action_router/command/relay")
+		m.SetPublisher("action_router")
+		m.SetSentAt(time.Now())
+
+		if err := signer.Sign(m); err != nil {
+			t.Fatal(err)
+		}
+
+		// Проверяем сообщение в том виде, в котором его получит сервис
+		data, err := m.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received := &messages.MessageImpl{}
+		if err := received.UnmarshalJSON(data); err != nil {
+			t.Fatal(err)
+		}
+		received.SetTopic(m.GetTopic())
+		received.SetReceivedAt(time.Now())
+
+		if err := verifier.Verify(received); err != nil {
+			t.Fatalf("%s: %v", tt.signKey, err)
+		}
+
+		// Подпись не зависит от формата сообщения в шине
+		for _, name := range []string{messages.CodecCBOR, messages.CodecMsgPack} {
+			codec, err := messages.GetCodec(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := codec.Encode(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := messages.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded.SetTopic(m.GetTopic())
+
+			if err := verifier.Verify(decoded); err != nil {
+				t.Fatalf("%s, %s: %v", tt.signKey, name, err)
+			}
+		}
+
+		received.SetTopic("action_router/command/sensor")
+		if err := verifier.Verify(received); errors.Cause(err) != ErrInvalid {
+			t.Fatalf("%s: forwarded message: got %v, want %v", tt.signKey, err, ErrInvalid)
+		}
+
+		received.SetTopic(m.GetTopic())
+		received.SetTargetID(6)
+		if err := verifier.Verify(received); errors.Cause(err) != ErrInvalid {
+			t.Fatalf("%s: tampered message: got %v, want %v", tt.signKey, err, ErrInvalid)
+		}
+
+		received.SetSignature("")
+		if err := verifier.Verify(received); errors.Cause(err) != ErrUnsigned {
+			t.Fatalf("%s: unsigned message: got %v, want %v", tt.signKey, err, ErrUnsigned)
+		}
+
+		received.SetPublisher("object_manager")
+		received.SetSignature(m.GetSignature())
+		if err := verifier.Verify(received); errors.Cause(err) != ErrUnknownPublisher {
+			t.Fatalf("%s: unknown publisher: got %v, want %v", tt.signKey, err, ErrUnknownPublisher)
+		}
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Now()
+	guard := NewReplayGuard(time.Minute)
+
+	newMessage := func(sentAt time.Time, sig string) messages.Message {
+		m, err := messages.NewCommand("on", messages.TargetTypeObject, 5, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetSentAt(sentAt)
+		m.SetSignature(sig)
+
+		return m
+	}
+
+	if err := guard.Check(newMessage(now, "hmac:a"), now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := guard.Check(newMessage(now, "hmac:a"), now.Add(time.Second)); err != ErrReplay {
+		t.Fatalf("replay: got %v, want %v", err, ErrReplay)
+	}
+
+	for _, sentAt := range []time.Time{{}, now.Add(-2 * time.Minute), now.Add(2 * time.Minute)} {
+		if err := guard.Check(newMessage(sentAt, "hmac:b"), now); err != ErrStale {
+			t.Fatalf("sent_at %v: got %v, want %v", sentAt, err, ErrStale)
+		}
+	}
+
+	// Подписи, вышедшие из окна, удаляются из кеша
+	if err := guard.Check(newMessage(now.Add(2*time.Minute), "hmac:c"), now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := guard.seen["hmac:a"]; ok || len(guard.seen) != 1 {
+		t.Fatalf("expired signatures are kept: %v", guard.seen)
+	}
+}
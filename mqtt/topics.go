@@ -1,5 +1,7 @@
 package mqtt
 
+import "strings"
+
 const (
 	ClientObjectManager = "object_manager"
 	ClientActionRouter  = "action_router"
@@ -11,3 +13,60 @@ const (
 	TopicEvent   = "event"
 	TopicCommand = "command"
 )
+
+// Служебные топики, общие для всех сервисов
+const (
+	TopicServiceCommand     = "service/command"      // Широковещательные команды сервисам
+	TopicServiceInfo        = "service/info"         // Ответы сервисов на команду info
+	TopicServiceClusterInfo = "service/cluster_info" // Сводная информация о сервисах
+	TopicServiceLeader      = "service/leader"       // Блокировки выбора лидера (service/leader/<группа>)
+	TopicServiceMetrics     = "service/metrics"      // Периодические сводки метрик сервисов
+)
+
+// SharedTopic Формирует топик общей подписки ($share/<group>/<topic>).
+// Сообщения общей подписки распределяются брокером между участниками группы.
+func SharedTopic(group, topic string) string {
+	if group == "" {
+		return topic
+	}
+
+	return "$share/" + group + "/" + topic
+}
+
+// TrimShared Возвращает фильтр подписки без префикса общей подписки
+func TrimShared(filter string) string {
+	if !strings.HasPrefix(filter, "$share/") {
+		return filter
+	}
+
+	items := strings.SplitN(filter, "/", 3)
+	if len(items) < 3 {
+		return ""
+	}
+
+	return items[2]
+}
+
+// TopicMatch Проверяет, подходит ли топик под фильтр подписки (с учетом +, # и $share)
+func TopicMatch(filter, topic string) bool {
+	f := strings.Split(TrimShared(filter), "/")
+	t := strings.Split(topic, "/")
+
+	// Топики, начинающиеся с $, не попадают под фильтры, начинающиеся с подстановочных символов
+	if len(t) > 0 && strings.HasPrefix(t[0], "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+
+	for i, level := range f {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(t):
+			return false
+		case level != "+" && level != t[i]:
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
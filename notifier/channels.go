@@ -0,0 +1,241 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// Названия встроенных каналов
+const (
+	ChannelWebhook = "webhook"
+	ChannelSMTP    = "smtp"
+	ChannelLog     = "log"
+)
+
+// initChannels Создает каналы, для которых заданы настройки
+func (o *Notifier) initChannels(cfg map[string]string) error {
+	if v := cfg["notify_webhook_url"]; v != "" {
+		headers, err := parseHeaders(cfg["notify_webhook_headers"])
+		if err != nil {
+			return errors.Wrap(err, "initChannels")
+		}
+
+		o.channels[ChannelWebhook] = NewWebhookChannel(v, headers, o.timeout)
+	}
+
+	if v := cfg["notify_smtp_addr"]; v != "" {
+		c, err := NewSMTPChannel(v, cfg["notify_smtp_user"], cfg["notify_smtp_password"], cfg["notify_smtp_from"], cfg["notify_smtp_to"])
+		if err != nil {
+			return errors.Wrap(err, "initChannels")
+		}
+
+		o.channels[ChannelSMTP] = c
+	}
+
+	if v := cfg["notify_log_file"]; v != "" {
+		c, err := NewLogChannel(v)
+		if err != nil {
+			return errors.Wrap(err, "initChannels")
+		}
+
+		o.channels[ChannelLog] = c
+	}
+
+	return nil
+}
+
+// parseHeaders Разбирает заголовки вида "name=value;name2=value2"
+func parseHeaders(s string) (map[string]string, error) {
+	r := make(map[string]string)
+
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.Wrap(errors.Errorf("bad header %q, expected name=value", item), "parseHeaders")
+		}
+
+		r[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return r, nil
+}
+
+// NewWebhookChannel Создает канал, отправляющий уведомления POST-запросом с JSON уведомления
+func NewWebhookChannel(url string, headers map[string]string, timeout time.Duration) *WebhookChannel {
+	return &WebhookChannel{
+		url:     url,
+		headers: headers,
+		client: &fasthttp.Client{
+			Name:         "touchon-notifier",
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		},
+	}
+}
+
+type WebhookChannel struct {
+	url     string
+	headers map[string]string
+	client  *fasthttp.Client
+}
+
+func (o *WebhookChannel) Name() string {
+	return ChannelWebhook
+}
+
+func (o *WebhookChannel) Send(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "WebhookChannel.Send")
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetRequestURI(o.url)
+	req.Header.SetContentType("application/json")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBody(body)
+
+	if err := o.client.Do(req, resp); err != nil {
+		return errors.Wrap(err, "WebhookChannel.Send")
+	}
+
+	if code := resp.StatusCode(); code < 200 || code > 299 {
+		return errors.Wrap(errors.Errorf("HTTP#%d %s", code, string(resp.Body())), "WebhookChannel.Send")
+	}
+
+	return nil
+}
+
+// NewSMTPChannel Создает канал, отправляющий уведомления письмом. Получатели перечисляются через запятую.
+func NewSMTPChannel(addr, user, password, from, to string) (*SMTPChannel, error) {
+	o := &SMTPChannel{addr: addr, from: from}
+
+	for _, rcpt := range strings.Split(to, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			o.to = append(o.to, rcpt)
+		}
+	}
+
+	switch {
+	case from == "":
+		return nil, errors.Wrap(errors.New("notify_smtp_from is empty"), "NewSMTPChannel")
+	case len(o.to) == 0:
+		return nil, errors.Wrap(errors.New("notify_smtp_to is empty"), "NewSMTPChannel")
+	}
+
+	if user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		o.auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	return o, nil
+}
+
+type SMTPChannel struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func (o *SMTPChannel) Name() string {
+	return ChannelSMTP
+}
+
+func (o *SMTPChannel) Send(n *Notification) error {
+	subject := "[" + string(n.Type) + "] "
+	if n.Publisher != "" {
+		subject += n.Publisher + ": "
+	}
+	subject += firstLine(n.Text)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", o.from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(o.to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n"))
+	buf.WriteString("\r\n")
+
+	if err := smtp.SendMail(o.addr, o.auth, o.from, o.to, buf.Bytes()); err != nil {
+		return errors.Wrap(err, "SMTPChannel.Send")
+	}
+
+	return nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// NewLogChannel Создает канал, дописывающий уведомления в файл (по строке JSON на уведомление)
+func NewLogChannel(path string) (*LogChannel, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errors.Wrap(err, "NewLogChannel")
+	}
+
+	return &LogChannel{path: path}, nil
+}
+
+type LogChannel struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (o *LogChannel) Name() string {
+	return ChannelLog
+}
+
+func (o *LogChannel) Send(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "LogChannel.Send")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Файл открывается на каждую запись, чтобы не мешать ротации журналов
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "LogChannel.Send")
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "LogChannel.Send")
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "LogChannel.Send")
+	}
+
+	return nil
+}
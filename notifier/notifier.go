@@ -0,0 +1,385 @@
+// Пакет доставки уведомлений людям.
+//
+// Нотификатор подписывается на события on_notify (events.NewOnNotifyMessage) и доставляет
+// уведомления по каналам: webhook, SMTP, локальный файл журнала. Уведомления можно отправить
+// и напрямую, методами Notify и Send (messages.Notification).
+//
+// Настройки:
+//
+//	notify_topic           = "+/event/#"                          # Топики, в которых публикуются события on_notify
+//	notify_webhook_url     = "https://example.com/hook"           # Канал webhook: POST JSON уведомления
+//	notify_webhook_headers = "Authorization=Bearer xxx"           # Заголовки запроса webhook ("name=value;...")
+//	notify_smtp_addr       = "smtp.example.com:587"               # Канал smtp
+//	notify_smtp_user       = "user"                               # Логин SMTP (пустой - без авторизации)
+//	notify_smtp_password   = "password"                           #
+//	notify_smtp_from       = "touchon@example.com"                #
+//	notify_smtp_to         = "admin@example.com,ops@example.com"  # Получатели
+//	notify_log_file        = "/var/log/touchon/notify.log"        # Канал log
+//	notify_routes          = "critical=webhook,smtp,log;normal=log" # Каналы по важности (по умолчанию - все каналы)
+//	notify_quiet_hours     = "22:00-07:00"                        # Тихие часы по локальному времени
+//	notify_quiet_channels  = "log"                                # Каналы обычных уведомлений в тихие часы
+//	notify_dedup_window    = "5m"                                 # Повторы уведомления в течение окна не доставляются (0 - выкл)
+//	notify_timeout         = "10s"                                # Время ожидания доставки по одному каналу
+//
+// Критичные уведомления тихие часы не ограничивают.
+package notifier
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/events"
+	"github.com/VladimirDronik/touchon-server/info"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Global instance
+var I *Notifier
+
+const (
+	DefaultTopic       = "+/event/#"
+	DefaultDedupWindow = 5 * time.Minute
+	DefaultTimeout     = 10 * time.Second
+)
+
+// Notification Уведомление
+type Notification struct {
+	Type      messages.NotificationType `json:"type"`
+	Text      string                    `json:"text"`
+	Publisher string                    `json:"publisher,omitempty"` // Сервис, отправивший уведомление
+	Time      time.Time                 `json:"time"`
+}
+
+// Channel Канал доставки уведомлений
+type Channel interface {
+	Name() string
+	Send(n *Notification) error
+}
+
+// New Создает нотификатор с каналами, заданными в настройках.
+// Реплики сервиса делят уведомления через общую подписку группы mqtt_share_group.
+// Чтобы доставлялись уведомления своего сервиса, у клиента нужно отключить IgnoreSelfMsgs.
+func New(client mqtt.Client, cfg map[string]string, logger *logrus.Logger) (*Notifier, error) {
+	switch {
+	case client == nil:
+		return nil, errors.Wrap(errors.New("client is nil"), "notifier.New")
+	case logger == nil:
+		return nil, errors.Wrap(errors.New("logger is nil"), "notifier.New")
+	}
+
+	o := &Notifier{
+		client:      client,
+		topic:       cfg["notify_topic"],
+		logger:      logger,
+		channels:    make(map[string]Channel),
+		dedupWindow: DefaultDedupWindow,
+		timeout:     DefaultTimeout,
+		sent:        make(map[string]time.Time),
+		stats:       &Stats{Delivered: map[string]int{}, Failed: map[string]int{}},
+	}
+
+	if o.topic == "" {
+		o.topic = DefaultTopic
+	}
+
+	o.topic = topics.SharedTopic(cfg["mqtt_share_group"], o.topic)
+
+	var err error
+
+	if v := cfg["notify_timeout"]; v != "" {
+		if o.timeout, err = time.ParseDuration(v); err != nil {
+			return nil, errors.Wrap(err, "notifier.New")
+		}
+	}
+
+	if v := cfg["notify_dedup_window"]; v != "" {
+		if o.dedupWindow, err = time.ParseDuration(v); err != nil {
+			return nil, errors.Wrap(err, "notifier.New")
+		}
+	}
+
+	if err := o.initChannels(cfg); err != nil {
+		return nil, errors.Wrap(err, "notifier.New")
+	}
+
+	if o.routes, err = parseRoutes(cfg["notify_routes"], o.channels); err != nil {
+		return nil, errors.Wrap(err, "notifier.New")
+	}
+
+	if o.quietHours, err = parseQuietHours(cfg["notify_quiet_hours"]); err != nil {
+		return nil, errors.Wrap(err, "notifier.New")
+	}
+
+	quietChannels := cfg["notify_quiet_channels"]
+	if quietChannels == "" {
+		quietChannels = ChannelLog
+	}
+
+	if o.quietChannels, err = parseChannelList(quietChannels, o.channels); err != nil {
+		return nil, errors.Wrap(err, "notifier.New")
+	}
+
+	return o, nil
+}
+
+type Notifier struct {
+	client   mqtt.Client
+	sub      *mqtt.Subscription
+	topic    string
+	logger   *logrus.Logger
+	channels map[string]Channel
+	timeout  time.Duration
+
+	routes        map[messages.NotificationType][]string // Каналы по важности (nil - все каналы)
+	quietHours    *quietHours                            // nil - тихие часы не заданы
+	quietChannels []string
+
+	dedupWindow time.Duration
+	mu          sync.Mutex
+	sent        map[string]time.Time // Время последней доставки уведомления (по ключу дедупликации)
+	stats       *Stats
+
+	wg sync.WaitGroup
+}
+
+// Stats Статистика доставки уведомлений
+type Stats struct {
+	Received     int            // Получено уведомлений
+	Deduplicated int            // Отброшено повторов
+	Suppressed   int            // Не доставлено ни по одному каналу из-за тихих часов
+	Delivered    map[string]int // Доставлено по каналам
+	Failed       map[string]int // Ошибок доставки по каналам
+}
+
+// AddChannel Добавляет канал доставки (или заменяет канал с тем же названием)
+func (o *Notifier) AddChannel(c Channel) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.channels[c.Name()] = c
+}
+
+func (o *Notifier) Start() error {
+	sub, err := o.client.Subscribe(o.topic, 100)
+	if err != nil {
+		return errors.Wrap(err, "Notifier.Start")
+	}
+
+	o.sub = sub
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+
+		for msg := range sub.C() {
+			m, err := messages.NewFromMQTT(msg)
+			if err != nil || m.GetType() != messages.MessageTypeEvent || m.GetName() != "on_notify" {
+				continue
+			}
+
+			n := &Notification{
+				Type:      messages.NotificationTypeNormal,
+				Text:      m.GetStringValueOr("msg", ""),
+				Publisher: m.GetPublisher(),
+				Time:      m.GetSentAt(),
+			}
+
+			if events.NotifyType(m.GetStringValueOr("type", "")) == events.NotifyTypeCritical {
+				n.Type = messages.NotificationTypeCritical
+			}
+
+			if err := o.Notify(n); err != nil {
+				o.logger.Error(errors.Wrap(err, "Notifier"))
+			}
+		}
+	}()
+
+	info.AddSection("notifier", func() interface{} { return o.GetStats() })
+
+	o.logger.Infof("Notifier: уведомления из %s доставляются по каналам %s", o.topic, strings.Join(o.channelNames(), ", "))
+
+	return nil
+}
+
+func (o *Notifier) Shutdown() error {
+	if err := o.sub.Unsubscribe(); err != nil {
+		return errors.Wrap(err, "Notifier.Shutdown")
+	}
+
+	o.wg.Wait()
+
+	return nil
+}
+
+// Notify Доставляет уведомление по каналам, выбранным правилами маршрутизации.
+// Возвращает ошибку, если уведомление не удалось доставить ни по одному из выбранных каналов.
+func (o *Notifier) Notify(n *Notification) error {
+	if n.Text == "" {
+		return errors.Wrap(errors.New("notification text is empty"), "Notify")
+	}
+
+	if n.Type == "" {
+		n.Type = messages.NotificationTypeNormal
+	}
+
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+
+	now := time.Now()
+
+	channels, key, ok := o.prepare(n, now)
+	if !ok {
+		return nil
+	}
+
+	var lastErr error
+	delivered := 0
+
+	for _, c := range channels {
+		if err := o.send(c, n); err != nil {
+			o.countDelivery(c.Name(), err)
+			lastErr = errors.Wrapf(err, "channel %s", c.Name())
+			o.logger.Warn(errors.Wrap(lastErr, "Notify"))
+			continue
+		}
+
+		o.countDelivery(c.Name(), nil)
+		delivered++
+	}
+
+	// Повторы отбрасываются, только если уведомление удалось доставить: иначе повтор - еще одна попытка доставки
+	if delivered > 0 {
+		o.markSent(key, now)
+	}
+
+	if delivered == 0 && lastErr != nil {
+		return errors.Wrap(lastErr, "Notify")
+	}
+
+	return nil
+}
+
+// Send Доставляет уведомление сервиса
+func (o *Notifier) Send(n *messages.Notification) error {
+	if err := o.Notify(&Notification{Type: n.Type, Text: n.Text, Publisher: info.Name}); err != nil {
+		return errors.Wrap(err, "Send")
+	}
+
+	return nil
+}
+
+// prepare Выбирает каналы доставки с учетом правил, тихих часов и дедупликации.
+// Возвращает также ключ дедупликации, который записывается после доставки (см. markSent).
+func (o *Notifier) prepare(n *Notification, now time.Time) ([]Channel, string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.stats.Received++
+
+	key := string(n.Type) + "\x00" + n.Publisher + "\x00" + n.Text
+
+	if o.dedupWindow > 0 {
+		if last, ok := o.sent[key]; ok && now.Sub(last) < o.dedupWindow {
+			o.stats.Deduplicated++
+			return nil, "", false
+		}
+	}
+
+	names := o.routes[n.Type]
+	if o.routes == nil {
+		names = o.sortedChannelNames()
+	}
+
+	if n.Type != messages.NotificationTypeCritical && o.quietHours.contains(now) {
+		names = intersect(names, o.quietChannels)
+	}
+
+	channels := make([]Channel, 0, len(names))
+	for _, name := range names {
+		if c, ok := o.channels[name]; ok {
+			channels = append(channels, c)
+		}
+	}
+
+	if len(channels) == 0 {
+		o.stats.Suppressed++
+		return nil, "", false
+	}
+
+	return channels, key, true
+}
+
+// markSent Запоминает время доставки уведомления для дедупликации
+func (o *Notifier) markSent(key string, now time.Time) {
+	if o.dedupWindow <= 0 {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.sent[key] = now
+
+	// Убираем устаревшие ключи, чтобы карта не росла
+	for k, t := range o.sent {
+		if now.Sub(t) >= o.dedupWindow {
+			delete(o.sent, k)
+		}
+	}
+}
+
+// send Отправляет уведомление по каналу с ограничением времени ожидания
+func (o *Notifier) send(c Channel, n *Notification) error {
+	done := make(chan error, 1)
+	go func() { done <- c.Send(n) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(o.timeout):
+		return errors.Errorf("timeout %s", o.timeout)
+	}
+}
+
+func (o *Notifier) countDelivery(channel string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err != nil {
+		o.stats.Failed[channel]++
+	} else {
+		o.stats.Delivered[channel]++
+	}
+}
+
+func (o *Notifier) GetStats() *Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	r := *o.stats
+	r.Delivered = make(map[string]int, len(o.stats.Delivered))
+	r.Failed = make(map[string]int, len(o.stats.Failed))
+
+	for k, v := range o.stats.Delivered {
+		r.Delivered[k] = v
+	}
+
+	for k, v := range o.stats.Failed {
+		r.Failed[k] = v
+	}
+
+	return &r
+}
+
+func (o *Notifier) channelNames() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.sortedChannelNames()
+}
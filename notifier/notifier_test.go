@@ -0,0 +1,221 @@
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/events"
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+)
+
+func TestNotifier(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu := sync.Mutex{}
+	var hooks []*Notification
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		n := &Notification{}
+		if err := json.Unmarshal(body, n); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		hooks = append(hooks, n)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	logFile := filepath.Join(t.TempDir(), "notify.log")
+
+	bus := client.NewBus()
+	pub := bus.NewClient("pub", "object_manager", "")
+
+	o, err := New(bus.NewClient("notifier", "notifier", ""), map[string]string{
+		"notify_webhook_url":     srv.URL,
+		"notify_webhook_headers": "Authorization=Bearer secret",
+		"notify_log_file":        logFile,
+		"notify_routes":          "critical=webhook,log; normal=log",
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(text string, notifyType events.NotifyType) {
+		msg, err := events.NewOnNotifyMessage("object_manager/event/service", text, notifyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := pub.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("Контроллер не отвечает", events.NotifyTypeCritical)
+	send("Контроллер не отвечает", events.NotifyTypeCritical) // Повтор
+	send("Обновление установлено", events.NotifyTypeNonCritical)
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := o.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(hooks) != 1 || hooks[0].Type != messages.NotificationTypeCritical || hooks[0].Text != "Контроллер не отвечает" {
+		t.Fatalf("unexpected webhook notifications %+v", hooks)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Fatalf("unexpected log file:\n%s", data)
+	}
+
+	stats := o.GetStats()
+	if stats.Received != 3 || stats.Deduplicated != 1 || stats.Delivered[ChannelWebhook] != 1 || stats.Delivered[ChannelLog] != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestNotifier_QuietHours(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := New(client.NewBus().NewClient("notifier", "notifier", ""), map[string]string{
+		"notify_webhook_url":  "http://127.0.0.1:1/hook",
+		"notify_log_file":     filepath.Join(t.TempDir(), "notify.log"),
+		"notify_quiet_hours":  "22:00-07:00",
+		"notify_dedup_window": "0",
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	night := time.Date(2024, 3, 1, 23, 30, 0, 0, time.Local)
+	morning := time.Date(2024, 3, 2, 6, 59, 0, 0, time.Local)
+
+	tests := []struct {
+		notifyType messages.NotificationType
+		now        time.Time
+		want       []string
+	}{
+		{messages.NotificationTypeNormal, day, []string{ChannelLog, ChannelWebhook}},
+		{messages.NotificationTypeNormal, night, []string{ChannelLog}},
+		{messages.NotificationTypeNormal, morning, []string{ChannelLog}},
+		{messages.NotificationTypeCritical, night, []string{ChannelLog, ChannelWebhook}},
+	}
+
+	for _, tt := range tests {
+		channels, _, _ := o.prepare(&Notification{Type: tt.notifyType, Text: "test"}, tt.now)
+
+		var got []string
+		for _, c := range channels {
+			got = append(got, c.Name())
+		}
+
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Fatalf("%s at %s: got %v, want %v", tt.notifyType, tt.now.Format("15:04"), got, tt.want)
+		}
+	}
+
+	if _, err := parseQuietHours("22-07"); err == nil {
+		t.Fatal("expected error for bad quiet hours")
+	}
+
+	if _, err := parseRoutes("critical=sms", o.channels); err == nil {
+		t.Fatal("expected error for unknown channel")
+	}
+}
+
+// flakyChannel Канал журнала, доставка по которому не удается, пока fail = true
+type flakyChannel struct {
+	fail bool
+	sent int
+}
+
+func (o *flakyChannel) Name() string {
+	return ChannelLog
+}
+
+func (o *flakyChannel) Send(*Notification) error {
+	if o.fail {
+		return errors.New("unavailable")
+	}
+
+	o.sent++
+	return nil
+}
+
+func TestNotifier_DedupAfterFailure(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := New(client.NewBus().NewClient("notifier", "notifier", ""), map[string]string{
+		"notify_log_file": filepath.Join(t.TempDir(), "notify.log"),
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Заменяем канал журнала
+	c := &flakyChannel{fail: true}
+	o.AddChannel(c)
+
+	n := &Notification{Type: messages.NotificationTypeCritical, Text: "Контроллер не отвечает"}
+	if err := o.Notify(n); err == nil {
+		t.Fatal("expected delivery error")
+	}
+
+	// Недоставленное уведомление не считается повтором
+	c.fail = false
+	if err := o.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := o.GetStats(); c.sent != 1 || stats.Deduplicated != 1 || stats.Failed[ChannelLog] != 1 {
+		t.Fatalf("sent = %d, stats %+v", c.sent, stats)
+	}
+}
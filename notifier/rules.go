@@ -0,0 +1,142 @@
+package notifier
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+)
+
+// parseRoutes Разбирает правила маршрутизации вида "critical=webhook,smtp;normal=log".
+// Пустые правила - все уведомления доставляются по всем каналам.
+func parseRoutes(s string, channels map[string]Channel) (map[messages.NotificationType][]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	r := make(map[messages.NotificationType][]string)
+
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Wrap(errors.Errorf("bad route %q, expected <type>=<channel>,...", item), "parseRoutes")
+		}
+
+		notifyType := messages.NotificationType(strings.TrimSpace(kv[0]))
+		if notifyType != messages.NotificationTypeNormal && notifyType != messages.NotificationTypeCritical {
+			return nil, errors.Wrap(errors.Errorf("bad route %q: unknown notification type %q", item, notifyType), "parseRoutes")
+		}
+
+		names, err := parseChannelList(kv[1], channels)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseRoutes")
+		}
+
+		r[notifyType] = names
+	}
+
+	return r, nil
+}
+
+// parseChannelList Разбирает список каналов через запятую. Все каналы должны быть настроены.
+func parseChannelList(s string, channels map[string]Channel) ([]string, error) {
+	var r []string
+
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		if _, ok := channels[name]; !ok {
+			return nil, errors.Wrap(errors.Errorf("channel %q is not configured", name), "parseChannelList")
+		}
+
+		r = append(r, name)
+	}
+
+	return r, nil
+}
+
+// quietHours Тихие часы: интервал локального времени суток, может переходить через полночь
+type quietHours struct {
+	from time.Duration // От начала суток
+	to   time.Duration
+}
+
+// parseQuietHours Разбирает интервал вида "22:00-07:00"
+func parseQuietHours(s string) (*quietHours, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil, nil
+	}
+
+	items := strings.Split(s, "-")
+	if len(items) != 2 {
+		return nil, errors.Wrap(errors.Errorf("bad quiet hours %q, expected HH:MM-HH:MM", s), "parseQuietHours")
+	}
+
+	r := &quietHours{}
+	for i, item := range items {
+		t, err := time.Parse("15:04", strings.TrimSpace(item))
+		if err != nil {
+			return nil, errors.Wrap(errors.Errorf("bad quiet hours %q, expected HH:MM-HH:MM", s), "parseQuietHours")
+		}
+
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			r.from = d
+		} else {
+			r.to = d
+		}
+	}
+
+	return r, nil
+}
+
+// contains Проверяет, попадает ли время в тихие часы
+func (o *quietHours) contains(t time.Time) bool {
+	if o == nil || o.from == o.to {
+		return false
+	}
+
+	t = t.Local()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	if o.from < o.to {
+		return d >= o.from && d < o.to
+	}
+
+	// Интервал через полночь
+	return d >= o.from || d < o.to
+}
+
+func intersect(a, b []string) []string {
+	var r []string
+
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				r = append(r, x)
+				break
+			}
+		}
+	}
+
+	return r
+}
+
+func (o *Notifier) sortedChannelNames() []string {
+	r := make([]string, 0, len(o.channels))
+	for name := range o.channels {
+		r = append(r, name)
+	}
+
+	sort.Strings(r)
+
+	return r
+}
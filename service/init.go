@@ -13,4 +13,5 @@ import (
 	_ "github.com/VladimirDronik/touchon-server/events/object/sensor"
 	_ "github.com/VladimirDronik/touchon-server/events/object/wiren_board/wb_mrm2_mini"
 	_ "github.com/VladimirDronik/touchon-server/events/script"
+	_ "github.com/VladimirDronik/touchon-server/events/service"
 )
@@ -5,8 +5,10 @@ import (
 
 	"github.com/VladimirDronik/touchon-server/config"
 	"github.com/VladimirDronik/touchon-server/helpers"
+	"github.com/VladimirDronik/touchon-server/http/server"
 	"github.com/VladimirDronik/touchon-server/info"
 	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/broker"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -48,10 +50,43 @@ func Prolog(banner string, configDefaults map[string]string, version, buildAt st
 
 	logger.Debugf("ENV: %#v", cfg)
 
+	// Встроенный MQTT брокер запускаем до подключения клиентов к шине
+	if cfg["mqtt_broker_enabled"] == "true" {
+		broker.I, err = broker.New(cfg, logger)
+		if err != nil {
+			return nil, nil, nil, nil, errors.Wrap(err, "Prolog")
+		}
+
+		if err := broker.I.Start(); err != nil {
+			return nil, nil, nil, nil, errors.Wrap(err, "Prolog")
+		}
+
+		info.AddSection("mqtt_broker", func() interface{} { return broker.I.GetStats() })
+	}
+
 	db, err := helpers.NewDB(cfg["database_url"])
 	if err != nil {
 		return nil, nil, nil, nil, errors.Wrap(err, "Prolog")
 	}
 
+	// Доступность БД проверяется в /_/health/ready всех HTTP-серверов сервиса
+	server.RegisterHealthCheck("db", server.DBCheck(db))
+
 	return cfg, logger, rb, db, nil
 }
+
+// Epilog Освобождает ресурсы, захваченные в Prolog: останавливает встроенный MQTT брокер.
+// Вызывается при завершении сервиса после остановки клиентов шины.
+func Epilog() error {
+	if broker.I == nil {
+		return nil
+	}
+
+	if err := broker.I.Shutdown(); err != nil {
+		return errors.Wrap(err, "Epilog")
+	}
+
+	broker.I = nil
+
+	return nil
+}
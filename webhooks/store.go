@@ -0,0 +1,207 @@
+package webhooks
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var ErrNotFound = errors.New("subscription not found")
+
+// Subscription Подписка на события
+type Subscription struct {
+	ID         int               `json:"id" gorm:"primaryKey"`
+	Name       string            `json:"name"`                                     // Описание подписки
+	Events     []string          `json:"events" gorm:"serializer:json"`            // Коды событий, допускаются шаблоны: object.sensor.*, *.on_alarm. Пустой список - все события
+	TargetType string            `json:"target_type,omitempty"`                    // Тип цели (пустой - любой)
+	TargetID   int               `json:"target_id,omitempty"`                      // ID цели (0 - любая)
+	URL        string            `json:"url"`                                      // Адрес, на который отправляется POST-запрос
+	Headers    map[string]string `json:"headers,omitempty" gorm:"serializer:json"` // Дополнительные заголовки запроса
+	Secret     string            `json:"secret,omitempty"`                         // Секрет подписи HMAC-SHA256 (в ответах не возвращается)
+	Enabled    bool              `json:"enabled"`                                  //
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+func (o *Subscription) TableName() string {
+	return "webhook_subscriptions"
+}
+
+// Check Проверяет подписку
+func (o *Subscription) Check() error {
+	u, err := url.Parse(o.URL)
+	switch {
+	case err != nil:
+		return errors.Wrap(err, "Subscription.Check")
+	case u.Scheme != "http" && u.Scheme != "https", u.Host == "":
+		return errors.Wrap(errors.Errorf("bad url %q, expected http(s)://host/...", o.URL), "Subscription.Check")
+	case o.TargetType != "" && !messages.TargetTypes[o.TargetType]:
+		return errors.Wrap(errors.Errorf("unknown target type %q", o.TargetType), "Subscription.Check")
+	case o.TargetID < 0:
+		return errors.Wrap(errors.New("target_id < 0"), "Subscription.Check")
+	}
+
+	for _, pattern := range o.Events {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			return errors.Wrap(errors.Errorf("bad event pattern %q", pattern), "Subscription.Check")
+		}
+	}
+
+	return nil
+}
+
+// Match Проверяет, подходит ли событие под подписку
+func (o *Subscription) Match(m messages.Message) bool {
+	switch {
+	case !o.Enabled:
+		return false
+	case o.TargetType != "" && o.TargetType != m.GetTargetType():
+		return false
+	case o.TargetID != 0 && o.TargetID != m.GetTargetID():
+		return false
+	case len(o.Events) == 0:
+		return true
+	}
+
+	for _, pattern := range o.Events {
+		if ok, _ := path.Match(pattern, m.GetName()); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Delivery Запись журнала доставки
+type Delivery struct {
+	ID             int       `json:"id" gorm:"primaryKey"`
+	SubscriptionID int       `json:"subscription_id" gorm:"index"`
+	DeliveryID     string    `json:"delivery_id"` // Значение заголовка X-Touchon-Delivery
+	Event          string    `json:"event"`
+	TargetType     string    `json:"target_type,omitempty"`
+	TargetID       int       `json:"target_id,omitempty"`
+	Success        bool      `json:"success"`
+	Attempts       int       `json:"attempts"`              // Количество попыток
+	StatusCode     int       `json:"status_code,omitempty"` // Код ответа последней попытки
+	Error          string    `json:"error,omitempty"`       // Ошибка последней попытки
+	Duration       float64   `json:"duration"`              // Длительность доставки с учетом повторов, с
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (o *Delivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// NewStore Создает хранилище подписок, при необходимости создает таблицы
+func NewStore(db *gorm.DB) (*Store, error) {
+	if db == nil {
+		return nil, errors.Wrap(errors.New("db is nil"), "NewStore")
+	}
+
+	if err := db.AutoMigrate(&Subscription{}, &Delivery{}); err != nil {
+		return nil, errors.Wrap(err, "NewStore")
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Store Хранилище подписок и журнала доставки
+type Store struct {
+	db *gorm.DB
+}
+
+func (o *Store) GetSubscriptions() ([]*Subscription, error) {
+	var r []*Subscription
+	if err := o.db.Order("id").Find(&r).Error; err != nil {
+		return nil, errors.Wrap(err, "GetSubscriptions")
+	}
+
+	return r, nil
+}
+
+func (o *Store) GetSubscription(id int) (*Subscription, error) {
+	r := &Subscription{}
+	err := o.db.First(r, id).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, errors.Wrapf(ErrNotFound, "GetSubscription(%d)", id)
+	case err != nil:
+		return nil, errors.Wrap(err, "GetSubscription")
+	}
+
+	return r, nil
+}
+
+// SaveSubscription Создает (ID = 0) или обновляет подписку
+func (o *Store) SaveSubscription(s *Subscription) error {
+	if err := s.Check(); err != nil {
+		return errors.Wrap(err, "SaveSubscription")
+	}
+
+	if s.ID != 0 {
+		if _, err := o.GetSubscription(s.ID); err != nil {
+			return errors.Wrap(err, "SaveSubscription")
+		}
+	}
+
+	if err := o.db.Save(s).Error; err != nil {
+		return errors.Wrap(err, "SaveSubscription")
+	}
+
+	return nil
+}
+
+func (o *Store) DeleteSubscription(id int) error {
+	r := o.db.Delete(&Subscription{}, id)
+	switch {
+	case r.Error != nil:
+		return errors.Wrap(r.Error, "DeleteSubscription")
+	case r.RowsAffected == 0:
+		return errors.Wrapf(ErrNotFound, "DeleteSubscription(%d)", id)
+	}
+
+	if err := o.db.Where("subscription_id = ?", id).Delete(&Delivery{}).Error; err != nil {
+		return errors.Wrap(err, "DeleteSubscription")
+	}
+
+	return nil
+}
+
+// AddDelivery Добавляет запись в журнал доставки, оставляя в журнале не более keep последних записей
+func (o *Store) AddDelivery(d *Delivery, keep int) error {
+	if err := o.db.Create(d).Error; err != nil {
+		return errors.Wrap(err, "AddDelivery")
+	}
+
+	if keep > 0 && d.ID > keep {
+		if err := o.db.Where("id <= ?", d.ID-keep).Delete(&Delivery{}).Error; err != nil {
+			return errors.Wrap(err, "AddDelivery")
+		}
+	}
+
+	return nil
+}
+
+// GetDeliveries Возвращает последние записи журнала доставки подписки (subscriptionID = 0 - всех подписок)
+func (o *Store) GetDeliveries(subscriptionID, limit int) ([]*Delivery, error) {
+	q := o.db.Order("id DESC")
+	if subscriptionID != 0 {
+		q = q.Where("subscription_id = ?", subscriptionID)
+	}
+
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var r []*Delivery
+	if err := q.Find(&r).Error; err != nil {
+		return nil, errors.Wrap(err, "GetDeliveries")
+	}
+
+	return r, nil
+}
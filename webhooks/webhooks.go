@@ -0,0 +1,398 @@
+// Пакет исходящих webhook'ов: при появлении в шине событий, подходящих под подписку,
+// отправляет на адрес подписки POST-запрос с JSON события.
+//
+// Подписки хранятся в БД сервиса и управляются через эндпоинты /_/webhooks.
+// Запрос содержит заголовки:
+//
+//	X-Touchon-Event     - код события
+//	X-Touchon-Delivery  - уникальный ID доставки (одинаковый для повторов)
+//	X-Touchon-Timestamp - unix-время отправки, с
+//	X-Touchon-Signature - "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + тело)), если задан секрет
+//
+// Настройки:
+//
+//	webhooks_topic       = "+/event/#" # Топики, в которых публикуются события
+//	webhooks_retries     = "3"         # Количество повторов при ошибке доставки
+//	webhooks_retry_delay = "1s"        # Задержка перед первым повтором, далее удваивается
+//	webhooks_workers     = "4"         # Количество одновременных доставок
+//	webhooks_queue_size  = "1000"      # Размер очереди доставки
+//	webhooks_log_size    = "1000"      # Количество хранимых записей журнала доставки
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	httpClient "github.com/VladimirDronik/touchon-server/http/client"
+	topics "github.com/VladimirDronik/touchon-server/mqtt"
+	mqtt "github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Global instance
+var I *Service
+
+const (
+	DefaultTopic      = "+/event/#"
+	DefaultRetries    = 3
+	DefaultRetryDelay = time.Second
+	DefaultWorkers    = 4
+	DefaultQueueSize  = 1000
+	DefaultLogSize    = 1000
+)
+
+// Event Тело запроса webhook'а
+type Event struct {
+	Event      string                 `json:"event"`
+	TargetType string                 `json:"target_type,omitempty"`
+	TargetID   int                    `json:"target_id,omitempty"`
+	Publisher  string                 `json:"publisher,omitempty"`
+	SentAt     time.Time              `json:"sent_at"`
+	Payload    map[string]interface{} `json:"payload,omitempty"`
+}
+
+// New Создает сервис webhook'ов. Реплики сервиса делят события через общую подписку группы mqtt_share_group.
+func New(client mqtt.Client, db *gorm.DB, cfg map[string]string, logger *logrus.Logger) (*Service, error) {
+	switch {
+	case client == nil:
+		return nil, errors.Wrap(errors.New("client is nil"), "webhooks.New")
+	case logger == nil:
+		return nil, errors.Wrap(errors.New("logger is nil"), "webhooks.New")
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "webhooks.New")
+	}
+
+	o := &Service{
+		client:     client,
+		store:      store,
+		http:       httpClient.New(),
+		topic:      cfg["webhooks_topic"],
+		logger:     logger,
+		retries:    DefaultRetries,
+		retryDelay: DefaultRetryDelay,
+		workers:    DefaultWorkers,
+		logSize:    DefaultLogSize,
+		done:       make(chan struct{}),
+	}
+
+	if o.topic == "" {
+		o.topic = DefaultTopic
+	}
+
+	o.topic = topics.SharedTopic(cfg["mqtt_share_group"], o.topic)
+
+	queueSize := DefaultQueueSize
+
+	for key, v := range map[string]*int{
+		"webhooks_retries":    &o.retries,
+		"webhooks_workers":    &o.workers,
+		"webhooks_queue_size": &queueSize,
+		"webhooks_log_size":   &o.logSize,
+	} {
+		if s := cfg[key]; s != "" {
+			if *v, err = strconv.Atoi(s); err != nil || *v < 0 {
+				return nil, errors.Wrap(errors.Errorf("bad %s %q", key, s), "webhooks.New")
+			}
+		}
+	}
+
+	if s := cfg["webhooks_retry_delay"]; s != "" {
+		if o.retryDelay, err = time.ParseDuration(s); err != nil {
+			return nil, errors.Wrap(err, "webhooks.New")
+		}
+	}
+
+	o.workers = max(o.workers, 1)
+	o.queue = make(chan *job, queueSize)
+
+	if err := o.reload(); err != nil {
+		return nil, errors.Wrap(err, "webhooks.New")
+	}
+
+	return o, nil
+}
+
+type Service struct {
+	client     mqtt.Client
+	sub        *mqtt.Subscription
+	store      *Store
+	http       *httpClient.Client
+	topic      string
+	logger     *logrus.Logger
+	retries    int
+	retryDelay time.Duration
+	workers    int
+	logSize    int
+	queue      chan *job
+
+	mu            sync.RWMutex
+	subscriptions []*Subscription // Подписки из БД
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+// job Доставка события подписчику
+type job struct {
+	subscription *Subscription
+	event        *Event
+	deliveryID   string
+}
+
+func (o *Service) GetStore() *Store {
+	return o.store
+}
+
+func (o *Service) Start() error {
+	sub, err := o.client.Subscribe(o.topic, 100)
+	if err != nil {
+		return errors.Wrap(err, "webhooks.Start")
+	}
+
+	o.sub = sub
+
+	o.wg.Add(1 + o.workers)
+
+	go func() {
+		defer o.wg.Done()
+		defer close(o.queue)
+
+		for msg := range sub.C() {
+			m, err := messages.NewFromMQTT(msg)
+			if err != nil || m.GetType() != messages.MessageTypeEvent {
+				continue
+			}
+
+			o.dispatch(m)
+		}
+	}()
+
+	for i := 0; i < o.workers; i++ {
+		go func() {
+			defer o.wg.Done()
+
+			for j := range o.queue {
+				o.deliver(j)
+			}
+		}()
+	}
+
+	o.logger.Infof("Webhooks: события из %s отправляются подписчикам", o.topic)
+
+	return nil
+}
+
+func (o *Service) Shutdown() error {
+	close(o.done)
+
+	if err := o.sub.Unsubscribe(); err != nil {
+		return errors.Wrap(err, "webhooks.Shutdown")
+	}
+
+	o.wg.Wait()
+
+	return nil
+}
+
+// reload Перечитывает подписки из БД. Вызывается после изменения подписок.
+func (o *Service) reload() error {
+	items, err := o.store.GetSubscriptions()
+	if err != nil {
+		return errors.Wrap(err, "reload")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.subscriptions = items
+
+	return nil
+}
+
+// SaveSubscription Создает или обновляет подписку
+func (o *Service) SaveSubscription(s *Subscription) error {
+	if err := o.store.SaveSubscription(s); err != nil {
+		return errors.Wrap(err, "webhooks.SaveSubscription")
+	}
+
+	if err := o.reload(); err != nil {
+		return errors.Wrap(err, "webhooks.SaveSubscription")
+	}
+
+	return nil
+}
+
+func (o *Service) DeleteSubscription(id int) error {
+	if err := o.store.DeleteSubscription(id); err != nil {
+		return errors.Wrap(err, "webhooks.DeleteSubscription")
+	}
+
+	if err := o.reload(); err != nil {
+		return errors.Wrap(err, "webhooks.DeleteSubscription")
+	}
+
+	return nil
+}
+
+// dispatch Ставит в очередь доставку события всем подходящим подписчикам
+func (o *Service) dispatch(m messages.Message) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var e *Event
+
+	for _, s := range o.subscriptions {
+		if !s.Match(m) {
+			continue
+		}
+
+		if e == nil {
+			e = &Event{
+				Event:      m.GetName(),
+				TargetType: m.GetTargetType(),
+				TargetID:   m.GetTargetID(),
+				Publisher:  m.GetPublisher(),
+				SentAt:     m.GetSentAt(),
+				Payload:    m.GetPayload(),
+			}
+		}
+
+		j := &job{subscription: s, event: e, deliveryID: newDeliveryID()}
+
+		select {
+		case o.queue <- j:
+		default:
+			o.logDelivery(j, &Delivery{Error: "delivery queue is full"})
+		}
+	}
+}
+
+// deliver Доставляет событие подписчику с повторами
+func (o *Service) deliver(j *job) {
+	start := time.Now()
+	d := &Delivery{}
+
+	body, err := json.Marshal(j.event)
+	if err != nil {
+		d.Error = err.Error()
+		o.logDelivery(j, d)
+		return
+	}
+
+	// При остановке сервиса оставшиеся в очереди доставки не выполняются, а отмечаются в журнале
+	select {
+	case <-o.done:
+		d.Error = "delivery canceled"
+		o.logDelivery(j, d)
+		return
+	default:
+	}
+
+	delay := o.retryDelay
+
+	for attempt := 0; attempt <= o.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-o.done:
+				d.Error += " (delivery canceled)"
+				d.Duration = time.Since(start).Seconds()
+				o.logDelivery(j, d)
+				return
+			}
+		}
+
+		d.Attempts++
+		d.StatusCode, err = o.send(j, body)
+		if err == nil {
+			d.Success = true
+			d.Error = ""
+			break
+		}
+
+		d.Error = err.Error()
+	}
+
+	d.Duration = time.Since(start).Seconds()
+	o.logDelivery(j, d)
+}
+
+// send Отправляет запрос подписчику
+func (o *Service) send(j *job, body []byte) (int, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	headers := make(map[string]string, len(j.subscription.Headers)+5)
+	for k, v := range j.subscription.Headers {
+		headers[k] = v
+	}
+
+	headers["Content-Type"] = "application/json"
+	headers["X-Touchon-Event"] = j.event.Event
+	headers["X-Touchon-Delivery"] = j.deliveryID
+	headers["X-Touchon-Timestamp"] = ts
+
+	if j.subscription.Secret != "" {
+		headers["X-Touchon-Signature"] = Sign(j.subscription.Secret, ts, body)
+	}
+
+	status, respBody, err := o.http.Send(http.MethodPost, j.subscription.URL, headers, body)
+	if err != nil {
+		return 0, errors.Wrap(err, "send")
+	}
+
+	if status < 200 || status > 299 {
+		if len(respBody) > 200 {
+			respBody = respBody[:200]
+		}
+
+		return status, errors.Wrap(errors.Errorf("HTTP#%d %s", status, string(respBody)), "send")
+	}
+
+	return status, nil
+}
+
+func (o *Service) logDelivery(j *job, d *Delivery) {
+	d.SubscriptionID = j.subscription.ID
+	d.DeliveryID = j.deliveryID
+	d.Event = j.event.Event
+	d.TargetType = j.event.TargetType
+	d.TargetID = j.event.TargetID
+
+	if !d.Success {
+		o.logger.Warnf("Webhooks: событие %s не доставлено подписчику #%d (%s): %s", d.Event, d.SubscriptionID, j.subscription.URL, d.Error)
+	}
+
+	if err := o.store.AddDelivery(d, o.logSize); err != nil {
+		o.logger.Error(errors.Wrap(err, "logDelivery"))
+	}
+}
+
+// Sign Возвращает подпись запроса (значение заголовка X-Touchon-Signature)
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
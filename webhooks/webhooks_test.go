@@ -0,0 +1,136 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VladimirDronik/touchon-server/models"
+	"github.com/VladimirDronik/touchon-server/mqtt/client"
+	"github.com/VladimirDronik/touchon-server/mqtt/messages"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestWebhooks(t *testing.T) {
+	logger, err := models.NewLogger("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	var requests atomic.Int32
+	received := make(chan *Event, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if Sign("secret", r.Header.Get("X-Touchon-Timestamp"), body) != r.Header.Get("X-Touchon-Signature") ||
+			r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Первая попытка завершается ошибкой, доставка повторяется
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		e := &Event{}
+		if err := json.Unmarshal(body, e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- e
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	bus := client.NewBus()
+	pub := bus.NewClient("pub", "object_manager", "")
+
+	o, err := New(bus.NewClient("webhooks", "webhooks", ""), db, map[string]string{"webhooks_retry_delay": "10ms"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.SaveSubscription(&Subscription{URL: "ftp://example.com"}); err == nil {
+		t.Fatal("expected error for bad url")
+	}
+
+	s := &Subscription{
+		Name:       "alarms",
+		Events:     []string{"object.controller.*", "*.on_alarm"},
+		TargetType: messages.TargetTypeObject,
+		URL:        srv.URL + "/hook",
+		Headers:    map[string]string{"X-Api-Key": "key"},
+		Secret:     "secret",
+		Enabled:    true,
+	}
+
+	if err := o.SaveSubscription(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"object.relay.on_state_on", "object.controller.on_unavailable"} {
+		msg, err := messages.NewEvent(name, messages.TargetTypeObject, 5, map[string]interface{}{"level": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.SetTopic("object_manager/event/object")
+
+		if err := pub.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case e := <-received:
+		if e.Event != "object.controller.on_unavailable" || e.TargetID != 5 || e.Payload["level"] != float64(1) {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event is not delivered")
+	}
+
+	if err := o.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, err := o.GetStore().GetDeliveries(s.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || !deliveries[0].Success || deliveries[0].Attempts != 2 || deliveries[0].StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected deliveries %+v", deliveries)
+	}
+
+	if err := o.DeleteSubscription(s.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.GetStore().GetSubscription(s.ID); err == nil {
+		t.Fatal("subscription is not deleted")
+	}
+}